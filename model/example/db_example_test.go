@@ -6,6 +6,7 @@ import (
 
 	"github.com/usthooz/oozkits/model/mysql"
 	"github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
 	ozlog "github.com/usthooz/oozlog/go"
 )
 
@@ -17,9 +18,13 @@ func init() {
 		Host:     "127.0.0.1",
 		Port:     3306,
 	}
+	rds, err := redistest.NewServer()
+	if err != nil {
+		ozlog.Fatalf("redistest.NewServer err->%v", err)
+	}
 	redisConfig := &redis.Config{
 		ForSingle: redis.SingleConfig{
-			Addr: "127.0.0.1:6379",
+			Addr: rds.Addr(),
 		},
 		DeployType: "single",
 	}
@@ -38,6 +38,7 @@ type CacheDB struct {
 	cacheExpire       time.Duration
 	typeName          string
 	module            *redis.Module
+	keyFilter         redis.KeyFilterGuard
 }
 
 // ErrCacheIsNil db cache(redis) is nil
@@ -169,12 +170,16 @@ func (c *CacheDB) GetCache(destStructPtr Cacheable, fields ...string) error {
 	if err != nil {
 		return err
 	}
-	if c.DB.dbConfig.CloseCache {
+	if c.DB.dbConfig.CloseCache || c.Cache.CacheBypassed() {
 		// cache is closed
 		return c.WitchCollection(func(collect *mgo.Collection) error {
 			return collect.Find(c.CreateGetQuery(cacheKey.Values, fields...)).One(destStructPtr)
 		})
 	}
+	// the key filter has never seen this key
+	if !c.keyFilter.MayExist(cacheKey.Key) {
+		return ErrNotFound
+	}
 	var (
 		key                 = cacheKey.Key
 		gettedFirstCacheKey = cacheKey.isPri
@@ -263,6 +268,61 @@ func (c *CacheDB) GetCache(destStructPtr Cacheable, fields ...string) error {
 	return err
 }
 
+// DeleteCache deletes the cache of the document by fields, call it after the
+// document is written. If it fails while the cache is bypassed, the keys are
+// deleted when the breaker closes.
+func (c *CacheDB) DeleteCache(structPtr Cacheable, fields ...string) error {
+	if c.DB.dbConfig.CloseCache {
+		return nil
+	}
+	cacheKey, err := c.CreateCacheKey(structPtr, fields...)
+	if err != nil {
+		return err
+	}
+	var keys = []string{cacheKey.Key}
+	// secondary cache
+	if !cacheKey.isPri {
+		firstKey, err := c.Cache.Get(cacheKey.Key).Result()
+		if err == nil {
+			keys = append(keys, firstKey)
+		} else if !redis.IsRedisNil(err) && c.Cache.CacheBypassed() {
+			// the primary key of the document, if set.
+			if firstKey, err = c.createPrikey(structPtr); err == nil {
+				keys = append(keys, firstKey)
+			}
+		}
+	}
+	return c.Cache.InvalidateCache(keys...)
+}
+
+// SetKeyFilter sets the filter(.e.g. *redis.BloomFilter) of the cache keys.
+// The filter is not consulted until SetKeyFilterSeeded is called: add the keys
+// of the existing documents by SeedKeyFilter first. Then GetCache returns
+// ErrNotFound at once for the keys the filter has never seen when the cache is
+// used. The filter does not learn from the reads, the documents inserted later
+// must be seeded too.
+func (c *CacheDB) SetKeyFilter(filter redis.KeyFilter) *CacheDB {
+	c.keyFilter.SetFilter(filter)
+	return c
+}
+
+// SetKeyFilterSeeded marks the keys of the existing documents seeded, the key
+// filter is consulted from then on.
+func (c *CacheDB) SetKeyFilterSeeded() *CacheDB {
+	c.keyFilter.SetSeeded()
+	return c
+}
+
+// SeedKeyFilter adds the cache key of the document by fields(the primary key
+// if none) to the key filter.
+func (c *CacheDB) SeedKeyFilter(structPtr Cacheable, fields ...string) error {
+	cacheKey, err := c.CreateCacheKey(structPtr, fields...)
+	if err != nil {
+		return err
+	}
+	return c.keyFilter.Add(cacheKey.Key)
+}
+
 // checkSecondCache
 func (c *CacheDB) checkSecondCache(destStructPtr Cacheable, fields []string, values []interface{}) bool {
 	v := reflect.ValueOf(destStructPtr).Elem()
@@ -75,6 +75,8 @@ func (p *PreDB) RegisterCacheableDB(ormStructPtr Cacheable, cacheExpire time.Dur
 		preFunc     = func() error {
 			_cacheableDB, err := p.DB.RegisterCacheDB(ormStructPtr, cacheExpire)
 			if err == nil {
+				// keep the key filter set before init
+				_cacheableDB.keyFilter = cacheableDB.keyFilter
 				*cacheableDB = *_cacheableDB
 				p.DB.cacheDBs[tableName] = cacheableDB
 			}
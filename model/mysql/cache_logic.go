@@ -186,10 +186,14 @@ func (c *CacheDB) GetCache(structPtr Cacheable, fields ...string) error {
 		return err
 	}
 	// use redis cache
-	if c.DB.dbConfig.CloseCache {
+	if c.DB.dbConfig.CloseCache || c.Cache.CacheBypassed() {
 		// get cache
 		return c.DB.Get(structPtr, c.CreateGetQuery(fields...), cacheKey.FieldValues...)
 	}
+	// the key filter has never seen this key
+	if !c.keyFilter.MayExist(cacheKey.Key) {
+		return ErrNoRows
+	}
 	var (
 		key              = cacheKey.Key
 		getFirstCacheKey = cacheKey.isPriKey
@@ -312,7 +316,7 @@ func (c *CacheDB) GetCacheByWhere(structPtr Cacheable, whereNamedCond string) er
 		return err
 	}
 	structElemValue := reflect.ValueOf(structPtr).Elem()
-	if c.DB.dbConfig.CloseCache {
+	if c.DB.dbConfig.CloseCache || c.Cache.CacheBypassed() {
 		// read db
 		return c.DB.Get(structPtr, c.createGetQueryByWhere(whereCond), cacheKey.FieldValues...)
 	}
@@ -400,7 +404,7 @@ func (c *CacheDB) DeleteCache(structPtr Cacheable, fields ...string) error {
 	if c.DB.dbConfig.CloseCache {
 		return nil
 	}
-	cacheKey, _, err := c.CreateCacheKey(structPtr, fields...)
+	cacheKey, structElemValue, err := c.CreateCacheKey(structPtr, fields...)
 	if err != nil {
 		return err
 	}
@@ -411,9 +415,24 @@ func (c *CacheDB) DeleteCache(structPtr Cacheable, fields ...string) error {
 		firstKey, err := c.Cache.Get(cacheKey.Key).Result()
 		if err == nil {
 			keys = append(keys, firstKey)
+		} else if !redis.IsRedisNil(err) && c.Cache.CacheBypassed() {
+			// the primary key of the row, if set.
+			if firstKey, err = c.createPrikey(structElemValue); err == nil {
+				keys = append(keys, firstKey)
+			}
 		}
 	}
-	return c.Cache.Del(keys...).Err()
+	return c.Cache.InvalidateCache(keys...)
+}
+
+// cacheWriteErr returns err of the cache write, or logs it and invalidates
+// the keys once the breaker closes if the cache is bypassed.
+func (c *CacheDB) cacheWriteErr(method string, err error, keys ...string) error {
+	if err != nil && c.Cache.CacheBypassed() {
+		ozlog.Errorf("%s(): cache bypassed: %s", method, err.Error())
+		return c.Cache.InvalidateCache(keys...)
+	}
+	return err
 }
 
 // PutCache
@@ -425,13 +444,16 @@ func (c *CacheDB) PutCache(structPtr Cacheable, fields ...string) error {
 	if err != nil {
 		return err
 	}
+	if err = c.keyFilter.Add(cacheKey.Key); err != nil {
+		ozlog.Errorf("PutCache(): add filter key: %s", err.Error())
+	}
 	data, err := json.Marshal(structPtr)
 	if err != nil {
 		return err
 	}
 	key := cacheKey.Key
 	if cacheKey.isPriKey {
-		return c.Cache.Set(key, data, c.cacheExpire).Err()
+		return c.cacheWriteErr("PutCache", c.Cache.Set(key, data, c.cacheExpire).Err(), key)
 	}
 	key, err = c.createPrikey(structElemValue)
 	if err != nil {
@@ -439,7 +461,7 @@ func (c *CacheDB) PutCache(structPtr Cacheable, fields ...string) error {
 	}
 	err = c.Cache.Set(key, data, c.cacheExpire).Err()
 	if err != nil {
-		return err
+		return c.cacheWriteErr("PutCache", err, key, cacheKey.Key)
 	}
-	return c.Cache.Set(cacheKey.Key, key, c.cacheExpire).Err()
+	return c.cacheWriteErr("PutCache", c.Cache.Set(cacheKey.Key, key, c.cacheExpire).Err(), cacheKey.Key)
 }
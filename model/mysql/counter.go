@@ -0,0 +1,333 @@
+package mysql
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usthooz/oozkits/model/redis"
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// ErrCounterTable counter table is not set.
+var ErrCounterTable = errors.New("CounterOptions.Table is empty")
+
+// Counter write-behind counters. Incr adds to a redis hash under the module,
+// Flush moves the hash to a pending batch and adds the deltas of the batch to
+// the table in one transaction, which also records the batch id in the flush
+// table. A batch interrupted by a crash is flushed again by the next Flush
+// and skipped in the table if it was already committed, so no increment is
+// lost or counted twice.
+type Counter struct {
+	db    *DB
+	cache *redis.Client
+	name  string
+	opts  CounterOptions
+	// redis keys, share the hash tag {counter:name}.
+	live    string
+	batch   string
+	batchID string
+	// lua scripts registered in the script registry of the cache.
+	rotate *redis.RegisteredScript
+	finish *redis.RegisteredScript
+}
+
+// CounterOptions counter options.
+type CounterOptions struct {
+	// Table the counts are added to, the id column must be unique.
+	Table string
+	// Id column of the table.
+	// Default is "id".
+	IDColumn string
+	// Count column of the table.
+	// Default is "count".
+	CountColumn string
+	// Table recording the flushed batches, see CreateFlushTable.
+	// Default is "counter_flush".
+	FlushTable string
+	// Frequency of flushing by Run.
+	// Default is 10 seconds.
+	FlushInterval time.Duration
+	// Number of rows per INSERT.
+	// Default is 500.
+	BatchSize int
+	// The flushed batches are kept in the flush table for Retention, a
+	// pending batch older than Retention could be counted twice.
+	// Default is 7 days.
+	Retention time.Duration
+}
+
+// init sets the default options.
+func (o *CounterOptions) init() {
+	if o.IDColumn == "" {
+		o.IDColumn = "id"
+	}
+	if o.CountColumn == "" {
+		o.CountColumn = "count"
+	}
+	if o.FlushTable == "" {
+		o.FlushTable = "counter_flush"
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = 10 * time.Second
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 500
+	}
+	if o.Retention <= 0 {
+		o.Retention = 7 * 24 * time.Hour
+	}
+}
+
+const (
+	// KEYS: live, batch, batch id; ARGV: new batch id
+	counterRotateScript = `
+local id = redis.call('GET', KEYS[3])
+if id then
+	return id
+end
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+redis.call('RENAME', KEYS[1], KEYS[2])
+redis.call('SET', KEYS[3], ARGV[1])
+return ARGV[1]`
+	// KEYS: batch, batch id; ARGV: batch id
+	counterFinishScript = `
+if redis.call('GET', KEYS[2]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1], KEYS[2])
+end
+return 0`
+)
+
+// NewCounter creates counter named name, the redis keys are under the module.
+func (d *DB) NewCounter(m *redis.Module, name string, opts *CounterOptions) (*Counter, error) {
+	if d.Cache == nil {
+		return nil, ErrCacheIsNil
+	}
+	var o CounterOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Table == "" {
+		return nil, ErrCounterTable
+	}
+	o.init()
+	var (
+		prefix  = "{counter:" + name + "}:"
+		scripts = d.Cache.Scripts()
+	)
+	rotate, err := scripts.Register("mysql.counter.rotate", counterRotateScript, m)
+	if err != nil {
+		return nil, err
+	}
+	finish, err := scripts.Register("mysql.counter.finish", counterFinishScript, m)
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{
+		db:      d,
+		cache:   d.Cache,
+		name:    name,
+		opts:    o,
+		live:    m.GetKey(prefix + "live"),
+		batch:   m.GetKey(prefix + "batch"),
+		batchID: m.GetKey(prefix + "batch_id"),
+		rotate:  rotate,
+		finish:  finish,
+	}, nil
+}
+
+// CreateFlushTable creates the flush table if not exists.
+func (c *Counter) CreateFlushTable(ctx context.Context) error {
+	_, err := c.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS `"+c.opts.FlushTable+"` ("+
+		"`name` VARCHAR(128) NOT NULL, "+
+		"`batch` CHAR(32) NOT NULL, "+
+		"`created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP, "+
+		"PRIMARY KEY (`name`, `batch`), KEY `created_at` (`created_at`)"+
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	return err
+}
+
+// Incr adds delta to the count of id.
+func (c *Counter) Incr(id string, delta int64) error {
+	return c.cache.HIncrBy(c.live, id, delta).Err()
+}
+
+// Pending returns the delta of id not flushed yet.
+func (c *Counter) Pending(id string) (int64, error) {
+	var (
+		live  *redis.StringCmd
+		batch *redis.StringCmd
+	)
+	_, err := c.cache.Pipelined(func(p redis.Pipeliner) error {
+		live = p.HGet(c.live, id)
+		batch = p.HGet(c.batch, id)
+		return nil
+	})
+	if err != nil && !redis.IsRedisNil(err) {
+		return 0, err
+	}
+	var n int64
+	for _, cmd := range []*redis.StringCmd{live, batch} {
+		if v, err := cmd.Int64(); err == nil {
+			n += v
+		}
+	}
+	return n, nil
+}
+
+// Get returns the count of id in the table plus the pending delta.
+func (c *Counter) Get(ctx context.Context, id string) (int64, error) {
+	pending, err := c.Pending(id)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = c.db.QueryRowContext(ctx, fmt.Sprintf("SELECT `%s` FROM `%s` WHERE `%s`=?",
+		c.opts.CountColumn, c.opts.Table, c.opts.IDColumn), id).Scan(&n)
+	if err != nil && !IsNoRows(err) {
+		return 0, err
+	}
+	return n + pending, nil
+}
+
+// Flush adds the pending deltas to the table, returns the number of ids
+// updated. A batch left by an interrupted Flush is flushed first.
+func (c *Counter) Flush(ctx context.Context) (int, error) {
+	id, err := c.rotate.Run([]string{c.live, c.batch, c.batchID}, newBatchID()).String()
+	if redis.IsRedisNil(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	deltas, err := c.cache.HGetAll(c.batch).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.apply(ctx, id, deltas)
+	if err != nil {
+		return 0, err
+	}
+	if err = c.finish.Run([]string{c.batch, c.batchID}, id).Err(); err != nil {
+		// flushed again and skipped by the next Flush.
+		return n, err
+	}
+	return n, nil
+}
+
+// apply adds the deltas to the table and records the batch in one
+// transaction, the batch already recorded is skipped.
+func (c *Counter) apply(ctx context.Context, id string, deltas map[string]string) (n int, err error) {
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	// concurrent flushers of the same batch wait for the row lock here.
+	r, err := tx.ExecContext(ctx, "INSERT IGNORE INTO `"+c.opts.FlushTable+"` (`name`, `batch`) VALUES (?, ?)", c.name, id)
+	if err != nil {
+		return 0, err
+	}
+	if affected, err := r.RowsAffected(); err != nil {
+		return 0, err
+	} else if affected == 0 {
+		// committed before the crash.
+		return 0, tx.Rollback()
+	}
+	var (
+		query = fmt.Sprintf("INSERT INTO `%s` (`%s`, `%s`) VALUES %%s ON DUPLICATE KEY UPDATE `%s`=`%s`+VALUES(`%s`)",
+			c.opts.Table, c.opts.IDColumn, c.opts.CountColumn, c.opts.CountColumn, c.opts.CountColumn, c.opts.CountColumn)
+		values []string
+		args   []interface{}
+	)
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(query, strings.Join(values, ",")), args...)
+		values, args = values[:0], args[:0]
+		return err
+	}
+	for key, v := range deltas {
+		delta, perr := strconv.ParseInt(v, 10, 64)
+		if perr != nil {
+			ozlog.Errorf("Counter(%s).Flush(): invalid delta %s->%s", c.name, key, v)
+			continue
+		}
+		if delta == 0 {
+			continue
+		}
+		values = append(values, "(?,?)")
+		args = append(args, key, delta)
+		n++
+		if len(values) >= c.opts.BatchSize {
+			if err = flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Cleanup deletes the flush records older than Retention.
+func (c *Counter) Cleanup(ctx context.Context) error {
+	_, err := c.db.ExecContext(ctx, "DELETE FROM `"+c.opts.FlushTable+"` WHERE `name`=? AND `created_at`<?",
+		c.name, time.Now().Add(-c.opts.Retention))
+	return err
+}
+
+// Run flushes every FlushInterval and cleans up the flush records hourly
+// until ctx is done, then flushes a last time.
+func (c *Counter) Run(ctx context.Context) error {
+	var (
+		ticker      = time.NewTicker(c.opts.FlushInterval)
+		lastCleanup time.Time
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), c.opts.FlushInterval)
+			defer cancel()
+			_, err := c.Flush(shutdownCtx)
+			return err
+		case <-ticker.C:
+			if _, err := c.Flush(ctx); err != nil {
+				ozlog.Errorf("Counter(%s).Flush(): %s", c.name, err.Error())
+			}
+			if time.Since(lastCleanup) >= time.Hour {
+				if err := c.Cleanup(ctx); err != nil {
+					ozlog.Errorf("Counter(%s).Cleanup(): %s", c.name, err.Error())
+				} else {
+					lastCleanup = time.Now()
+				}
+			}
+		}
+	}
+}
+
+// newBatchID returns a random 32 hex chars batch id.
+func newBatchID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
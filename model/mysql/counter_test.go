@@ -0,0 +1,75 @@
+package mysql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestCounter(t *testing.T) {
+	dbconfig := &Config{
+		Database: "ooz",
+		Username: "root",
+		Password: "0707",
+		Host:     "127.0.0.1",
+		Port:     3306,
+	}
+	cache, _ := redistest.NewClient(t)
+	db, err := Connect(dbconfig, cache.GetConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS `ooztest_views` (`id` INT(10), `count` BIGINT NOT NULL DEFAULT 0, PRIMARY KEY(`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("DELETE FROM `ooztest_views`")
+	var (
+		ctx = context.Background()
+		m   = redis.NewModule("ooz-test")
+	)
+	c, err := db.NewCounter(m, "views", &CounterOptions{
+		Table:     "ooztest_views",
+		BatchSize: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CreateFlushTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.Incr("1", 2)
+	c.Incr("1", 3)
+	c.Incr("2", 1)
+	if n, err := c.Pending("1"); err != nil || n != 5 {
+		t.Fatalf("Pending() v->%d, err->%v", n, err)
+	}
+	if n, err := c.Flush(ctx); err != nil || n != 2 {
+		t.Fatalf("Flush() v->%d, err->%v", n, err)
+	}
+	c.Incr("1", 1)
+	if n, err := c.Get(ctx, "1"); err != nil || n != 6 {
+		t.Fatalf("Get() v->%d, err->%v", n, err)
+	}
+
+	// crash after the commit: the batch is flushed again and skipped.
+	id, err := c.rotate.Run([]string{c.live, c.batch, c.batchID}, newBatchID()).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deltas, _ := c.cache.HGetAll(c.batch).Result()
+	if _, err = c.apply(ctx, id, deltas); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Flush(ctx); err != nil || n != 0 {
+		t.Fatalf("Flush() committed batch v->%d, err->%v", n, err)
+	}
+	if n, err := c.Get(ctx, "1"); err != nil || n != 6 {
+		t.Fatalf("Get() after recovery v->%d, err->%v", n, err)
+	}
+	if err = c.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
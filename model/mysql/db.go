@@ -72,6 +72,7 @@ type CacheDB struct {
 	priFieldsIndex    []int          // primary column index in struct
 	fieldsIndexMap    map[string]int // key:colName, value:field index in struct
 	module            *redis.Module
+	keyFilter         redis.KeyFilterGuard
 }
 
 // ErrCacheIsNil db cache(redis) is nil
@@ -174,3 +175,32 @@ func (d *DB) GetCacheDB(tableName string) (*CacheDB, error) {
 	}
 	return c, nil
 }
+
+// SetKeyFilter sets the filter(.e.g. *redis.BloomFilter) of the cache keys.
+// The filter is not consulted until SetKeyFilterSeeded is called: add the keys
+// of the existing rows by SeedKeyFilter first, .e.g. by scanning the table at
+// startup. Then GetCache returns ErrNoRows at once for the keys the filter has
+// never seen when the cache is used. The filter does not learn from the reads,
+// the rows inserted later must be seeded too, PutCache adds its key.
+// GetCacheByWhere does not use the filter.
+func (c *CacheDB) SetKeyFilter(filter redis.KeyFilter) *CacheDB {
+	c.keyFilter.SetFilter(filter)
+	return c
+}
+
+// SetKeyFilterSeeded marks the keys of the existing rows seeded, the key
+// filter is consulted from then on.
+func (c *CacheDB) SetKeyFilterSeeded() *CacheDB {
+	c.keyFilter.SetSeeded()
+	return c
+}
+
+// SeedKeyFilter adds the cache key of the row by fields(the primary key if
+// none) to the key filter.
+func (c *CacheDB) SeedKeyFilter(structPtr Cacheable, fields ...string) error {
+	cacheKey, _, err := c.CreateCacheKey(structPtr, fields...)
+	if err != nil {
+		return err
+	}
+	return c.keyFilter.Add(cacheKey.Key)
+}
@@ -5,7 +5,7 @@ import (
 	"testing"
 	"time"
 
-	"github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
 )
 
 type ooztestTable struct {
@@ -28,14 +28,8 @@ func TestMysqlAndCache(t *testing.T) {
 		Port:     3306,
 	}
 	// rds config
-	single := redis.SingleConfig{
-		Addr: "127.0.0.1:6379",
-	}
-	rdsConfig := &redis.Config{
-		DeployType: "single",
-		ForSingle:  single,
-	}
-	db, err := Connect(dbconfig, rdsConfig)
+	cache, _ := redistest.NewClient(t)
+	db, err := Connect(dbconfig, cache.GetConfig())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -93,6 +93,8 @@ func (p *PreDB) RegisterCacheDB(ormStructPtr Cacheable, cacheExpiration time.Dur
 		}
 		_cacheableDB, err := p.DB.RegisterCacheDB(ormStructPtr, cacheExpiration)
 		if err == nil {
+			// keep the key filter set before init
+			_cacheableDB.keyFilter = cacheableDB.keyFilter
 			*cacheableDB = *_cacheableDB
 			p.DB.cacheDBs[tableName] = cacheableDB
 		}
@@ -0,0 +1,410 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// KeyAnalyzer finds the hot keys by sampling the commands through a client
+// hook, and the big keys by scanning a module prefix.
+type KeyAnalyzer struct {
+	client    *Client
+	opts      KeyAnalyzerOptions
+	hookOnce  sync.Once
+	sampling  int32
+	shards    [keyCountShards]keyCounts
+	mu        sync.Mutex
+	startedAt time.Time
+}
+
+// keyCountShards number of the count shards, the sampled commands of
+// different keys rarely wait for the same lock.
+const keyCountShards = 32
+
+// keyCounts sampled counts of a shard of the keys.
+type keyCounts struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+	max    int
+}
+
+// KeyAnalyzerOptions key analyzer options.
+type KeyAnalyzerOptions struct {
+	// Fraction of the commands sampled, 0 < SampleRate <= 1.
+	// Default is 0.01.
+	SampleRate float64
+	// Maximum number of keys tracked, the counts are halved and the keys
+	// with zero count dropped when reached, until a quarter is free.
+	// Default is 10000.
+	MaxTracked int
+	// Number of keys in the reports.
+	// Default is 20.
+	TopN int
+	// Number of keys scanned per SCAN and pipeline.
+	// Default is 500.
+	ScanCount int64
+}
+
+// init sets the default options.
+func (o *KeyAnalyzerOptions) init() {
+	if o.SampleRate <= 0 || o.SampleRate > 1 {
+		o.SampleRate = 0.01
+	}
+	if o.MaxTracked <= 0 {
+		o.MaxTracked = 10000
+	}
+	if o.TopN <= 0 {
+		o.TopN = 20
+	}
+	if o.ScanCount <= 0 {
+		o.ScanCount = 500
+	}
+}
+
+// HotKey key by estimated number of commands.
+type HotKey struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	// Count estimated number of commands, sampled count / SampleRate.
+	Count uint64 `json:"count"`
+}
+
+// BigKey key by memory usage.
+type BigKey struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	Type   string `json:"type"`
+	// Memory bytes reported by MEMORY USAGE, 0 if not supported.
+	Memory int64 `json:"memory"`
+	// Length string length, or number of elements of the other types.
+	Length int64  `json:"length"`
+	Node   string `json:"node,omitempty"`
+}
+
+// KeyReport analyzer report.
+type KeyReport struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	// Since when the hot keys are sampled.
+	SampledSince time.Time `json:"sampled_since,omitempty"`
+	SampleRate   float64   `json:"sample_rate"`
+	HotKeys      []HotKey  `json:"hot_keys"`
+	BigKeys      []BigKey  `json:"big_keys"`
+}
+
+var _ Hook = (*KeyAnalyzer)(nil)
+
+// NewKeyAnalyzer creates key analyzer.
+func NewKeyAnalyzer(c *Client, opts *KeyAnalyzerOptions) *KeyAnalyzer {
+	var o KeyAnalyzerOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	a := &KeyAnalyzer{
+		client: c,
+		opts:   o,
+	}
+	max := (o.MaxTracked + keyCountShards - 1) / keyCountShards
+	for i := range a.shards {
+		a.shards[i].counts = make(map[string]uint64)
+		a.shards[i].max = max
+	}
+	return a
+}
+
+// StartSampling starts sampling the commands of the client.
+func (a *KeyAnalyzer) StartSampling() {
+	a.hookOnce.Do(func() {
+		a.client.AddHook(a)
+	})
+	a.mu.Lock()
+	if a.startedAt.IsZero() {
+		a.startedAt = time.Now()
+	}
+	a.mu.Unlock()
+	atomic.StoreInt32(&a.sampling, 1)
+}
+
+// StopSampling stops sampling, the counts are kept.
+func (a *KeyAnalyzer) StopSampling() {
+	atomic.StoreInt32(&a.sampling, 0)
+}
+
+// Reset clears the counts.
+func (a *KeyAnalyzer) Reset() {
+	for i := range a.shards {
+		s := &a.shards[i]
+		s.mu.Lock()
+		s.counts = make(map[string]uint64)
+		s.mu.Unlock()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.startedAt = time.Time{}
+	if atomic.LoadInt32(&a.sampling) == 1 {
+		a.startedAt = time.Now()
+	}
+}
+
+// BeforeProcess implements Hook.
+func (a *KeyAnalyzer) BeforeProcess(cmd Cmder) {
+	a.sample(cmd)
+}
+
+// AfterProcess implements Hook.
+func (a *KeyAnalyzer) AfterProcess(cmd Cmder, elapsed time.Duration) {}
+
+// BeforeProcessPipeline implements Hook.
+func (a *KeyAnalyzer) BeforeProcessPipeline(cmds []Cmder) {
+	for _, cmd := range cmds {
+		a.sample(cmd)
+	}
+}
+
+// AfterProcessPipeline implements Hook.
+func (a *KeyAnalyzer) AfterProcessPipeline(cmds []Cmder, elapsed time.Duration) {}
+
+// sample counts the key of the command with probability SampleRate.
+func (a *KeyAnalyzer) sample(cmd Cmder) {
+	if atomic.LoadInt32(&a.sampling) == 0 || a.opts.SampleRate < 1 && rand.Float64() >= a.opts.SampleRate {
+		return
+	}
+	key := CmdKey(cmd)
+	if key == "" {
+		return
+	}
+	a.shards[crc16(key)%keyCountShards].add(key)
+}
+
+// add counts the key. When the shard is full the counts are halved until a
+// quarter of it is free, so the eviction runs at most once per max/4 new keys.
+func (s *keyCounts) add(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.counts[key]; !ok && len(s.counts) >= s.max {
+		for len(s.counts) > s.max*3/4 {
+			for k, n := range s.counts {
+				if n /= 2; n == 0 {
+					delete(s.counts, k)
+				} else {
+					s.counts[k] = n
+				}
+			}
+		}
+	}
+	s.counts[key]++
+}
+
+// HotKeys returns the TopN hot keys.
+func (a *KeyAnalyzer) HotKeys() []HotKey {
+	var keys []HotKey
+	for i := range a.shards {
+		s := &a.shards[i]
+		s.mu.Lock()
+		for key, n := range s.counts {
+			keys = append(keys, HotKey{
+				Key:    key,
+				Prefix: KeyPrefix(key),
+				Count:  uint64(float64(n) / a.opts.SampleRate),
+			})
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > a.opts.TopN {
+		keys = keys[:a.opts.TopN]
+	}
+	return keys
+}
+
+// BigKeys scans the keys under the module on every master and returns the
+// TopN keys by memory usage, or by length if MEMORY USAGE is not supported.
+func (a *KeyAnalyzer) BigKeys(ctx context.Context, m *Module) ([]BigKey, error) {
+	var (
+		mu   sync.Mutex
+		keys []BigKey
+	)
+	err := a.client.ForEachMaster(func(node Cmdable) error {
+		nodeKeys, err := a.scanNode(ctx, node, globEscape(m.GetPrefix())+"*")
+		mu.Lock()
+		keys = append(keys, nodeKeys...)
+		mu.Unlock()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortBigKeys(keys)
+	if len(keys) > a.opts.TopN {
+		keys = keys[:a.opts.TopN]
+	}
+	return keys, nil
+}
+
+// scanNode scans the keys matching pattern on the node, keeping the TopN.
+func (a *KeyAnalyzer) scanNode(ctx context.Context, node Cmdable, pattern string) ([]BigKey, error) {
+	var (
+		cursor uint64
+		top    []BigKey
+		addr   = nodeAddr(node)
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return top, err
+		}
+		keys, next, err := node.Scan(cursor, pattern, a.opts.ScanCount).Result()
+		if err != nil {
+			return top, err
+		}
+		if len(keys) > 0 {
+			sized, err := a.sizeKeys(node, keys)
+			if err != nil {
+				return top, err
+			}
+			for i := range sized {
+				sized[i].Node = addr
+			}
+			top = append(top, sized...)
+			sortBigKeys(top)
+			if len(top) > a.opts.TopN {
+				top = top[:a.opts.TopN]
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return top, nil
+		}
+	}
+}
+
+// sizeKeys returns the type, memory and length of the keys in two pipelines.
+func (a *KeyAnalyzer) sizeKeys(node Cmdable, keys []string) ([]BigKey, error) {
+	var (
+		types    = make([]*StatusCmd, len(keys))
+		memories = make([]*Cmd, len(keys))
+	)
+	_, err := node.Pipelined(func(p Pipeliner) error {
+		for i, key := range keys {
+			types[i] = p.Type(key)
+			memories[i] = p.Do("memory", "usage", key)
+		}
+		return nil
+	})
+	// MEMORY USAGE may not be supported, the errors are checked per command.
+	if err != nil && !IsRedisNil(err) && types[0].Err() != nil {
+		return nil, err
+	}
+	var (
+		lengths = make([]*IntCmd, len(keys))
+		sized   = make([]BigKey, 0, len(keys))
+	)
+	_, err = node.Pipelined(func(p Pipeliner) error {
+		for i, key := range keys {
+			switch types[i].Val() {
+			case "string":
+				lengths[i] = p.StrLen(key)
+			case "list":
+				lengths[i] = p.LLen(key)
+			case "hash":
+				lengths[i] = p.HLen(key)
+			case "set":
+				lengths[i] = p.SCard(key)
+			case "zset":
+				lengths[i] = p.ZCard(key)
+			case "stream":
+				lengths[i] = p.XLen(key)
+			}
+		}
+		return nil
+	})
+	if err != nil && !IsRedisNil(err) {
+		return nil, err
+	}
+	for i, key := range keys {
+		typ := types[i].Val()
+		if typ == "none" || typ == "" {
+			// deleted while scanning.
+			continue
+		}
+		k := BigKey{
+			Key:    key,
+			Prefix: KeyPrefix(key),
+			Type:   typ,
+		}
+		k.Memory, _ = memories[i].Int64()
+		if lengths[i] != nil {
+			k.Length = lengths[i].Val()
+		}
+		sized = append(sized, k)
+	}
+	return sized, nil
+}
+
+// sortBigKeys sorts the keys by memory, then length.
+func sortBigKeys(keys []BigKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Memory != keys[j].Memory {
+			return keys[i].Memory > keys[j].Memory
+		}
+		if keys[i].Length != keys[j].Length {
+			return keys[i].Length > keys[j].Length
+		}
+		return keys[i].Key < keys[j].Key
+	})
+}
+
+// Report returns the hot keys and the big keys under the module, the big
+// keys are not scanned if m is nil.
+func (a *KeyAnalyzer) Report(ctx context.Context, m *Module) (*KeyReport, error) {
+	r := &KeyReport{
+		GeneratedAt: time.Now(),
+		SampleRate:  a.opts.SampleRate,
+		HotKeys:     a.HotKeys(),
+	}
+	a.mu.Lock()
+	r.SampledSince = a.startedAt
+	a.mu.Unlock()
+	if m != nil {
+		var err error
+		if r.BigKeys, err = a.BigKeys(ctx, m); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// JSON returns the report in JSON.
+func (r *KeyReport) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// Table returns the report as text tables.
+func (r *KeyReport) Table() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "HOT KEYS (sample rate %g)\n", r.SampleRate)
+	fmt.Fprintln(w, "RANK\tKEY\tPREFIX\tCOUNT")
+	for i, k := range r.HotKeys {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\n", i+1, k.Key, k.Prefix, k.Count)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "BIG KEYS")
+	fmt.Fprintln(w, "RANK\tKEY\tTYPE\tMEMORY\tLENGTH\tNODE")
+	for i, k := range r.BigKeys {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%s\n", i+1, k.Key, k.Type, k.Memory, k.Length, k.Node)
+	}
+	w.Flush()
+	return buf.String()
+}
@@ -0,0 +1,113 @@
+package redis_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestKeyAnalyzer(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	var (
+		m = NewModule("ooz-test")
+		a = NewKeyAnalyzer(client, &KeyAnalyzerOptions{
+			SampleRate: 1,
+			TopN:       2,
+			ScanCount:  2,
+		})
+		hot  = m.GetKey("hot")
+		big  = m.GetKey("big")
+		cold = m.GetKey("cold")
+	)
+	a.StartSampling()
+	for i := 0; i < 10; i++ {
+		client.Get(hot)
+	}
+	client.Set(cold, "v", 0)
+	client.Pipelined(func(p Pipeliner) error {
+		p.Get(hot)
+		p.RPush(big, strings.Split(strings.Repeat("x", 100), ""))
+		return nil
+	})
+	a.StopSampling()
+	// not sampled
+	client.Get(cold)
+	client.Get(cold)
+
+	hotKeys := a.HotKeys()
+	if len(hotKeys) != 2 || hotKeys[0].Key != hot || hotKeys[0].Count != 11 || hotKeys[1].Count != 1 {
+		t.Fatalf("HotKeys() v->%+v", hotKeys)
+	}
+
+	r, err := a.Report(context.Background(), m)
+	if err != nil {
+		t.Fatalf("Report() err->%v", err)
+	}
+	if len(r.BigKeys) != 2 || r.BigKeys[0].Key != big || r.BigKeys[0].Type != "list" || r.BigKeys[0].Length != 100 {
+		t.Fatalf("Report() big keys->%+v", r.BigKeys)
+	}
+	if r.BigKeys[1].Key != cold || r.BigKeys[1].Length != 1 {
+		t.Fatalf("Report() big keys->%+v", r.BigKeys)
+	}
+	b, err := r.JSON()
+	if err != nil {
+		t.Fatalf("JSON() err->%v", err)
+	}
+	var decoded KeyReport
+	if err = json.Unmarshal(b, &decoded); err != nil || len(decoded.HotKeys) != 2 || decoded.BigKeys[0].Key != big {
+		t.Fatalf("JSON() v->%s, err->%v", b, err)
+	}
+	if table := r.Table(); !strings.Contains(table, big) || !strings.Contains(table, "HOT KEYS") {
+		t.Fatalf("Table() v->%s", table)
+	}
+
+	a.Reset()
+	if hotKeys = a.HotKeys(); len(hotKeys) != 0 {
+		t.Fatalf("HotKeys() after reset v->%+v", hotKeys)
+	}
+	client.Del(hot, big, cold)
+
+	// the glob characters of the module are matched literally.
+	var (
+		globbed = NewModule("ooz-test[a]")
+		own     = globbed.GetKey("big")
+		other   = NewModule("ooz-testa").GetKey("big")
+	)
+	client.Set(own, "v", 0)
+	client.Set(other, "v", 0)
+	bigKeys, err := a.BigKeys(context.Background(), globbed)
+	if err != nil || len(bigKeys) != 1 || bigKeys[0].Key != own {
+		t.Fatalf("BigKeys() glob module v->%+v, err->%v", bigKeys, err)
+	}
+	client.Del(own, other)
+}
+
+func TestKeyAnalyzerMaxTracked(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	var (
+		m = NewModule("ooz-test")
+		a = NewKeyAnalyzer(client, &KeyAnalyzerOptions{
+			SampleRate: 1,
+			MaxTracked: 320,
+			TopN:       1000,
+		})
+		hot = m.GetKey("hot")
+	)
+	a.StartSampling()
+	// the cold keys are dropped and the hot key is kept.
+	for i := 0; i < 2000; i++ {
+		client.Get(m.GetKey(fmt.Sprintf("cold_%d", i)))
+		if i%10 == 0 {
+			client.Get(hot)
+		}
+	}
+	hotKeys := a.HotKeys()
+	if len(hotKeys) > 320 || hotKeys[0].Key != hot {
+		t.Fatalf("HotKeys() len->%d, v->%+v", len(hotKeys), hotKeys[0])
+	}
+}
@@ -0,0 +1,211 @@
+package redis
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// KeyFilter reports whether a key may exist, CacheDB uses it to skip the
+// lookups of the keys that have never been added.
+type KeyFilter interface {
+	// Add adds the keys.
+	Add(keys ...string) error
+	// MayExist returns false if the key has never been added.
+	MayExist(key string) (bool, error)
+}
+
+// KeyFilterGuard optional KeyFilter guarding the cache lookups, shared by
+// mysql.CacheDB and mongo.CacheDB. The zero value has no filter and lets
+// every key through, so does a filter until it is marked seeded.
+type KeyFilterGuard struct {
+	filter KeyFilter
+	// are the keys of the existing rows added to the filter?
+	seeded int32
+}
+
+// SetFilter sets the filter, nil to disable. The filter is not consulted
+// until SetSeeded is called.
+func (g *KeyFilterGuard) SetFilter(filter KeyFilter) {
+	g.filter = filter
+	atomic.StoreInt32(&g.seeded, 0)
+}
+
+// SetSeeded marks the keys of the existing rows added to the filter, the keys
+// it has never seen are blocked from then on.
+func (g *KeyFilterGuard) SetSeeded() {
+	atomic.StoreInt32(&g.seeded, 1)
+}
+
+// Seeded is the filter seeded?
+func (g *KeyFilterGuard) Seeded() bool {
+	return atomic.LoadInt32(&g.seeded) == 1
+}
+
+// Filter returns the filter, nil if not set.
+func (g *KeyFilterGuard) Filter() KeyFilter {
+	return g.filter
+}
+
+// MayExist may the key exist? true if no filter is set or it is not seeded,
+// the filter errors are logged and the key is treated as existing.
+func (g *KeyFilterGuard) MayExist(key string) bool {
+	if g.filter == nil || !g.Seeded() {
+		return true
+	}
+	ok, err := g.filter.MayExist(key)
+	if err != nil {
+		ozlog.Errorf("KeyFilterGuard.MayExist(): %s", err.Error())
+		return true
+	}
+	return ok
+}
+
+// Add adds the keys to the filter if set.
+func (g *KeyFilterGuard) Add(keys ...string) error {
+	if g.filter == nil || len(keys) == 0 {
+		return nil
+	}
+	return g.filter.Add(keys...)
+}
+
+// maxBloomBits redis strings are limited to 512MB.
+const maxBloomBits = 1 << 32
+
+// BloomFilter bitmap-based bloom filter stored in a redis string.
+type BloomFilter struct {
+	client *Client
+	key    string
+	bits   uint64
+	hashes uint64
+}
+
+var _ KeyFilter = (*BloomFilter)(nil)
+
+// NewBloomFilter creates bloom filter named name under the module, sized for
+// capacity items with false positive rate fpRate(0 < fpRate < 1).
+// The size is derived from capacity and fpRate, so they must not change
+// for an existing filter.
+func NewBloomFilter(c *Client, m *Module, name string, capacity uint64, fpRate float64) *BloomFilter {
+	bits, hashes := BloomFilterSize(capacity, fpRate)
+	return &BloomFilter{
+		client: c,
+		key:    m.GetKey("bloom:" + name),
+		bits:   bits,
+		hashes: hashes,
+	}
+}
+
+// BloomFilterSize returns the number of bits and hash functions for capacity
+// items with false positive rate fpRate.
+func BloomFilterSize(capacity uint64, fpRate float64) (bits, hashes uint64) {
+	if capacity == 0 {
+		capacity = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.01
+	}
+	n := float64(capacity)
+	bits = uint64(math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if bits > maxBloomBits {
+		bits = maxBloomBits
+	}
+	hashes = uint64(math.Round(float64(bits) / n * math.Ln2))
+	if hashes == 0 {
+		hashes = 1
+	}
+	return bits, hashes
+}
+
+// Key returns the redis key of the filter.
+func (b *BloomFilter) Key() string {
+	return b.key
+}
+
+// offsets returns the bit offsets of the item by double hashing.
+func (b *BloomFilter) offsets(item string) []int64 {
+	h := fnv.New128a()
+	h.Write([]byte(item))
+	sum := h.Sum(nil)
+	var (
+		h1      = mix64(binary.BigEndian.Uint64(sum[:8]))
+		h2      = mix64(binary.BigEndian.Uint64(sum[8:])) | 1
+		offsets = make([]int64, b.hashes)
+	)
+	for i := uint64(0); i < b.hashes; i++ {
+		offsets[i] = int64((h1 + i*h2) % b.bits)
+	}
+	return offsets
+}
+
+// mix64 splitmix64 finalizer, fnv of similar items is poorly distributed.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add adds the items in one pipeline.
+func (b *BloomFilter) Add(items ...string) error {
+	if len(items) == 0 {
+		return nil
+	}
+	_, err := b.client.Pipelined(func(p Pipeliner) error {
+		for _, item := range items {
+			for _, offset := range b.offsets(item) {
+				p.SetBit(b.key, offset, 1)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// MayExist returns false if the item has never been added.
+func (b *BloomFilter) MayExist(item string) (bool, error) {
+	exists, err := b.MayExistMulti(item)
+	if err != nil {
+		return false, err
+	}
+	return exists[0], nil
+}
+
+// MayExistMulti tests the items in one pipeline.
+func (b *BloomFilter) MayExistMulti(items ...string) ([]bool, error) {
+	var cmds = make([][]*IntCmd, len(items))
+	_, err := b.client.Pipelined(func(p Pipeliner) error {
+		for i, item := range items {
+			offsets := b.offsets(item)
+			cmds[i] = make([]*IntCmd, len(offsets))
+			for j, offset := range offsets {
+				cmds[i][j] = p.GetBit(b.key, offset)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	exists := make([]bool, len(items))
+	for i := range items {
+		exists[i] = true
+		for _, cmd := range cmds[i] {
+			if cmd.Val() == 0 {
+				exists[i] = false
+				break
+			}
+		}
+	}
+	return exists, nil
+}
+
+// Clear deletes the filter.
+func (b *BloomFilter) Clear() error {
+	return b.client.Del(b.key).Err()
+}
@@ -0,0 +1,62 @@
+package redis_test
+
+import (
+	"strconv"
+	"testing"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestBloomFilter(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	b := NewBloomFilter(client, NewModule("ooz-test"), "test_bloom", 1000, 0.01)
+	defer b.Clear()
+	var items []string
+	for i := 0; i < 1000; i++ {
+		items = append(items, "id:"+strconv.Itoa(i))
+	}
+	if err := b.Add(items...); err != nil {
+		t.Fatalf("b.Add() err->%v", err)
+	}
+	exists, err := b.MayExistMulti(items...)
+	if err != nil {
+		t.Fatalf("b.MayExistMulti() err->%v", err)
+	}
+	for i, ok := range exists {
+		if !ok {
+			t.Fatalf("b.MayExistMulti() false negative->%s", items[i])
+		}
+	}
+	var falsePositives int
+	for i := 1000; i < 2000; i++ {
+		if ok, _ := b.MayExist("id:" + strconv.Itoa(i)); ok {
+			falsePositives++
+		}
+	}
+	if falsePositives > 30 {
+		t.Fatalf("false positives->%d/1000, want about 10", falsePositives)
+	}
+}
+
+func TestKeyFilterGuard(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	var g KeyFilterGuard
+	if !g.MayExist("user:1") || g.Add("user:1") != nil {
+		t.Fatalf("KeyFilterGuard without filter blocks keys")
+	}
+	b := NewBloomFilter(client, NewModule("ooz-test"), "guard", 1000, 0.01)
+	defer client.Del(b.Key())
+	g.SetFilter(b)
+	// the keys are let through until the filter is seeded.
+	if !g.MayExist("user:1") {
+		t.Fatalf("g.MayExist() v->false before SetSeeded")
+	}
+	g.SetSeeded()
+	if g.MayExist("user:1") {
+		t.Fatalf("g.MayExist() v->true before Add")
+	}
+	if err := g.Add("user:1"); err != nil || !g.MayExist("user:1") {
+		t.Fatalf("g.Add() err->%v", err)
+	}
+}
@@ -0,0 +1,506 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// BreakerState circuit breaker state.
+type BreakerState int
+
+// circuit breaker states
+const (
+	// BreakerClosed commands are sent.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen commands fail fast with ErrBreakerOpen.
+	BreakerOpen
+	// BreakerHalfOpen a few probe commands are sent to test the recovery.
+	BreakerHalfOpen
+)
+
+// String returns the state name.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// ErrBreakerOpen the command is rejected by the open circuit breaker.
+var ErrBreakerOpen = errors.New("redis: circuit breaker is open")
+
+// BreakerConfig redis circuit breaker config.
+type BreakerConfig struct {
+	// Enables the circuit breaker.
+	Enable bool `yaml:"enable,omitempty"`
+	// Minimum number of commands in a window before the breaker can trip.
+	// Default is 20.
+	MinRequests int `yaml:"min_requests,omitempty"`
+	// The breaker trips when the rate of failed commands in a window reaches it,
+	// redis error replies (.e.g. Nil) are not failures.
+	// Default is 0.5.
+	ErrorRate float64 `yaml:"error_rate,omitempty"`
+	// Commands slower than this are slow, time: millisecond.
+	// Default is 0, latency does not trip the breaker.
+	SlowThreshold int64 `yaml:"slow_threshold,omitempty"`
+	// The breaker trips when the rate of slow commands in a window reaches it.
+	// Default is 0.5.
+	SlowRate float64 `yaml:"slow_rate,omitempty"`
+	// Length of the statistics window, time: second.
+	// Default is 10 seconds.
+	Window int64 `yaml:"window,omitempty"`
+	// Time the breaker stays open before trying half-open, time: second.
+	// Default is 5 seconds.
+	OpenTimeout int64 `yaml:"open_timeout,omitempty"`
+	// Number of successful probe commands in half-open to close the breaker.
+	// Default is 3.
+	HalfOpenRequests int `yaml:"half_open_requests,omitempty"`
+	// While the breaker is not closed, CacheDB reads the database directly
+	// instead of failing fast with ErrBreakerOpen. The cache keys that could
+	// not be invalidated meanwhile are deleted when the breaker closes, the
+	// cache stays bypassed until then. CacheBypassed sends the half-open probes,
+	// so the breaker closes without a HealthMonitor.
+	Bypass bool `yaml:"bypass,omitempty"`
+}
+
+// init sets the default config.
+func (c *BreakerConfig) init() {
+	if c.MinRequests <= 0 {
+		c.MinRequests = 20
+	}
+	if c.ErrorRate <= 0 {
+		c.ErrorRate = 0.5
+	}
+	if c.SlowRate <= 0 {
+		c.SlowRate = 0.5
+	}
+	if c.Window <= 0 {
+		c.Window = 10
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = 5
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 3
+	}
+}
+
+// Breaker circuit breaker trips on the error rate or latency of commands.
+// It is installed as the go-redis limiter of every node to reject commands,
+// and as a Hook to count the results.
+type Breaker struct {
+	cfg           BreakerConfig
+	slowThreshold time.Duration
+	mu            sync.Mutex
+	state         BreakerState
+	// when the current window started, or the breaker opened.
+	since time.Time
+	// counters of the current window, or of the probes in half-open.
+	requests, failures, slows int
+	probes                    int
+	listeners                 []func(from, to BreakerState)
+	// state changes not notified yet, notifyMu keeps them in order.
+	changes  [][2]BreakerState
+	notifyMu sync.Mutex
+}
+
+var _ Hook = (*Breaker)(nil)
+
+// NewBreaker creates circuit breaker.
+func NewBreaker(cfg BreakerConfig) *Breaker {
+	cfg.init()
+	return &Breaker{
+		cfg:           cfg,
+		slowThreshold: time.Duration(cfg.SlowThreshold) * time.Millisecond,
+		since:         time.Now(),
+	}
+}
+
+// OnStateChange registers fn called on every state change in order, it is
+// called in the command path and must not block.
+func (b *Breaker) OnStateChange(fn func(from, to BreakerState)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners = append(b.listeners, fn)
+}
+
+// State returns the current state.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	b.checkOpenTimeout()
+	state := b.state
+	b.mu.Unlock()
+	b.notify()
+	return state
+}
+
+// Bypass should the cache be bypassed? true if Bypass is configured and the
+// breaker is not closed.
+func (b *Breaker) Bypass() bool {
+	return b.cfg.Bypass && b.State() != BreakerClosed
+}
+
+// Allow implements go-redis Limiter, returns ErrBreakerOpen if the command
+// is rejected.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	b.checkOpenTimeout()
+	var err error
+	switch b.state {
+	case BreakerOpen:
+		err = ErrBreakerOpen
+	case BreakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			err = ErrBreakerOpen
+		} else {
+			b.probes++
+		}
+	}
+	b.mu.Unlock()
+	b.notify()
+	return err
+}
+
+// ReportResult implements go-redis Limiter, the results are counted by the hook.
+func (b *Breaker) ReportResult(result error) {}
+
+// BeforeProcess implements Hook.
+func (b *Breaker) BeforeProcess(cmd Cmder) {}
+
+// AfterProcess implements Hook.
+func (b *Breaker) AfterProcess(cmd Cmder, elapsed time.Duration) {
+	b.record(cmd.Err(), elapsed)
+}
+
+// BeforeProcessPipeline implements Hook.
+func (b *Breaker) BeforeProcessPipeline(cmds []Cmder) {}
+
+// AfterProcessPipeline implements Hook.
+func (b *Breaker) AfterProcessPipeline(cmds []Cmder, elapsed time.Duration) {
+	var err error
+	for _, cmd := range cmds {
+		if isBreakerFailure(cmd.Err()) || cmd.Err() == ErrBreakerOpen {
+			err = cmd.Err()
+			break
+		}
+	}
+	b.record(err, elapsed)
+}
+
+// record counts the result of a command.
+func (b *Breaker) record(err error, elapsed time.Duration) {
+	if err == ErrBreakerOpen {
+		return
+	}
+	var (
+		failed = isBreakerFailure(err)
+		slow   = b.slowThreshold > 0 && elapsed >= b.slowThreshold
+	)
+	b.mu.Lock()
+	defer b.notify()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case BreakerClosed:
+		if now.Sub(b.since) >= time.Duration(b.cfg.Window)*time.Second {
+			b.since, b.requests, b.failures, b.slows = now, 0, 0, 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if slow {
+			b.slows++
+		}
+		if b.requests >= b.cfg.MinRequests &&
+			(float64(b.failures) >= b.cfg.ErrorRate*float64(b.requests) ||
+				b.slowThreshold > 0 && float64(b.slows) >= b.cfg.SlowRate*float64(b.requests)) {
+			b.setState(BreakerOpen, now)
+		}
+	case BreakerHalfOpen:
+		if failed || slow {
+			b.setState(BreakerOpen, now)
+			return
+		}
+		if b.requests++; b.requests >= b.cfg.HalfOpenRequests {
+			b.setState(BreakerClosed, now)
+		}
+	}
+}
+
+// checkOpenTimeout switches open to half-open after OpenTimeout, b.mu must be held.
+func (b *Breaker) checkOpenTimeout() {
+	now := time.Now()
+	if b.state == BreakerOpen && now.Sub(b.since) >= time.Duration(b.cfg.OpenTimeout)*time.Second {
+		b.setState(BreakerHalfOpen, now)
+	}
+}
+
+// setState changes state and resets the counters, b.mu must be held.
+func (b *Breaker) setState(state BreakerState, now time.Time) {
+	from := b.state
+	b.state = state
+	b.since, b.requests, b.failures, b.slows, b.probes = now, 0, 0, 0, 0
+	ozlog.Warnf("redis: circuit breaker %s -> %s", from, state)
+	b.changes = append(b.changes, [2]BreakerState{from, state})
+}
+
+// notify calls the listeners with the pending state changes, b.mu must not be held.
+func (b *Breaker) notify() {
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+	b.mu.Lock()
+	changes, listeners := b.changes, b.listeners
+	b.changes = nil
+	b.mu.Unlock()
+	for _, change := range changes {
+		for _, fn := range listeners {
+			fn(change[0], change[1])
+		}
+	}
+}
+
+// isBreakerFailure is the error a connection failure or timeout? The redis
+// error replies are successes.
+func isBreakerFailure(err error) bool {
+	if err == nil || err == ErrBreakerOpen {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	switch err.Error() {
+	case "redis: connection pool timeout", "redis: client is closed":
+		return true
+	}
+	return false
+}
+
+// Breaker returns the circuit breaker, nil if it is not enabled.
+func (c *Client) Breaker() *Breaker {
+	return c.breaker
+}
+
+// CacheBypassed should the cache be bypassed? true if the circuit breaker is
+// configured to bypass and it is not closed, or the deferred invalidations
+// are not deleted yet. While the breaker is half-open it sends a probe.
+func (c *Client) CacheBypassed() bool {
+	if c == nil || c.breaker == nil || !c.breaker.cfg.Bypass {
+		return false
+	}
+	if c.parent != nil {
+		return c.parent.CacheBypassed()
+	}
+	switch c.breaker.State() {
+	case BreakerClosed:
+		if !c.invalidations.pending() {
+			return false
+		}
+		go c.flushInvalidations()
+	case BreakerHalfOpen:
+		c.probe()
+	}
+	return true
+}
+
+// probe pings redis once at a time, the pings are counted by the breaker.
+func (c *Client) probe() {
+	if !atomic.CompareAndSwapInt32(&c.probing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.probing, 0)
+		c.Ping()
+	}()
+}
+
+// InvalidateCache deletes the cache keys after a write of their source. If
+// it fails while the cache is bypassed, the keys are deleted when the breaker
+// closes and nil is returned.
+func (c *Client) InvalidateCache(keys ...string) error {
+	if c.parent != nil {
+		return c.parent.InvalidateCache(keys...)
+	}
+	err := c.Del(keys...).Err()
+	if err == nil || !c.CacheBypassed() {
+		return err
+	}
+	ozlog.Errorf("redis: cache invalidation deferred until the breaker closes: %s", err.Error())
+	c.invalidations.add(keys)
+	return nil
+}
+
+// flushInvalidations deletes the deferred invalidations, the keys are kept if
+// it fails.
+func (c *Client) flushInvalidations() {
+	keys := c.invalidations.take()
+	if len(keys) == 0 {
+		return
+	}
+	err := c.Del(keys...).Err()
+	if err != nil {
+		ozlog.Errorf("redis: deferred cache invalidation: %s", err.Error())
+	}
+	c.invalidations.done(keys, err != nil)
+}
+
+// cacheInvalidations the cache keys to delete when the breaker closes.
+type cacheInvalidations struct {
+	mu       sync.Mutex
+	keys     map[string]struct{}
+	flushing bool
+}
+
+// add adds the keys.
+func (ci *cacheInvalidations) add(keys []string) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if ci.keys == nil {
+		ci.keys = make(map[string]struct{})
+	}
+	for _, key := range keys {
+		ci.keys[key] = struct{}{}
+	}
+}
+
+// pending are there keys to delete?
+func (ci *cacheInvalidations) pending() bool {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	return len(ci.keys) > 0
+}
+
+// take returns the keys to delete, nil if they are being deleted.
+func (ci *cacheInvalidations) take() []string {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if ci.flushing {
+		return nil
+	}
+	keys := make([]string, 0, len(ci.keys))
+	for key := range ci.keys {
+		keys = append(keys, key)
+	}
+	ci.flushing = len(keys) > 0
+	return keys
+}
+
+// done removes the deleted keys, they are kept if failed.
+func (ci *cacheInvalidations) done(keys []string, failed bool) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.flushing = false
+	if failed {
+		return
+	}
+	for _, key := range keys {
+		delete(ci.keys, key)
+	}
+}
+
+// Health redis health.
+type Health struct {
+	// Healthy did the last ping succeed?
+	Healthy bool
+	// Latency of the last ping.
+	Latency time.Duration
+	// Err of the last ping.
+	Err error
+	// CheckedAt when the last ping was sent.
+	CheckedAt time.Time
+	// Breaker state, BreakerClosed if the breaker is not enabled.
+	Breaker BreakerState
+}
+
+// HealthMonitor pings redis periodically, the pings are also the probes that
+// close the circuit breaker when there is no other traffic.
+type HealthMonitor struct {
+	client    *Client
+	interval  time.Duration
+	mu        sync.RWMutex
+	health    Health
+	listeners []func(Health)
+}
+
+// NewHealthMonitor creates health monitor pinging every interval.
+func NewHealthMonitor(c *Client, interval time.Duration) *HealthMonitor {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &HealthMonitor{
+		client:   c,
+		interval: interval,
+	}
+}
+
+// OnChange registers fn called when Healthy changes.
+func (h *HealthMonitor) OnChange(fn func(Health)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners = append(h.listeners, fn)
+}
+
+// Health returns the result of the last check.
+func (h *HealthMonitor) Health() Health {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.health
+}
+
+// Check pings redis and returns the health.
+func (h *HealthMonitor) Check() Health {
+	start := time.Now()
+	err := h.client.Ping().Err()
+	health := Health{
+		Healthy:   err == nil,
+		Latency:   time.Since(start),
+		Err:       err,
+		CheckedAt: start,
+	}
+	if b := h.client.Breaker(); b != nil {
+		health.Breaker = b.State()
+	}
+	h.mu.Lock()
+	changed := h.health.CheckedAt.IsZero() || h.health.Healthy != health.Healthy
+	h.health = health
+	listeners := h.listeners
+	h.mu.Unlock()
+	if changed {
+		if err != nil {
+			ozlog.Errorf("redis: health check failed: %s", err.Error())
+		}
+		for _, fn := range listeners {
+			fn(health)
+		}
+	}
+	return health
+}
+
+// Run checks every interval until ctx is done.
+func (h *HealthMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.Check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package redis_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestBreaker(t *testing.T) {
+	client, _ := redistest.NewClient(t, &Config{
+		Breaker: BreakerConfig{
+			Enable:           true,
+			MinRequests:      4,
+			OpenTimeout:      1,
+			HalfOpenRequests: 1,
+			Bypass:           true,
+		},
+	})
+	b := client.Breaker()
+	changes := make(chan BreakerState, 4)
+	b.OnStateChange(func(from, to BreakerState) {
+		changes <- to
+	})
+	m := NewModule("ooz-test")
+	// redis nil replies are not failures.
+	for i := 0; i < 4; i++ {
+		client.Get(m.GetKey("breaker"))
+	}
+	if b.State() != BreakerClosed || client.CacheBypassed() {
+		t.Fatalf("b.State()->%s, want closed", b.State())
+	}
+	// trip by connection failures.
+	for i := 0; i < 6; i++ {
+		b.Record(&net.OpError{Op: "read", Err: net.UnknownNetworkError("test")}, time.Millisecond)
+	}
+	if b.State() != BreakerOpen || !client.CacheBypassed() {
+		t.Fatalf("b.State()->%s, want open", b.State())
+	}
+	if err := client.Set(m.GetKey("breaker"), 1, time.Second).Err(); err != ErrBreakerOpen {
+		t.Fatalf("client.Set() err->%v, want %v", err, ErrBreakerOpen)
+	}
+	// half-open after OpenTimeout, the health check probe closes it.
+	time.Sleep(time.Second)
+	hm := NewHealthMonitor(client, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	hm.Run(ctx)
+	if health := hm.Health(); !health.Healthy || health.Breaker != BreakerClosed {
+		t.Fatalf("hm.Health()->%+v", health)
+	}
+	for _, want := range []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed} {
+		select {
+		case state := <-changes:
+			if state != want {
+				t.Fatalf("state change->%s, want %s", state, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("state change to %s not observed", want)
+		}
+	}
+}
+
+func TestBreakerBypass(t *testing.T) {
+	client, _ := redistest.NewClient(t, &Config{
+		Breaker: BreakerConfig{
+			Enable:           true,
+			MinRequests:      4,
+			OpenTimeout:      1,
+			HalfOpenRequests: 1,
+			Bypass:           true,
+		},
+	})
+	var (
+		b   = client.Breaker()
+		key = NewModule("ooz-test").GetKey("bypass")
+	)
+	client.Set(key, "old", time.Hour)
+	for i := 0; i < 6; i++ {
+		b.Record(&net.OpError{Op: "read", Err: net.UnknownNetworkError("test")}, time.Millisecond)
+	}
+	// the invalidation is deferred while the cache is bypassed.
+	if err := client.InvalidateCache(key); err != nil || !client.CacheBypassed() {
+		t.Fatalf("client.InvalidateCache() err->%v, bypassed->%v", err, client.CacheBypassed())
+	}
+	// without a HealthMonitor, CacheBypassed probes the half-open breaker and
+	// the key is deleted once it closes.
+	time.Sleep(time.Second)
+	for i := 0; client.CacheBypassed(); i++ {
+		if i == 100 {
+			t.Fatalf("b.State()->%s, cache still bypassed", b.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := client.Get(key).Err(); !IsRedisNil(err) {
+		t.Fatalf("client.Get() invalidated key err->%v", err)
+	}
+}
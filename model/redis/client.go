@@ -1,8 +1,9 @@
-// Based on `github.com/go-redis/redis`v6.6.0
+// Based on `github.com/go-redis/redis`v6.15.9
 package redis
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -59,6 +60,12 @@ type (
 		// Enables read only queries on slave nodes.
 		// Only for cluster.
 		ReadOnly bool `yaml:"read_only,omitempty"`
+		// Command instrumentation hooks.
+		Hooks HooksConfig `yaml:"hooks,omitempty"`
+		// Encoding of the objects stored by SetObject.
+		Object ObjectConfig `yaml:"object,omitempty"`
+		// Circuit breaker, commands fail fast with ErrBreakerOpen when open.
+		Breaker BreakerConfig `yaml:"breaker,omitempty"`
 	}
 	// SingleConfig redis single node client config.
 	SingleConfig struct {
@@ -67,6 +74,12 @@ type (
 		// Maximum backoff between each retry.
 		// Default is 512 seconds; -1 disables backoff.
 		MaxRetryBackoff int64 `yaml:"max_retry_backoff,omitempty"`
+		// Read replica host:port addresses, read-only commands are sent to
+		// them and the others to Addr.
+		ReplicaAddrs []string `yaml:"replica_addrs,omitempty"`
+		// Replica selection, [round_robin, latency].
+		// Default is round_robin.
+		ReplicaRouting string `yaml:"replica_routing,omitempty"`
 	}
 	// ClusterConfig redis cluster client config.
 	ClusterConfig struct {
@@ -79,6 +92,29 @@ type (
 		// Enables routing read-only queries to the closest master or slave node.
 		RouteByLatency bool `yaml:"route_by_latency,omitempty"`
 	}
+	// HooksConfig redis command instrumentation config.
+	HooksConfig struct {
+		// Enables per-command latency and error metrics in prometheus format.
+		Metrics bool `yaml:"metrics,omitempty"`
+		// Namespace of the prometheus metrics.
+		// Default is "redis".
+		MetricsNamespace string `yaml:"metrics_namespace,omitempty"`
+		// Commands slower than this are logged with their key prefix, time: millisecond.
+		// Default is 0, the slow log is disabled.
+		SlowThreshold int64 `yaml:"slow_threshold,omitempty"`
+	}
+	// ObjectConfig redis object codec config.
+	ObjectConfig struct {
+		// Codec name, [json, msgpack, gob] or registered by RegisterCodec.
+		// Default is json.
+		Codec string `yaml:"codec,omitempty"`
+		// Compression name, [snappy, zstd] or registered by RegisterCompressor.
+		// Default is not to compress.
+		Compression string `yaml:"compression,omitempty"`
+		// Encoded objects larger than this are compressed, unit: byte.
+		// Default is 1024.
+		CompressThreshold int `yaml:"compress_threshold,omitempty"`
+	}
 )
 
 // Client redis client and cluster client merge.
@@ -86,17 +122,43 @@ type (
 	Client struct {
 		cfg *Config
 		Cmdable
+		hooksMu  sync.RWMutex
+		hooks    []Hook
+		objCodec *ObjectCodec
+		breaker  *Breaker
+		// the cache keys to delete when the breaker closes, and is a
+		// half-open probe in flight?
+		invalidations cacheInvalidations
+		probing       int32
+		scriptsOnce   sync.Once
+		scripts       *ScriptRegistry
+		// in-process loads of Remember.
+		flight flightGroup
+		// read replicas, only for single.
+		replicas []*redis.Client
+		master   *Client
+		// the client of Master(), its hooks are shared.
+		parent *Client
+		// the clock of the deadlines stored in redis, see setClock.
+		clock func() time.Time
 	}
 	Cmdable interface {
 		redis.Cmdable
 		TxPipeline() redis.Pipeliner
 		TxPipelined(fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
-		Publish(channel, message string) *redis.IntCmd
+		// the message is any value since go-redis v6.15, strings are accepted
+		// as before.
+		Publish(channel string, message interface{}) *redis.IntCmd
 		Subscribe(channels ...string) *redis.PubSub
+		PSubscribe(channels ...string) *redis.PubSub
+		Do(args ...interface{}) *redis.Cmd
+		Process(cmd redis.Cmder) error
+		Close() error
 	}
 	// Alias-> usth ooz.redis's method copy to go-redis.redis
 	PubSub             = redis.PubSub
 	Message            = redis.Message
+	Subscription       = redis.Subscription
 	GeoLocation        = redis.GeoLocation
 	GeoRadiusQuery     = redis.GeoRadiusQuery
 	ZRangeBy           = redis.ZRangeBy
@@ -118,34 +180,50 @@ type (
 	ZSliceCmd          = redis.ZSliceCmd
 	ScanCmd            = redis.ScanCmd
 	ClusterSlotsCmd    = redis.ClusterSlotsCmd
+	Cmd                = redis.Cmd
 )
 
 // NewClient new redis client and cluster redis.
 func NewClient(cfg *Config) (*Client, error) {
+	objCodec, err := NewObjectCodec(cfg.Object)
+	if err != nil {
+		return nil, err
+	}
 	var (
 		c = &Client{
-			cfg: cfg,
+			cfg:      cfg,
+			objCodec: objCodec,
 		}
 	)
+	if cfg.Breaker.Enable {
+		c.breaker = NewBreaker(cfg.Breaker)
+		c.breaker.OnStateChange(func(from, to BreakerState) {
+			if to == BreakerClosed {
+				go c.flushInvalidations()
+			}
+		})
+	}
 	switch cfg.DeployType {
 	case DeploySingle:
 		// redis client
-		c.Cmdable = redis.NewClient(&redis.Options{
-			Addr:               cfg.ForSingle.Addr,
-			Password:           cfg.Password,
-			MaxRetries:         cfg.MaxRetries,
-			PoolSize:           cfg.PoolSizePerNode,
-			MaxRetryBackoff:    time.Duration(cfg.ForSingle.MaxRetryBackoff) * time.Second,
-			DialTimeout:        time.Duration(cfg.DialTimeout) * time.Second,
-			ReadTimeout:        time.Duration(cfg.ReadTimeout) * time.Second,
-			WriteTimeout:       time.Duration(cfg.WriteTimeout) * time.Second,
-			PoolTimeout:        time.Duration(cfg.PoolTimeout) * time.Second,
-			IdleTimeout:        time.Duration(cfg.IdleTimeout) * time.Second,
-			IdleCheckFrequency: time.Duration(cfg.IdleCheckFrequency) * time.Second,
-		})
+		client := c.newSingleNode(cfg.ForSingle.Addr)
+		if len(cfg.ForSingle.ReplicaAddrs) == 0 {
+			c.wrapProcess(client)
+			c.Cmdable = client
+			break
+		}
+		if err := c.routeReplicas(client); err != nil {
+			return nil, err
+		}
 	case DeployCluster:
 		// redis cluster client
-		c.Cmdable = redis.NewClusterClient(&redis.ClusterOptions{
+		var onNewNode func(*redis.Client)
+		if c.breaker != nil {
+			onNewNode = func(node *redis.Client) {
+				node.SetLimiter(c.breaker)
+			}
+		}
+		client := redis.NewClusterClient(&redis.ClusterOptions{
 			Addrs:              cfg.ForCluster.Addrs,
 			Password:           cfg.Password,
 			ReadOnly:           cfg.ReadOnly,
@@ -159,10 +237,20 @@ func NewClient(cfg *Config) (*Client, error) {
 			PoolTimeout:        time.Duration(cfg.PoolTimeout) * time.Second,
 			IdleTimeout:        time.Duration(cfg.IdleTimeout) * time.Second,
 			IdleCheckFrequency: time.Duration(cfg.IdleCheckFrequency) * time.Second,
+			OnNewNode:          onNewNode,
 		})
+		c.wrapProcess(client)
+		c.Cmdable = client
 	default:
 		return nil, fmt.Errorf("Config.DeployType: optionals-> %s, %s, this cfg cat't nil.", DeploySingle, DeployCluster)
 	}
+	// config hooks
+	if c.breaker != nil {
+		c.AddHook(c.breaker)
+	}
+	if err := c.addConfigHooks(); err != nil {
+		return nil, err
+	}
 	if _, err := c.Ping().Result(); err != nil {
 		return nil, err
 	}
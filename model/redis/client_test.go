@@ -1,21 +1,15 @@
-package redis
+package redis_test
 
 import (
 	"testing"
 	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
 )
 
 func TestClient(t *testing.T) {
-	single := SingleConfig{
-		Addr: "127.0.0.1:6379",
-	}
-	client, err := NewClient(&Config{
-		DeployType: "single",
-		ForSingle:  single,
-	})
-	if err != nil {
-		t.Errorf("new client err->%v", err)
-	}
+	client, _ := redistest.NewClient(t)
 	m := NewModule("ooz-test")
 	s, err := client.Set(m.GetKey("ooz_key"), "ooz_value", time.Second).Result()
 	if err != nil {
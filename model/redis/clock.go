@@ -0,0 +1,35 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/usthooz/oozkits/model/redis/internal/testhook"
+)
+
+func init() {
+	testhook.SetClock = func(client interface{}, now func() time.Time) {
+		client.(*Client).setClock(now)
+	}
+}
+
+// setClock sets the clock of the deadlines stored in redis, redistest sets
+// the time of its server. Default is the system clock.
+func (c *Client) setClock(now func() time.Time) {
+	if c.parent != nil {
+		c.parent.setClock(now)
+		return
+	}
+	c.clock = now
+}
+
+// now returns the time of the clock, the instances sharing the keys of the
+// deadlines must agree on it.
+func (c *Client) now() time.Time {
+	if c.parent != nil {
+		return c.parent.now()
+	}
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock()
+}
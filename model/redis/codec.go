@@ -0,0 +1,304 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Codec marshals the objects stored by SetObject.
+type Codec interface {
+	// Name codec name used by ObjectConfig.Codec.
+	Name() string
+	// ID is written into the value header, must be unique and in [1, 15].
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Compressor compresses the marshaled objects larger than ObjectConfig.CompressThreshold.
+type Compressor interface {
+	// Name compressor name used by ObjectConfig.Compression.
+	Name() string
+	// ID is written into the value header, must be unique and in [1, 7].
+	ID() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Value header byte, 1 CCC DDDD: the high bit is always set, C is compressor id
+// (0 means not compressed), D is codec id. Values with the high bit unset were
+// not written by SetObject and are decoded as plain json.
+const (
+	headerFlag     byte = 0x80
+	headerCodec    byte = 0x0f
+	headerCompress byte = 0x70
+)
+
+// DefaultCompressThreshold objects larger than this are compressed, unit: byte.
+const DefaultCompressThreshold = 1024
+
+var (
+	// ErrUnknownCodec the value header references a codec that is not registered.
+	ErrUnknownCodec = errors.New("redis: unknown object codec")
+	// ErrUnknownCompressor the value header references a compressor that is not registered.
+	ErrUnknownCompressor = errors.New("redis: unknown object compressor")
+)
+
+var (
+	codecsMu      sync.RWMutex
+	codecs        = make(map[byte]Codec)
+	codecsByName  = make(map[string]Codec)
+	compressors   = make(map[byte]Compressor)
+	compressNames = make(map[string]Compressor)
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(MsgpackCodec{})
+	RegisterCodec(GobCodec{})
+	RegisterCompressor(SnappyCompressor{})
+	RegisterCompressor(new(ZstdCompressor))
+}
+
+// RegisterCodec makes the codec available by name and id, panics on duplicates.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	id := c.ID()
+	if id == 0 || id > headerCodec {
+		panic(fmt.Sprintf("redis: RegisterCodec codec id out of range, codec->%s", c.Name()))
+	}
+	if _, ok := codecs[id]; ok {
+		panic(fmt.Sprintf("redis: RegisterCodec called twice for codec id->%d", id))
+	}
+	if _, ok := codecsByName[c.Name()]; ok {
+		panic(fmt.Sprintf("redis: RegisterCodec called twice for codec->%s", c.Name()))
+	}
+	codecs[id] = c
+	codecsByName[c.Name()] = c
+}
+
+// RegisterCompressor makes the compressor available by name and id, panics on duplicates.
+func RegisterCompressor(c Compressor) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	id := c.ID()
+	if id == 0 || id > headerCompress>>4 {
+		panic(fmt.Sprintf("redis: RegisterCompressor compressor id out of range, compressor->%s", c.Name()))
+	}
+	if _, ok := compressors[id]; ok {
+		panic(fmt.Sprintf("redis: RegisterCompressor called twice for compressor id->%d", id))
+	}
+	if _, ok := compressNames[c.Name()]; ok {
+		panic(fmt.Sprintf("redis: RegisterCompressor called twice for compressor->%s", c.Name()))
+	}
+	compressors[id] = c
+	compressNames[c.Name()] = c
+}
+
+// ObjectCodec encodes objects with a header byte, so that the codec and
+// compression can be changed without breaking the existing values.
+type ObjectCodec struct {
+	codec      Codec
+	compressor Compressor
+	threshold  int
+}
+
+// NewObjectCodec creates object codec by config.
+func NewObjectCodec(cfg ObjectConfig) (*ObjectCodec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	var (
+		name = cfg.Codec
+		oc   = &ObjectCodec{
+			threshold: cfg.CompressThreshold,
+		}
+	)
+	if name == "" {
+		name = JSONCodec{}.Name()
+	}
+	codec, ok := codecsByName[name]
+	if !ok {
+		return nil, fmt.Errorf("ObjectConfig.Codec: unknown codec->%s", name)
+	}
+	oc.codec = codec
+	if cfg.Compression != "" {
+		compressor, ok := compressNames[cfg.Compression]
+		if !ok {
+			return nil, fmt.Errorf("ObjectConfig.Compression: unknown compressor->%s", cfg.Compression)
+		}
+		oc.compressor = compressor
+	}
+	if oc.threshold <= 0 {
+		oc.threshold = DefaultCompressThreshold
+	}
+	return oc, nil
+}
+
+// Codec returns the codec used to encode.
+func (oc *ObjectCodec) Codec() Codec {
+	return oc.codec
+}
+
+// Encode marshals v and compresses it when it is larger than the threshold.
+func (oc *ObjectCodec) Encode(v interface{}) ([]byte, error) {
+	data, err := oc.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	header := headerFlag | oc.codec.ID()
+	if oc.compressor != nil && len(data) > oc.threshold {
+		data, err = oc.compressor.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		header |= oc.compressor.ID() << 4
+	}
+	b := make([]byte, 0, len(data)+1)
+	b = append(b, header)
+	return append(b, data...), nil
+}
+
+// Decode unmarshals data into ptr by the codec and compressor in the header,
+// data without header is decoded as json.
+func (oc *ObjectCodec) Decode(data []byte, ptr interface{}) error {
+	if len(data) == 0 || data[0]&headerFlag == 0 {
+		return json.Unmarshal(data, ptr)
+	}
+	header := data[0]
+	data = data[1:]
+	codecsMu.RLock()
+	codec, ok := codecs[header&headerCodec]
+	compressor, compressOk := compressors[(header&headerCompress)>>4]
+	codecsMu.RUnlock()
+	if !ok {
+		return ErrUnknownCodec
+	}
+	if header&headerCompress != 0 {
+		if !compressOk {
+			return ErrUnknownCompressor
+		}
+		var err error
+		if data, err = compressor.Decompress(data); err != nil {
+			return err
+		}
+	}
+	return codec.Unmarshal(data, ptr)
+}
+
+// JSONCodec encoding/json codec.
+type JSONCodec struct{}
+
+// Name
+func (JSONCodec) Name() string { return "json" }
+
+// ID
+func (JSONCodec) ID() byte { return 1 }
+
+// Marshal
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// MsgpackCodec msgpack codec.
+type MsgpackCodec struct{}
+
+// Name
+func (MsgpackCodec) Name() string { return "msgpack" }
+
+// ID
+func (MsgpackCodec) ID() byte { return 2 }
+
+// Marshal
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+// Unmarshal
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// GobCodec encoding/gob codec.
+type GobCodec struct{}
+
+// Name
+func (GobCodec) Name() string { return "gob" }
+
+// ID
+func (GobCodec) ID() byte { return 3 }
+
+// Marshal
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// SnappyCompressor snappy block compressor.
+type SnappyCompressor struct{}
+
+// Name
+func (SnappyCompressor) Name() string { return "snappy" }
+
+// ID
+func (SnappyCompressor) ID() byte { return 1 }
+
+// Compress
+func (SnappyCompressor) Compress(data []byte) ([]byte, error) { return snappy.Encode(nil, data), nil }
+
+// Decompress
+func (SnappyCompressor) Decompress(data []byte) ([]byte, error) { return snappy.Decode(nil, data) }
+
+// ZstdCompressor zstd compressor, the encoder and decoder are created once and shared.
+type ZstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+// Name
+func (*ZstdCompressor) Name() string { return "zstd" }
+
+// ID
+func (*ZstdCompressor) ID() byte { return 2 }
+
+// init
+func (z *ZstdCompressor) init() error {
+	z.once.Do(func() {
+		if z.encoder, z.err = zstd.NewWriter(nil); z.err != nil {
+			return
+		}
+		z.decoder, z.err = zstd.NewReader(nil)
+	})
+	return z.err
+}
+
+// Compress
+func (z *ZstdCompressor) Compress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.encoder.EncodeAll(data, nil), nil
+}
+
+// Decompress
+func (z *ZstdCompressor) Decompress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.decoder.DecodeAll(data, nil)
+}
@@ -0,0 +1,429 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// CronCatchUp policy of the ticks missed while no instance was running the
+// job, .e.g. all instances down or the previous run too long.
+type CronCatchUp int
+
+const (
+	// CronCatchUpNone skips the missed ticks, a tick is run only within
+	// Tolerance of its time.
+	CronCatchUpNone CronCatchUp = iota
+	// CronCatchUpLatest runs the latest missed tick once.
+	CronCatchUpLatest
+	// CronCatchUpAll runs every missed tick in order, up to MaxCatchUp.
+	CronCatchUpAll
+)
+
+// cronParser parses the standard 5 fields with optional seconds and descriptors.
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour |
+	cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// CronFunc job function, ctx is canceled when the lock of the run is lost.
+type CronFunc func(ctx context.Context, run *CronRun) error
+
+// CronRun run of a job tick.
+type CronRun struct {
+	Job string
+	// Tick scheduled time of the run.
+	Tick time.Time
+	// Token fencing token, increasing with every run of the job.
+	Token int64
+}
+
+// CronStatus last run of a job, recorded in redis.
+type CronStatus struct {
+	Job string `json:"job"`
+	// LastTick latest claimed tick.
+	LastTick time.Time `json:"last_tick"`
+	// LastDoneTick latest finished tick, the ticks after it are offered again
+	// until a run finishes them.
+	LastDoneTick time.Time `json:"last_done_tick"`
+	// LastRunAt start time of the last finished run.
+	LastRunAt    time.Time     `json:"last_run_at"`
+	LastDuration time.Duration `json:"last_duration"`
+	LastError    string        `json:"last_error,omitempty"`
+	// LastRunner scheduler id of the last finished run.
+	LastRunner string `json:"last_runner"`
+	Token      int64  `json:"token"`
+	// Running is a run in progress?
+	Running bool `json:"running"`
+}
+
+// CronSchedulerOptions cron scheduler options.
+type CronSchedulerOptions struct {
+	// Scheduler instance id, recorded as the runner.
+	// Default is random.
+	ID string
+	// Time zone of the cron expressions.
+	// Default is time.Local.
+	Location *time.Location
+}
+
+// init sets the default options.
+func (o *CronSchedulerOptions) init() {
+	if o.ID == "" {
+		o.ID = randomID()
+	}
+	if o.Location == nil {
+		o.Location = time.Local
+	}
+}
+
+// CronJobOptions cron job options.
+type CronJobOptions struct {
+	// CatchUp policy of the missed ticks.
+	// Default is CronCatchUpNone.
+	CatchUp CronCatchUp
+	// A tick is on time within Tolerance, only used by CronCatchUpNone.
+	// Default is 1 minute.
+	Tolerance time.Duration
+	// Maximum number of missed ticks run by CronCatchUpAll.
+	// Default is 100.
+	MaxCatchUp int
+	// TTL of the run lock, renewed while the job runs. A tick is not run
+	// while the previous run holds the lock.
+	// Default is 1 minute.
+	LockTTL time.Duration
+}
+
+// init sets the default options.
+func (o *CronJobOptions) init() {
+	if o.Tolerance <= 0 {
+		o.Tolerance = time.Minute
+	}
+	if o.MaxCatchUp <= 0 {
+		o.MaxCatchUp = 100
+	}
+	if o.LockTTL <= 0 {
+		o.LockTTL = time.Minute
+	}
+}
+
+// cronJob registered job.
+type cronJob struct {
+	name     string
+	schedule cron.Schedule
+	fn       CronFunc
+	opts     CronJobOptions
+	// keys, share the hash tag {cron:scheduler:job}.
+	state string
+	lock  string
+	// registered at, the ticks before are not caught up.
+	since time.Time
+}
+
+// CronScheduler runs cron jobs on every instance, each tick is run once by
+// the instance claiming it in redis. The claim takes the run lock and a new
+// fencing token, the lock is renewed while the job runs.
+//
+// A tick is done when its run finishes, successfully or not. A tick whose run
+// crashed or lost the lock is claimed again with a greater token once the
+// lock expires; the late run has its ctx canceled when the renewal fails and
+// its finish is rejected, so downstream writes should be fenced by the Token.
+type CronScheduler struct {
+	client *Client
+	module *Module
+	name   string
+	opts   CronSchedulerOptions
+	mu     sync.Mutex
+	jobs   map[string]*cronJob
+}
+
+var (
+	// the tick can be claimed if it is not done and not before the claimed
+	// tick, i.e. a claimed tick is claimed again after its lock expired.
+	// KEYS: state, lock; ARGV: tick, id, lock ttl
+	cronClaimScript = newLibScript("cron.claim", `
+local tick = tonumber(ARGV[1])
+if tonumber(redis.call('HGET', KEYS[1], 'done') or '0') >= tick or
+	tonumber(redis.call('HGET', KEYS[1], 'tick') or '0') > tick then
+	return 0
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return -1
+end
+local token = redis.call('HINCRBY', KEYS[1], 'token', 1)
+redis.call('SET', KEYS[2], ARGV[2] .. ':' .. token, 'PX', ARGV[3])
+redis.call('HSET', KEYS[1], 'tick', ARGV[1])
+return token`)
+	// KEYS: state, lock; ARGV: lock value, lock ttl
+	cronRenewScript = newLibScript("cron.renew", `
+if redis.call('GET', KEYS[2]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[2], ARGV[2])
+end
+return 0`)
+	// the run is recorded only if the tick was not claimed again.
+	// KEYS: state, lock; ARGV: id, token, run at, duration, error, tick
+	cronFinishScript = newLibScript("cron.finish", `
+if redis.call('GET', KEYS[2]) == ARGV[1] .. ':' .. ARGV[2] then
+	redis.call('DEL', KEYS[2])
+end
+if redis.call('HGET', KEYS[1], 'token') ~= ARGV[2] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'done', ARGV[6], 'run_at', ARGV[3], 'duration', ARGV[4], 'error', ARGV[5], 'runner', ARGV[1])
+return 1`)
+)
+
+// NewCronScheduler creates cron scheduler named name under the module, the
+// instances with the same name share the jobs.
+func NewCronScheduler(c *Client, m *Module, name string, opts *CronSchedulerOptions) *CronScheduler {
+	var o CronSchedulerOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	registerLibScripts(c, m, cronClaimScript, cronRenewScript, cronFinishScript)
+	return &CronScheduler{
+		client: c,
+		module: m,
+		name:   name,
+		opts:   o,
+		jobs:   make(map[string]*cronJob),
+	}
+}
+
+// ID returns the scheduler instance id.
+func (s *CronScheduler) ID() string {
+	return s.opts.ID
+}
+
+// Register adds the job by the cron expression, .e.g. "*/5 * * * *",
+// "0 30 * * * *" with seconds or "@every 10m". Must be called before Run.
+func (s *CronScheduler) Register(name, spec string, fn CronFunc, opts *CronJobOptions) error {
+	schedule, err := cronParser.Parse(spec)
+	if err != nil {
+		return fmt.Errorf("redis: cron job %s: %s", name, err.Error())
+	}
+	var o CronJobOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[name]; ok {
+		return fmt.Errorf("redis: cron job %s is already registered", name)
+	}
+	s.jobs[name] = &cronJob{
+		name:     name,
+		schedule: schedule,
+		fn:       fn,
+		opts:     o,
+		state:    hashTagKey(s.module, "cron:"+s.name+":"+name, "state"),
+		lock:     hashTagKey(s.module, "cron:"+s.name+":"+name, "lock"),
+		since:    s.client.now(),
+	}
+	return nil
+}
+
+// Run runs the jobs until ctx is done, waiting for the running jobs.
+func (s *CronScheduler) Run(ctx context.Context) error {
+	s.mu.Lock()
+	jobs := make([]*cronJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *cronJob) {
+			defer wg.Done()
+			s.runJob(ctx, job)
+		}(job)
+	}
+	wg.Wait()
+	return nil
+}
+
+// next returns the first tick of the job after t.
+func (s *CronScheduler) next(job *cronJob, t time.Time) time.Time {
+	t = t.In(s.opts.Location)
+	if every, ok := job.schedule.(cron.ConstantDelaySchedule); ok {
+		// aligned, so that all instances have the same ticks.
+		return t.Truncate(every.Delay).Add(every.Delay)
+	}
+	return job.schedule.Next(t)
+}
+
+// runJob runs the due ticks of the job and sleeps until the next tick.
+func (s *CronScheduler) runJob(ctx context.Context, job *cronJob) {
+	for ctx.Err() == nil {
+		s.runDue(ctx, job, s.client.now())
+		now := s.client.now()
+		if next := s.next(job, now); !next.IsZero() {
+			sleepContext(ctx, next.Sub(now))
+		} else {
+			// never scheduled again.
+			<-ctx.Done()
+		}
+	}
+}
+
+// runDue runs the ticks of the job due at now.
+func (s *CronScheduler) runDue(ctx context.Context, job *cronJob, now time.Time) {
+	ticks, err := s.dueTicks(job, now)
+	if err != nil {
+		ozlog.Errorf("CronScheduler(%s).dueTicks(%s): %s", s.name, job.name, err.Error())
+	}
+	for _, tick := range ticks {
+		if ctx.Err() != nil {
+			return
+		}
+		s.runTick(ctx, job, tick)
+	}
+}
+
+// dueTicks returns the ticks of the job to run at now by the catch-up policy.
+func (s *CronScheduler) dueTicks(job *cronJob, now time.Time) ([]time.Time, error) {
+	since := job.since
+	last, err := s.client.HGet(job.state, "done").Int64()
+	if err != nil && !IsRedisNil(err) {
+		return nil, err
+	}
+	if err == nil {
+		since = time.Unix(0, last*int64(time.Millisecond))
+	}
+	// only the latest ticks are kept.
+	max := 1
+	if job.opts.CatchUp == CronCatchUpAll {
+		max = job.opts.MaxCatchUp
+	}
+	var ticks []time.Time
+	for t := s.next(job, since); !t.IsZero() && !t.After(now); t = s.next(job, t) {
+		if len(ticks) == max {
+			ticks = ticks[1:]
+		}
+		ticks = append(ticks, t)
+	}
+	if job.opts.CatchUp == CronCatchUpNone && len(ticks) > 0 && now.Sub(ticks[0]) > job.opts.Tolerance {
+		return nil, nil
+	}
+	return ticks, nil
+}
+
+// runTick claims the tick and runs the job if claimed.
+func (s *CronScheduler) runTick(ctx context.Context, job *cronJob, tick time.Time) {
+	token, err := cronClaimScript.Run(s.client, []string{job.state, job.lock},
+		unixMilli(tick), s.opts.ID, int64(job.opts.LockTTL/time.Millisecond)).Int64()
+	if err != nil {
+		ozlog.Errorf("CronScheduler(%s).claim(%s): %s", s.name, job.name, err.Error())
+		return
+	}
+	if token <= 0 {
+		// done, or a run of the job is in progress.
+		return
+	}
+	lock := s.opts.ID + ":" + strconv.FormatInt(token, 10)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(job.opts.LockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				n, err := cronRenewScript.Run(s.client, []string{job.state, job.lock},
+					lock, int64(job.opts.LockTTL/time.Millisecond)).Int64()
+				if err != nil {
+					ozlog.Errorf("CronScheduler(%s).renew(%s): %s", s.name, job.name, err.Error())
+				} else if n == 0 {
+					ozlog.Errorf("CronScheduler(%s).renew(%s): lock lost", s.name, job.name)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	var (
+		start = s.client.now()
+		begin = time.Now()
+	)
+	err = s.call(runCtx, job, &CronRun{Job: job.name, Tick: tick, Token: token})
+	duration := time.Since(begin)
+	close(done)
+	var errMsg string
+	if err != nil {
+		errMsg = err.Error()
+		ozlog.Errorf("CronScheduler(%s).run(%s): %s", s.name, job.name, errMsg)
+	}
+	n, err := cronFinishScript.Run(s.client, []string{job.state, job.lock},
+		s.opts.ID, token, unixMilli(start), int64(duration/time.Millisecond), errMsg, unixMilli(tick)).Int64()
+	if err != nil {
+		ozlog.Errorf("CronScheduler(%s).finish(%s): %s", s.name, job.name, err.Error())
+	} else if n == 0 {
+		ozlog.Errorf("CronScheduler(%s).finish(%s): tick %s claimed again by a later run", s.name, job.name, tick)
+	}
+}
+
+// call calls the job function, recovering panics.
+func (s *CronScheduler) call(ctx context.Context, job *cronJob, run *CronRun) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.fn(ctx, run)
+}
+
+// Status returns the last run of the job.
+func (s *CronScheduler) Status(job string) (*CronStatus, error) {
+	s.mu.Lock()
+	j, ok := s.jobs[job]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("redis: cron job %s is not registered", job)
+	}
+	var (
+		state   *StringStringMapCmd
+		running *IntCmd
+	)
+	_, err := s.client.Pipelined(func(p Pipeliner) error {
+		state = p.HGetAll(j.state)
+		running = p.Exists(j.lock)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var (
+		fields = state.Val()
+		st     = &CronStatus{
+			Job:        job,
+			LastError:  fields["error"],
+			LastRunner: fields["runner"],
+			Running:    running.Val() == 1,
+		}
+		ms = func(field string) int64 {
+			n, _ := strconv.ParseInt(fields[field], 10, 64)
+			return n
+		}
+	)
+	if n := ms("tick"); n > 0 {
+		st.LastTick = time.Unix(0, n*int64(time.Millisecond))
+	}
+	if n := ms("done"); n > 0 {
+		st.LastDoneTick = time.Unix(0, n*int64(time.Millisecond))
+	}
+	if n := ms("run_at"); n > 0 {
+		st.LastRunAt = time.Unix(0, n*int64(time.Millisecond))
+	}
+	st.LastDuration = time.Duration(ms("duration")) * time.Millisecond
+	st.Token = ms("token")
+	return st, nil
+}
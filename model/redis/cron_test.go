@@ -0,0 +1,195 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestCronScheduler(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	srv.SetTime(srv.Now().Truncate(time.Second))
+	var (
+		ctx    = context.Background()
+		m      = NewModule("ooz-test")
+		mu     sync.Mutex
+		ticks  = make(map[time.Time]int)
+		tokens = make(map[int64]bool)
+	)
+	job := func(ctx context.Context, run *CronRun) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ticks[run.Tick]++
+		if tokens[run.Token] {
+			t.Errorf("duplicate token->%d", run.Token)
+		}
+		tokens[run.Token] = true
+		return errors.New("job failed")
+	}
+	var schedulers []*CronScheduler
+	for i := 0; i < 3; i++ {
+		s := NewCronScheduler(client, m, "test", nil)
+		if err := s.Register("every", "@every 1s", job, nil); err != nil {
+			t.Fatalf("Register() err->%v", err)
+		}
+		if err := s.Register("every", "* * * * * *", job, nil); err == nil {
+			t.Fatalf("Register() duplicate err->%v", err)
+		}
+		schedulers = append(schedulers, s)
+	}
+	// every instance runs the due ticks, each tick is run once.
+	for i := 0; i < 3; i++ {
+		srv.Advance(time.Second)
+		var wg sync.WaitGroup
+		for _, s := range schedulers {
+			wg.Add(1)
+			go func(s *CronScheduler) {
+				defer wg.Done()
+				s.RunDue(ctx, "every", srv.Now())
+			}(s)
+		}
+		wg.Wait()
+	}
+	if len(ticks) != 3 {
+		t.Fatalf("ticks->%v", ticks)
+	}
+	for tick, n := range ticks {
+		if n != 1 || tick.Nanosecond() != 0 {
+			t.Fatalf("tick->%v, runs->%d", tick, n)
+		}
+	}
+	// Run runs the due tick at once.
+	srv.Advance(time.Second)
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	s := NewCronScheduler(client, m, "test", nil)
+	err := s.Register("every", "@every 1s", func(ctx context.Context, run *CronRun) error {
+		stop()
+		return job(ctx, run)
+	}, nil)
+	if err != nil {
+		t.Fatalf("Register() err->%v", err)
+	}
+	s.Run(runCtx)
+	if len(ticks) != 4 || ticks[srv.Now()] != 1 {
+		t.Fatalf("Run() ticks->%v", ticks)
+	}
+	st, err := s.Status("every")
+	if err != nil || st.LastError != "job failed" || st.Token != int64(len(tokens)) || st.Running || !st.LastRunAt.Equal(srv.Now()) {
+		t.Fatalf("Status() v->%+v, err->%v", st, err)
+	}
+	if _, err = s.Status("none"); err == nil {
+		t.Fatalf("Status() not registered err->%v", err)
+	}
+	if err = s.Register("bad", "* *", job, nil); err == nil {
+		t.Fatalf("Register() invalid spec err->%v", err)
+	}
+}
+
+func TestCronCatchUp(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	var (
+		m = NewModule("ooz-test")
+		s = NewCronScheduler(client, m, "test", nil)
+		// 100ms and 800ms after the latest tick.
+		now  = srv.Now().Truncate(time.Second).Add(100 * time.Millisecond)
+		late = now.Add(700 * time.Millisecond)
+	)
+	for name, policy := range map[string]CronCatchUp{
+		"none":   CronCatchUpNone,
+		"latest": CronCatchUpLatest,
+		"all":    CronCatchUpAll,
+	} {
+		s.Register(name, "@every 1s", nil, &CronJobOptions{
+			CatchUp:    policy,
+			Tolerance:  500 * time.Millisecond,
+			MaxCatchUp: 3,
+		})
+	}
+	for _, c := range []struct {
+		name       string
+		now        time.Time
+		missed     time.Duration
+		want       int
+		wantLatest bool
+	}{
+		{"none", now, 10 * time.Second, 1, true},
+		{"none", late, 10 * time.Second, 0, false},
+		{"latest", late, 10 * time.Second, 1, true},
+		{"all", late, 10 * time.Second, 3, true},
+		{"all", now, time.Second, 1, true},
+		{"all", now, 0, 0, false},
+	} {
+		client.HSet(s.StateKey(c.name), "done", UnixMilli(now.Truncate(time.Second).Add(-c.missed)))
+		ticks, err := s.DueTicks(c.name, c.now)
+		if err != nil || len(ticks) != c.want {
+			t.Fatalf("dueTicks(%s, %v) v->%v, err->%v", c.name, c.missed, ticks, err)
+		}
+		if c.wantLatest && !ticks[len(ticks)-1].Equal(now.Truncate(time.Second)) {
+			t.Fatalf("dueTicks(%s, %v) latest v->%v", c.name, c.missed, ticks)
+		}
+	}
+}
+
+func TestCronTakeover(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	srv.SetTime(srv.Now().Truncate(time.Second))
+	var (
+		ctx     = context.Background()
+		m       = NewModule("ooz-test")
+		opts    = &CronJobOptions{LockTTL: time.Second}
+		started = make(chan *CronRun, 1)
+		release = make(chan struct{})
+		runs    = make(chan *CronRun, 2)
+	)
+	late := NewCronScheduler(client, m, "test", nil)
+	late.Register("every", "@every 1s", func(ctx context.Context, run *CronRun) error {
+		started <- run
+		<-release
+		return nil
+	}, opts)
+	s := NewCronScheduler(client, m, "test", nil)
+	s.Register("every", "@every 1s", func(ctx context.Context, run *CronRun) error {
+		runs <- run
+		return nil
+	}, opts)
+	srv.Advance(time.Second)
+	tick := srv.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		late.RunDue(ctx, "every", tick)
+	}()
+	first := <-started
+	// the tick is not finished, it is claimed again once the lock expires.
+	s.RunDue(ctx, "every", tick)
+	if len(runs) != 0 {
+		t.Fatalf("RunDue() ran the tick while its lock is held")
+	}
+	srv.Advance(1100 * time.Millisecond)
+	s.RunDue(ctx, "every", tick)
+	if len(runs) != 1 {
+		t.Fatalf("RunDue() runs->%d, want the expired tick claimed again", len(runs))
+	}
+	second := <-runs
+	if !second.Tick.Equal(tick) || second.Token <= first.Token {
+		t.Fatalf("run->%+v, first run->%+v", second, first)
+	}
+	// the finish of the late run is rejected.
+	close(release)
+	<-done
+	st, err := s.Status("every")
+	if err != nil || st.LastRunner != s.ID() || st.Token != second.Token || !st.LastDoneTick.Equal(tick) || st.Running {
+		t.Fatalf("Status() v->%+v, err->%v", st, err)
+	}
+	// the done tick is not run again.
+	s.RunDue(ctx, "every", tick)
+	if len(runs) != 0 {
+		t.Fatalf("RunDue() ran the done tick again")
+	}
+}
@@ -0,0 +1,497 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// DelayQueue delayed and scheduled jobs on a sorted set scored by due time.
+// Pollers claim due jobs atomically with a lease, the jobs not acknowledged
+// before the lease expires are delivered again (at-least-once), and moved to
+// the dead set after MaxAttempts.
+type DelayQueue struct {
+	client *Client
+	opts   DelayQueueOptions
+	name   string
+	// keys, all keys of a queue share the hash tag {delay:name}.
+	due      string
+	claimed  string
+	jobs     string
+	attempts string
+	dead     string
+	claims   string
+}
+
+// DelayQueueOptions delay queue options.
+type DelayQueueOptions struct {
+	// A claimed job is delivered again if not acknowledged within Lease,
+	// Run extends the lease while the handler is running.
+	// Default is 30 seconds.
+	Lease time.Duration
+	// Jobs failed or expired MaxAttempts times are moved to the dead set.
+	// Default is 3.
+	MaxAttempts int
+	// Frequency of polling the due jobs.
+	// Default is 1 second.
+	PollInterval time.Duration
+	// Maximum number of jobs claimed per poll.
+	// Default is 100.
+	PollBatch int
+	// A failed job is retried after RetryDelay.
+	// Default is 5 seconds.
+	RetryDelay time.Duration
+}
+
+// init sets the default options.
+func (o *DelayQueueOptions) init() {
+	if o.Lease <= 0 {
+		o.Lease = 30 * time.Second
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 3
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = time.Second
+	}
+	if o.PollBatch <= 0 {
+		o.PollBatch = 100
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = 5 * time.Second
+	}
+}
+
+// DelayedJob delay queue job.
+type DelayedJob struct {
+	// ID job id, unique in the queue.
+	ID string
+	// Payload job data.
+	Payload []byte
+	// Attempts number of times the job has been claimed, including this one.
+	Attempts int
+	// ClaimID id of this claim, Ack, Nack and Touch fail with ErrJobNotFound
+	// once the job is claimed again.
+	ClaimID string
+	queue   *DelayQueue
+}
+
+var (
+	// KEYS: due, claimed, jobs, attempts, dead, claims; ARGV: now, lease deadline, limit, max attempts, claim prefix
+	delayClaimScript = newLibScript("delay_queue.claim", `
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[2], id)
+	redis.call('HDEL', KEYS[6], id)
+	if tonumber(redis.call('HGET', KEYS[4], id) or '0') >= tonumber(ARGV[4]) then
+		redis.call('ZADD', KEYS[5], ARGV[1], id)
+	else
+		redis.call('ZADD', KEYS[1], ARGV[1], id)
+	end
+end
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+local jobs = {}
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+	local payload = redis.call('HGET', KEYS[3], id)
+	if payload then
+		redis.call('ZADD', KEYS[2], ARGV[2], id)
+		local attempts = redis.call('HINCRBY', KEYS[4], id, 1)
+		local claim = ARGV[5] .. ':' .. attempts
+		redis.call('HSET', KEYS[6], id, claim)
+		table.insert(jobs, {id, payload, attempts, claim})
+	end
+end
+return jobs`)
+	// KEYS: due, claimed, jobs, claims; ARGV: id, due, payload
+	delayScheduleScript = newLibScript("delay_queue.schedule", `
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[3])
+return 1`)
+	// KEYS: due, claimed, jobs, dead, claims; ARGV: id, due
+	delayRescheduleScript = newLibScript("delay_queue.reschedule", `
+if redis.call('HEXISTS', KEYS[3], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[5], ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+return 1`)
+	// KEYS: due, claimed, jobs, attempts, dead, claims; ARGV: id
+	delayCancelScript = newLibScript("delay_queue.cancel", `
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[5], ARGV[1])
+redis.call('HDEL', KEYS[6], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+return redis.call('HDEL', KEYS[3], ARGV[1])`)
+	// KEYS: claimed, jobs, attempts, claims; ARGV: id, claim id
+	delayAckScript = newLibScript("delay_queue.ack", `
+if redis.call('HGET', KEYS[4], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1`)
+	// KEYS: due, claimed, dead, attempts, claims; ARGV: id, retry at, now, max attempts, claim id
+	delayNackScript = newLibScript("delay_queue.nack", `
+if redis.call('HGET', KEYS[5], ARGV[1]) ~= ARGV[5] then
+	return -1
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[5], ARGV[1])
+if tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or '0') >= tonumber(ARGV[4]) then
+	redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])
+	return 1
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+return 0`)
+	// KEYS: claimed, claims; ARGV: id, lease deadline, claim id
+	delayTouchScript = newLibScript("delay_queue.touch", `
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[3] then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+return 1`)
+	// KEYS: dead, due, attempts; ARGV: now, limit
+	delayRequeueDeadScript = newLibScript("delay_queue.requeue_dead", `
+local ids = redis.call('ZRANGE', KEYS[1], 0, tonumber(ARGV[2]) - 1)
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('ZADD', KEYS[2], ARGV[1], id)
+	redis.call('HDEL', KEYS[3], id)
+end
+return #ids`)
+)
+
+// NewDelayQueue creates delay queue named name under the module.
+func NewDelayQueue(c *Client, m *Module, name string, opts *DelayQueueOptions) *DelayQueue {
+	var o DelayQueueOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	registerLibScripts(c, m, delayClaimScript, delayScheduleScript, delayRescheduleScript, delayCancelScript,
+		delayAckScript, delayNackScript, delayTouchScript, delayRequeueDeadScript)
+	return &DelayQueue{
+		client:   c,
+		opts:     o,
+		name:     name,
+		due:      hashTagKey(m, "delay:"+name, "due"),
+		claimed:  hashTagKey(m, "delay:"+name, "claimed"),
+		jobs:     hashTagKey(m, "delay:"+name, "jobs"),
+		attempts: hashTagKey(m, "delay:"+name, "attempts"),
+		dead:     hashTagKey(m, "delay:"+name, "dead"),
+		claims:   hashTagKey(m, "delay:"+name, "claims"),
+	}
+}
+
+// Name returns queue name.
+func (q *DelayQueue) Name() string {
+	return q.name
+}
+
+// Schedule schedules the job to run at dueAt, a job with the same id is
+// replaced. A random id is generated if id is "", returns the job id.
+func (q *DelayQueue) Schedule(id string, payload []byte, dueAt time.Time) (string, error) {
+	if id == "" {
+		id = randomID()
+	}
+	err := delayScheduleScript.Run(q.client, []string{q.due, q.claimed, q.jobs, q.claims},
+		id, unixMilli(dueAt), payload).Err()
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// ScheduleAfter schedules the job to run after delay.
+func (q *DelayQueue) ScheduleAfter(id string, payload []byte, delay time.Duration) (string, error) {
+	return q.Schedule(id, payload, q.client.now().Add(delay))
+}
+
+// Reschedule changes the due time of the job, returns false if the job does not exist.
+func (q *DelayQueue) Reschedule(id string, dueAt time.Time) (bool, error) {
+	n, err := delayRescheduleScript.Run(q.client, []string{q.due, q.claimed, q.jobs, q.dead, q.claims},
+		id, unixMilli(dueAt)).Int64()
+	return n == 1, err
+}
+
+// Cancel deletes the job, returns false if the job does not exist.
+func (q *DelayQueue) Cancel(id string) (bool, error) {
+	n, err := delayCancelScript.Run(q.client, []string{q.due, q.claimed, q.jobs, q.attempts, q.dead, q.claims},
+		id).Int64()
+	return n == 1, err
+}
+
+// DueAt returns the due time of the scheduled job, returns Nil if the job
+// does not exist or is claimed.
+func (q *DelayQueue) DueAt(id string) (time.Time, error) {
+	score, err := q.client.ZScore(q.due, id).Result()
+	if err != nil {
+		return time.Time{}, err
+	}
+	ms := int64(score)
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond)), nil
+}
+
+// Claim claims up to PollBatch due jobs, including the jobs whose lease
+// expired, the expired jobs claimed MaxAttempts times are moved to the dead set.
+func (q *DelayQueue) Claim() ([]*DelayedJob, error) {
+	return q.claim(q.opts.PollBatch)
+}
+
+// claim claims up to limit due jobs.
+func (q *DelayQueue) claim(limit int) ([]*DelayedJob, error) {
+	now := q.client.now()
+	r, err := delayClaimScript.Run(q.client, []string{q.due, q.claimed, q.jobs, q.attempts, q.dead, q.claims},
+		unixMilli(now), unixMilli(now.Add(q.opts.Lease)), limit, q.opts.MaxAttempts, randomID()).Result()
+	if err != nil {
+		return nil, err
+	}
+	vals, ok := r.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected delay queue claim reply->%v", r)
+	}
+	jobs := make([]*DelayedJob, 0, len(vals))
+	for _, v := range vals {
+		job, ok := v.([]interface{})
+		if !ok || len(job) != 4 {
+			return nil, fmt.Errorf("redis: unexpected delay queue claim reply->%v", r)
+		}
+		id, _ := job[0].(string)
+		payload, _ := job[1].(string)
+		attempts, _ := job[2].(int64)
+		claimID, _ := job[3].(string)
+		jobs = append(jobs, &DelayedJob{
+			ID:       id,
+			Payload:  []byte(payload),
+			Attempts: int(attempts),
+			ClaimID:  claimID,
+			queue:    q,
+		})
+	}
+	return jobs, nil
+}
+
+// Ack acknowledges the job claimed by claimID is done and deletes it.
+func (q *DelayQueue) Ack(id, claimID string) error {
+	n, err := delayAckScript.Run(q.client, []string{q.claimed, q.jobs, q.attempts, q.claims}, id, claimID).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+// Nack reports the job claimed by claimID failed, it is retried after
+// RetryDelay or moved to the dead set if it has been claimed MaxAttempts times.
+func (q *DelayQueue) Nack(id, claimID string) (dead bool, err error) {
+	now := q.client.now()
+	n, err := delayNackScript.Run(q.client, []string{q.due, q.claimed, q.dead, q.attempts, q.claims},
+		id, unixMilli(now.Add(q.opts.RetryDelay)), unixMilli(now), q.opts.MaxAttempts, claimID).Int64()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 {
+		return false, ErrJobNotFound
+	}
+	return n == 1, nil
+}
+
+// Touch extends the lease of the job claimed by claimID by Lease.
+func (q *DelayQueue) Touch(id, claimID string) error {
+	n, err := delayTouchScript.Run(q.client, []string{q.claimed, q.claims}, id,
+		unixMilli(q.client.now().Add(q.opts.Lease)), claimID).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+// Len returns the number of scheduled, claimed and dead jobs.
+func (q *DelayQueue) Len() (scheduled, claimed, dead int64, err error) {
+	var cmds [3]*IntCmd
+	_, err = q.client.Pipelined(func(p Pipeliner) error {
+		cmds[0] = p.ZCard(q.due)
+		cmds[1] = p.ZCard(q.claimed)
+		cmds[2] = p.ZCard(q.dead)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return cmds[0].Val(), cmds[1].Val(), cmds[2].Val(), nil
+}
+
+// DeadJobs returns up to count jobs of the dead set, oldest first.
+func (q *DelayQueue) DeadJobs(count int64) ([]*DelayedJob, error) {
+	ids, err := q.client.ZRange(q.dead, 0, count-1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	var (
+		payloads *SliceCmd
+		attempts *SliceCmd
+	)
+	_, err = q.client.Pipelined(func(p Pipeliner) error {
+		payloads = p.HMGet(q.jobs, ids...)
+		attempts = p.HMGet(q.attempts, ids...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*DelayedJob, 0, len(ids))
+	for i, id := range ids {
+		payload, _ := payloads.Val()[i].(string)
+		job := &DelayedJob{
+			ID:      id,
+			Payload: []byte(payload),
+			queue:   q,
+		}
+		if s, ok := attempts.Val()[i].(string); ok {
+			fmt.Sscan(s, &job.Attempts)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// RequeueDead schedules up to count oldest dead jobs to run now and resets
+// their attempts.
+func (q *DelayQueue) RequeueDead(count int) (int, error) {
+	n, err := delayRequeueDeadScript.Run(q.client, []string{q.dead, q.due, q.attempts},
+		unixMilli(q.client.now()), count).Int64()
+	return int(n), err
+}
+
+// Run polls the due jobs every PollInterval and calls handler with up to
+// concurrency jobs in parallel until ctx is done, then waits for the running
+// handlers. Only as many jobs as handlers are free are claimed, so a lease
+// starts with its handler. A job is acknowledged if handler returns nil,
+// otherwise (or on panic) it is nacked. The lease is extended while handler
+// is running.
+func (q *DelayQueue) Run(ctx context.Context, concurrency int, handler func(*DelayedJob) error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var (
+		sem    = make(chan struct{}, concurrency)
+		wg     sync.WaitGroup
+		ticker = time.NewTicker(q.opts.PollInterval)
+	)
+	defer ticker.Stop()
+	for {
+		// wait for a free handler, it is taken by the first claimed job.
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		limit := cap(sem) - len(sem) + 1
+		if limit > q.opts.PollBatch {
+			limit = q.opts.PollBatch
+		}
+		jobs, err := q.claim(limit)
+		if err != nil {
+			ozlog.Errorf("DelayQueue(%s).Claim(): %s", q.name, err.Error())
+		}
+		if len(jobs) == 0 {
+			<-sem
+		}
+		for i, job := range jobs {
+			if i > 0 {
+				sem <- struct{}{}
+			}
+			wg.Add(1)
+			go func(job *DelayedJob) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				q.handle(job, handler)
+			}(job)
+		}
+		// claim again once a handler is free if the batch was full.
+		if len(jobs) == limit && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handle calls handler for the job and acks or nacks it.
+func (q *DelayQueue) handle(job *DelayedJob, handler func(*DelayedJob) error) {
+	var (
+		done = make(chan struct{})
+		err  error
+	)
+	go func() {
+		ticker := time.NewTicker(q.opts.Lease / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := job.Touch(); err != nil {
+					ozlog.Errorf("DelayQueue(%s).Touch(%s): %s", q.name, job.ID, err.Error())
+				}
+			}
+		}
+	}()
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		err = handler(job)
+	}()
+	close(done)
+	if err == nil {
+		if err = job.Ack(); err != nil {
+			ozlog.Errorf("DelayQueue(%s).Ack(%s): %s", q.name, job.ID, err.Error())
+		}
+		return
+	}
+	ozlog.Errorf("DelayQueue(%s) job %s failed, attempts: %d, err: %s", q.name, job.ID, job.Attempts, err.Error())
+	if _, err = job.Nack(); err != nil {
+		ozlog.Errorf("DelayQueue(%s).Nack(%s): %s", q.name, job.ID, err.Error())
+	}
+}
+
+// Ack acknowledges the job is done.
+func (j *DelayedJob) Ack() error {
+	return j.queue.Ack(j.ID, j.ClaimID)
+}
+
+// Nack reports the job failed.
+func (j *DelayedJob) Nack() (dead bool, err error) {
+	return j.queue.Nack(j.ID, j.ClaimID)
+}
+
+// Touch extends the lease of the job.
+func (j *DelayedJob) Touch() error {
+	return j.queue.Touch(j.ID, j.ClaimID)
+}
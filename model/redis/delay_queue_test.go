@@ -0,0 +1,185 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestDelayQueue(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	q := NewDelayQueue(client, NewModule("ooz-test"), "test_delay", &DelayQueueOptions{
+		Lease:        100 * time.Millisecond,
+		PollInterval: 20 * time.Millisecond,
+	})
+	if _, err := q.ScheduleAfter("order_1", []byte("timeout"), 100*time.Millisecond); err != nil {
+		t.Fatalf("q.ScheduleAfter() err->%v", err)
+	}
+	if _, err := q.ScheduleAfter("order_2", []byte("timeout"), 100*time.Millisecond); err != nil {
+		t.Fatalf("q.ScheduleAfter() err->%v", err)
+	}
+	if ok, err := q.Cancel("order_2"); err != nil || !ok {
+		t.Fatalf("q.Cancel() ok->%v, err->%v", ok, err)
+	}
+	if jobs, err := q.Claim(); err != nil || len(jobs) != 0 {
+		t.Fatalf("q.Claim() before due jobs->%d, err->%v", len(jobs), err)
+	}
+	srv.Advance(120 * time.Millisecond)
+	// claimed but not acked, delivered again after the lease.
+	jobs, err := q.Claim()
+	if err != nil || len(jobs) != 1 || jobs[0].ID != "order_1" {
+		t.Fatalf("q.Claim() jobs->%v, err->%v", jobs, err)
+	}
+	srv.Advance(120 * time.Millisecond)
+	var attempts int
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	q.Run(ctx, 2, func(job *DelayedJob) error {
+		attempts = job.Attempts
+		cancel()
+		return nil
+	})
+	if attempts != 2 {
+		t.Fatalf("job attempts->%d, want 2", attempts)
+	}
+	if scheduled, claimed, dead, err := q.Len(); err != nil || scheduled+claimed+dead != 0 {
+		t.Fatalf("q.Len() scheduled->%d, claimed->%d, dead->%d, err->%v", scheduled, claimed, dead, err)
+	}
+}
+
+func TestDelayQueueDead(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	q := NewDelayQueue(client, NewModule("ooz-test"), "test_delay", &DelayQueueOptions{
+		Lease:       60 * time.Millisecond,
+		RetryDelay:  time.Second,
+		MaxAttempts: 2,
+	})
+	if _, err := q.ScheduleAfter("slow", []byte("1"), 0); err != nil {
+		t.Fatalf("q.ScheduleAfter() err->%v", err)
+	}
+	if _, err := q.ScheduleAfter("poison", []byte("2"), 0); err != nil {
+		t.Fatalf("q.ScheduleAfter() err->%v", err)
+	}
+	jobs, err := q.Claim()
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("q.Claim() jobs->%v, err->%v", jobs, err)
+	}
+	slow, poison := jobs[0], jobs[1]
+	if slow.ID != "slow" {
+		slow, poison = poison, slow
+	}
+	// the failed job is retried after RetryDelay.
+	fail := func(job *DelayedJob) error {
+		return errors.New("poison")
+	}
+	q.Handle(poison, fail)
+	// the lease is extended while the handler runs longer than it.
+	q.Handle(slow, func(job *DelayedJob) error {
+		deadline := client.ZScore(q.ClaimedKey(), job.ID).Val()
+		srv.Advance(40 * time.Millisecond)
+		for i := 0; client.ZScore(q.ClaimedKey(), job.ID).Val() == deadline; i++ {
+			if i == 100 {
+				t.Fatalf("lease not extended")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		srv.Advance(40 * time.Millisecond)
+		if again, err := q.Claim(); err != nil || len(again) != 0 {
+			t.Errorf("q.Claim() running jobs->%v, err->%v", again, err)
+		}
+		return nil
+	})
+	// then dead after MaxAttempts.
+	srv.Advance(time.Second)
+	if jobs, err = q.Claim(); err != nil || len(jobs) != 1 || jobs[0].ID != "poison" || jobs[0].Attempts != 2 {
+		t.Fatalf("q.Claim() retry jobs->%v, err->%v", jobs, err)
+	}
+	q.Handle(jobs[0], fail)
+	jobs, err = q.DeadJobs(10)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != "poison" || jobs[0].Attempts != 2 || string(jobs[0].Payload) != "2" {
+		t.Fatalf("q.DeadJobs() jobs->%v, err->%v", jobs, err)
+	}
+	if n, err := q.RequeueDead(10); err != nil || n != 1 {
+		t.Fatalf("q.RequeueDead() n->%d, err->%v", n, err)
+	}
+	if scheduled, claimed, dead, err := q.Len(); err != nil || scheduled != 1 || claimed != 0 || dead != 0 {
+		t.Fatalf("q.Len() scheduled->%d, claimed->%d, dead->%d, err->%v", scheduled, claimed, dead, err)
+	}
+	// the lease of a job is extended by Touch.
+	jobs, err = q.Claim()
+	if err != nil || len(jobs) != 1 || jobs[0].Attempts != 1 {
+		t.Fatalf("q.Claim() jobs->%v, err->%v", jobs, err)
+	}
+	srv.Advance(40 * time.Millisecond)
+	if err = jobs[0].Touch(); err != nil {
+		t.Fatalf("job.Touch() err->%v", err)
+	}
+	srv.Advance(40 * time.Millisecond)
+	if again, err := q.Claim(); err != nil || len(again) != 0 {
+		t.Fatalf("q.Claim() touched jobs->%v, err->%v", again, err)
+	}
+	if err = jobs[0].Ack(); err != nil {
+		t.Fatalf("job.Ack() err->%v", err)
+	}
+	if err = q.Touch("poison", jobs[0].ClaimID); err != ErrJobNotFound {
+		t.Fatalf("q.Touch() acked err->%v", err)
+	}
+}
+
+func TestDelayQueueClaim(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	q := NewDelayQueue(client, NewModule("ooz-test"), "test_delay", &DelayQueueOptions{
+		Lease:        100 * time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	})
+	if _, err := q.ScheduleAfter("order_1", []byte("1"), 0); err != nil {
+		t.Fatalf("q.ScheduleAfter() err->%v", err)
+	}
+	stale, err := q.Claim()
+	if err != nil || len(stale) != 1 {
+		t.Fatalf("q.Claim() jobs->%v, err->%v", stale, err)
+	}
+	srv.Advance(120 * time.Millisecond)
+	jobs, err := q.Claim()
+	if err != nil || len(jobs) != 1 || jobs[0].ClaimID == stale[0].ClaimID {
+		t.Fatalf("q.Claim() again jobs->%v, err->%v", jobs, err)
+	}
+	// the handler whose lease expired no longer owns the job.
+	if err = stale[0].Touch(); err != ErrJobNotFound {
+		t.Fatalf("job.Touch() stale claim err->%v", err)
+	}
+	if err = stale[0].Ack(); err != ErrJobNotFound {
+		t.Fatalf("job.Ack() stale claim err->%v", err)
+	}
+	if _, err = stale[0].Nack(); err != ErrJobNotFound {
+		t.Fatalf("job.Nack() stale claim err->%v", err)
+	}
+	if err = jobs[0].Ack(); err != nil {
+		t.Fatalf("job.Ack() err->%v", err)
+	}
+	// Run claims only the jobs it has free handlers for.
+	for _, id := range []string{"order_2", "order_3", "order_4"} {
+		if _, err = q.ScheduleAfter(id, []byte("1"), 0); err != nil {
+			t.Fatalf("q.ScheduleAfter() err->%v", err)
+		}
+	}
+	var handled int
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	q.Run(ctx, 1, func(job *DelayedJob) error {
+		if _, claimed, _, err := q.Len(); err != nil || claimed != 1 {
+			t.Errorf("q.Len() claimed->%d, err->%v, want 1", claimed, err)
+		}
+		if handled++; handled == 3 {
+			cancel()
+		}
+		return nil
+	})
+	if handled != 3 {
+		t.Fatalf("handled jobs->%d, want 3", handled)
+	}
+}
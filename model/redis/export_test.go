@@ -0,0 +1,74 @@
+package redis
+
+import (
+	"context"
+	"time"
+)
+
+// the internals used by the tests of package redis_test.
+
+var (
+	CRC16         = crc16
+	KeyspaceFlags = keyspaceFlags
+	UnixMilli     = unixMilli
+)
+
+// Hooks returns the hooks of the client.
+func (c *Client) Hooks() []Hook {
+	return c.getHooks()
+}
+
+// Record records the result of a command.
+func (b *Breaker) Record(err error, elapsed time.Duration) {
+	b.record(err, elapsed)
+}
+
+// StateKey returns the state key of the job.
+func (s *CronScheduler) StateKey(job string) string {
+	return s.jobs[job].state
+}
+
+// DueTicks returns the ticks of the job to run at now.
+func (s *CronScheduler) DueTicks(job string, now time.Time) ([]time.Time, error) {
+	return s.dueTicks(s.jobs[job], now)
+}
+
+// RunDue runs the ticks of the job due at now.
+func (s *CronScheduler) RunDue(ctx context.Context, job string, now time.Time) {
+	s.runDue(ctx, s.jobs[job], now)
+}
+
+// Handle calls handler for the claimed job as Run.
+func (q *DelayQueue) Handle(job *DelayedJob, handler func(*DelayedJob) error) {
+	q.handle(job, handler)
+}
+
+// ClaimedKey returns the key of the claimed jobs.
+func (q *DelayQueue) ClaimedKey() string {
+	return q.claimed
+}
+
+// LeaseKey returns the lease key.
+func (l *LeaderElection) LeaseKey() string {
+	return l.lease
+}
+
+// HoldersKey returns the key of the holders.
+func (s *Semaphore) HoldersKey() string {
+	return s.key
+}
+
+// SessionKey returns the key of the session.
+func (s *SessionStore) SessionKey(sess *Session) string {
+	return s.sessionKey(sess.id)
+}
+
+// UserKey returns the key of the session index of the user.
+func (s *SessionStore) UserKey(userID string) string {
+	return s.userKey(userID)
+}
+
+// PendingClaim claims as Claim by XPENDING and XCLAIM.
+func (sc *StreamConsumer) PendingClaim() ([]*StreamMessage, error) {
+	return sc.pendingClaim()
+}
@@ -0,0 +1,357 @@
+package redis
+
+import (
+	"errors"
+	"math"
+)
+
+var (
+	// ErrGeoMemberNotFound returned when the center member of a search does not exist.
+	ErrGeoMemberNotFound = errors.New("redis: geo member not found")
+	// ErrGeoUnit returned when the unit is not one of the distance units.
+	ErrGeoUnit = errors.New("redis: unknown geo unit")
+	// ErrGeoArea returned when the query has neither a radius nor a box.
+	ErrGeoArea = errors.New("redis: geo query has no radius or box")
+)
+
+// GeoUnit distance unit.
+type GeoUnit string
+
+// Distance units.
+const (
+	GeoMeters     GeoUnit = "m"
+	GeoKilometers GeoUnit = "km"
+	GeoMiles      GeoUnit = "mi"
+	GeoFeet       GeoUnit = "ft"
+)
+
+// meters returns the meters of one unit, km if unit is empty, 0 if unknown.
+func (u GeoUnit) meters() float64 {
+	switch u {
+	case GeoMeters:
+		return 1
+	case GeoKilometers, "":
+		return 1000
+	case GeoMiles:
+		return 1609.34
+	case GeoFeet:
+		return 0.3048
+	default:
+		return 0
+	}
+}
+
+// String returns the unit argument of the geo commands, km if unit is empty.
+func (u GeoUnit) String() string {
+	if u == "" {
+		return string(GeoKilometers)
+	}
+	return string(u)
+}
+
+// GeoIndex geo index of members with metadata. The locations are a geo
+// sorted set and the metadata, encoded by the object codec, a hash, both in
+// the same hash slot so that they are updated together.
+type GeoIndex struct {
+	client *Client
+	name   string
+	key    string
+	meta   string
+}
+
+// GeoMember member of the geo index.
+type GeoMember struct {
+	Name      string
+	Longitude float64
+	Latitude  float64
+	// Metadata encoded by the object codec, nil to keep the current one.
+	Meta interface{}
+}
+
+// GeoQuery search query. The center is the member Member if set, otherwise
+// Longitude and Latitude. The members within Radius are returned, or within
+// the Width x Height box if Radius is 0.
+type GeoQuery struct {
+	Member    string
+	Longitude float64
+	Latitude  float64
+	Radius    float64
+	Width     float64
+	Height    float64
+	// Unit of Radius, Width, Height and the result distances.
+	// Default is km.
+	Unit GeoUnit
+	// Paging of the results sorted by distance, Limit 0 for all.
+	Offset int
+	Limit  int
+	// Farthest first.
+	Desc bool
+}
+
+// GeoResult member found by a search.
+type GeoResult struct {
+	Name      string
+	Longitude float64
+	Latitude  float64
+	// Distance to the center in the unit of the query.
+	Distance float64
+}
+
+// GeoHit search result with its typed value.
+type GeoHit[T any] struct {
+	GeoResult
+	Value T
+}
+
+// NewGeoIndex creates geo index named name under the module.
+func NewGeoIndex(c *Client, m *Module, name string) *GeoIndex {
+	return &GeoIndex{
+		client: c,
+		name:   name,
+		key:    hashTagKey(m, "geo:"+name, "locations"),
+		meta:   hashTagKey(m, "geo:"+name, "meta"),
+	}
+}
+
+// Add adds the members or updates their location and metadata.
+func (g *GeoIndex) Add(members ...*GeoMember) error {
+	if len(members) == 0 {
+		return nil
+	}
+	var (
+		locations = make([]*GeoLocation, len(members))
+		meta      = make(map[string]interface{})
+	)
+	for i, member := range members {
+		locations[i] = &GeoLocation{
+			Name:      member.Name,
+			Longitude: member.Longitude,
+			Latitude:  member.Latitude,
+		}
+		if member.Meta == nil {
+			continue
+		}
+		data, err := g.client.objCodec.Encode(member.Meta)
+		if err != nil {
+			return err
+		}
+		meta[member.Name] = data
+	}
+	_, err := g.client.TxPipelined(func(p Pipeliner) error {
+		p.GeoAdd(g.key, locations...)
+		if len(meta) > 0 {
+			p.HMSet(g.meta, meta)
+		}
+		return nil
+	})
+	return err
+}
+
+// Move updates the location of the member, keeping its metadata.
+func (g *GeoIndex) Move(name string, longitude, latitude float64) error {
+	return g.client.GeoAdd(g.key, &GeoLocation{
+		Name:      name,
+		Longitude: longitude,
+		Latitude:  latitude,
+	}).Err()
+}
+
+// Remove removes the members and their metadata.
+func (g *GeoIndex) Remove(names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(names))
+	for i, name := range names {
+		members[i] = name
+	}
+	_, err := g.client.TxPipelined(func(p Pipeliner) error {
+		p.ZRem(g.key, members...)
+		p.HDel(g.meta, names...)
+		return nil
+	})
+	return err
+}
+
+// Position returns the location of the member, ok is false if not exists.
+func (g *GeoIndex) Position(name string) (longitude, latitude float64, ok bool, err error) {
+	pos, err := g.client.GeoPos(g.key, name).Result()
+	if err != nil || len(pos) == 0 || pos[0] == nil {
+		return 0, 0, false, err
+	}
+	return pos[0].Longitude, pos[0].Latitude, true, nil
+}
+
+// Distance returns the distance between the members in unit, ok is false if
+// one does not exist.
+func (g *GeoIndex) Distance(name1, name2 string, unit GeoUnit) (dist float64, ok bool, err error) {
+	if unit.meters() == 0 {
+		return 0, false, ErrGeoUnit
+	}
+	dist, err = g.client.GeoDist(g.key, name1, name2, unit.String()).Result()
+	if IsRedisNil(err) {
+		return 0, false, nil
+	}
+	return dist, err == nil, err
+}
+
+// Count returns the number of members.
+func (g *GeoIndex) Count() (int64, error) {
+	return g.client.ZCard(g.key).Result()
+}
+
+// Search returns the members matching the query sorted by distance. The box
+// search runs GEORADIUS on the circle around the box and filters the box
+// like GEOSEARCH BYBOX, so that it works on redis before 6.2. Search returns
+// ErrGeoUnit for an unknown unit and ErrGeoArea without radius or box.
+func (g *GeoIndex) Search(q *GeoQuery) ([]GeoResult, error) {
+	if q.Unit.meters() == 0 {
+		return nil, ErrGeoUnit
+	}
+	if q.Radius <= 0 && (q.Width <= 0 || q.Height <= 0) {
+		return nil, ErrGeoArea
+	}
+	lon, lat := q.Longitude, q.Latitude
+	if q.Member != "" {
+		var (
+			ok  bool
+			err error
+		)
+		if lon, lat, ok, err = g.Position(q.Member); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, ErrGeoMemberNotFound
+		}
+	}
+	var (
+		box   = q.Radius <= 0
+		query = &GeoRadiusQuery{
+			Radius:    q.Radius,
+			Unit:      q.Unit.String(),
+			WithCoord: true,
+			WithDist:  true,
+			Sort:      "ASC",
+		}
+	)
+	if box {
+		// the box corners are a bit farther on the sphere.
+		query.Radius = math.Hypot(q.Width, q.Height) / 2 * 1.01
+	} else if q.Limit > 0 {
+		query.Count = q.Offset + q.Limit
+	}
+	if q.Desc {
+		query.Sort = "DESC"
+	}
+	locations, err := g.client.GeoRadiusRO(g.key, lon, lat, query).Result()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]GeoResult, 0, len(locations))
+	for _, l := range locations {
+		if box && !inGeoBox(lon, lat, l.Longitude, l.Latitude, q.Width*q.Unit.meters(), q.Height*q.Unit.meters()) {
+			continue
+		}
+		results = append(results, GeoResult{
+			Name:      l.Name,
+			Longitude: l.Longitude,
+			Latitude:  l.Latitude,
+			Distance:  l.Dist,
+		})
+	}
+	if q.Offset >= len(results) {
+		return nil, nil
+	}
+	results = results[q.Offset:]
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, nil
+}
+
+// GetGeoMeta returns the metadata of the member decoded as T, returns Nil if
+// the member has no metadata.
+func GetGeoMeta[T any](g *GeoIndex, name string) (T, error) {
+	var v T
+	data, err := g.client.HGet(g.meta, name).Bytes()
+	if err != nil {
+		return v, err
+	}
+	err = g.client.objCodec.Decode(data, &v)
+	return v, err
+}
+
+// GeoSearchMeta searches the index as GeoIndex.Search and decodes the
+// metadata of the results as T, the zero value if a member has none.
+func GeoSearchMeta[T any](g *GeoIndex, q *GeoQuery) ([]GeoHit[T], error) {
+	results, err := g.Search(q)
+	if err != nil || len(results) == 0 {
+		return nil, err
+	}
+	names := make([]string, len(results))
+	for i, r := range results {
+		names[i] = r.Name
+	}
+	vals, err := g.client.HMGet(g.meta, names...).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeGeoHits[T](g.client, results, vals, true)
+}
+
+// GeoJoin loads the objects stored by SetObject at key(name) of the
+// results, by MultiGet, and decodes them as T. The results whose object does
+// not exist are dropped.
+func GeoJoin[T any](c *Client, results []GeoResult, key func(name string) string) ([]GeoHit[T], error) {
+	if len(results) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(results))
+	for i, r := range results {
+		keys[i] = key(r.Name)
+	}
+	vals, err := c.MultiGet(keys...)
+	if err != nil {
+		return nil, err
+	}
+	return decodeGeoHits[T](c, results, vals, false)
+}
+
+// decodeGeoHits decodes the values of the results, the nil values are kept
+// as zero values or dropped.
+func decodeGeoHits[T any](c *Client, results []GeoResult, vals []interface{}, keepNil bool) ([]GeoHit[T], error) {
+	hits := make([]GeoHit[T], 0, len(results))
+	for i, r := range results {
+		hit := GeoHit[T]{GeoResult: r}
+		if s, ok := vals[i].(string); ok {
+			if err := c.objCodec.Decode([]byte(s), &hit.Value); err != nil {
+				return nil, err
+			}
+		} else if !keepNil {
+			continue
+		}
+		hits = append(hits, hit)
+	}
+	return hits, nil
+}
+
+// geoEarthRadius earth radius in meters used by redis.
+const geoEarthRadius = 6372797.560856
+
+// geoDistance returns the haversine distance in meters as redis.
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lat1r, lon1r := lat1*math.Pi/180, lon1*math.Pi/180
+	lat2r, lon2r := lat2*math.Pi/180, lon2*math.Pi/180
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((lon2r - lon1r) / 2)
+	return 2 * geoEarthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+// inGeoBox is the point within the width x height meters box centered on
+// the center? The horizontal distance is measured on the latitude of the
+// point, as GEOSEARCH BYBOX.
+func inGeoBox(centerLon, centerLat, lon, lat, width, height float64) bool {
+	if math.Abs(lat-centerLat)*math.Pi/180*geoEarthRadius > height/2 {
+		return false
+	}
+	return geoDistance(centerLon, lat, lon, lat) <= width/2
+}
@@ -0,0 +1,102 @@
+package redis_test
+
+import (
+	"math"
+	"testing"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+type testStore struct {
+	City string
+	Open bool
+}
+
+func TestGeoIndex(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	var (
+		m     = NewModule("ooz-test")
+		index = NewGeoIndex(client, m, "stores")
+	)
+	err := index.Add(
+		&GeoMember{Name: "palermo", Longitude: 13.361389, Latitude: 38.115556, Meta: testStore{City: "Palermo", Open: true}},
+		&GeoMember{Name: "catania", Longitude: 15.087269, Latitude: 37.502669, Meta: testStore{City: "Catania"}},
+		&GeoMember{Name: "agrigento", Longitude: 13.583333, Latitude: 37.316667},
+	)
+	if err != nil {
+		t.Fatalf("Add() err->%v", err)
+	}
+	if n, err := index.Count(); err != nil || n != 3 {
+		t.Fatalf("Count() v->%d, err->%v", n, err)
+	}
+	if d, ok, err := index.Distance("palermo", "catania", GeoKilometers); err != nil || !ok || math.Abs(d-166.2742) > 0.01 {
+		t.Fatalf("Distance() v->%v, ok->%v, err->%v", d, ok, err)
+	}
+	if _, ok, err := index.Distance("palermo", "rome", GeoKilometers); err != nil || ok {
+		t.Fatalf("Distance() missing ok->%v, err->%v", ok, err)
+	}
+	if _, _, err := index.Distance("palermo", "catania", "yd"); err != ErrGeoUnit {
+		t.Fatalf("Distance() unknown unit err->%v", err)
+	}
+	if _, err := index.Search(&GeoQuery{Longitude: 15, Latitude: 37, Radius: 200, Unit: "KM"}); err != ErrGeoUnit {
+		t.Fatalf("Search() unknown unit err->%v", err)
+	}
+	if _, err := index.Search(&GeoQuery{Longitude: 15, Latitude: 37, Width: 100}); err != ErrGeoArea {
+		t.Fatalf("Search() no area err->%v", err)
+	}
+
+	results, err := index.Search(&GeoQuery{Longitude: 15, Latitude: 37, Radius: 200, Unit: GeoKilometers})
+	if err != nil || len(results) != 3 || results[0].Name != "catania" || results[2].Name != "palermo" {
+		t.Fatalf("Search() radius v->%v, err->%v", results, err)
+	}
+	results, err = index.Search(&GeoQuery{Longitude: 15, Latitude: 37, Radius: 200000, Unit: GeoMeters, Offset: 1, Limit: 1})
+	if err != nil || len(results) != 1 || results[0].Name != "agrigento" || results[0].Distance < 100000 {
+		t.Fatalf("Search() page v->%v, err->%v", results, err)
+	}
+	results, err = index.Search(&GeoQuery{Member: "palermo", Radius: 200, Desc: true, Limit: 1})
+	if err != nil || len(results) != 1 || results[0].Name != "catania" {
+		t.Fatalf("Search() member v->%v, err->%v", results, err)
+	}
+	if _, err = index.Search(&GeoQuery{Member: "rome", Radius: 200}); err != ErrGeoMemberNotFound {
+		t.Fatalf("Search() missing member err->%v", err)
+	}
+	// catania is 82km east of the center, out of the 150km wide box.
+	results, err = index.Search(&GeoQuery{Longitude: 14.15, Latitude: 37.5, Width: 150, Height: 200})
+	if err != nil || len(results) != 2 || results[0].Name != "agrigento" || results[1].Name != "palermo" {
+		t.Fatalf("Search() box v->%v, err->%v", results, err)
+	}
+
+	hits, err := GeoSearchMeta[testStore](index, &GeoQuery{Longitude: 15, Latitude: 37, Radius: 200})
+	if err != nil || len(hits) != 3 || hits[0].Value.City != "Catania" || hits[1].Value.City != "" || !hits[2].Value.Open {
+		t.Fatalf("GeoSearchMeta() v->%v, err->%v", hits, err)
+	}
+	if err = index.Move("catania", 13.4, 38.1); err != nil {
+		t.Fatalf("Move() err->%v", err)
+	}
+	if s, err := GetGeoMeta[testStore](index, "catania"); err != nil || s.City != "Catania" {
+		t.Fatalf("GetGeoMeta() v->%v, err->%v", s, err)
+	}
+
+	// join the results to the stored objects, the missing ones are dropped.
+	key := func(name string) string { return m.GetKey("store:" + name) }
+	if err = client.SetObject(key("palermo"), testStore{City: "Palermo", Open: true}, 0); err != nil {
+		t.Fatalf("SetObject() err->%v", err)
+	}
+	defer client.Del(key("palermo"))
+	results, _ = index.Search(&GeoQuery{Member: "palermo", Radius: 10})
+	joined, err := GeoJoin[testStore](client, results, key)
+	if err != nil || len(results) != 2 || len(joined) != 1 || joined[0].Name != "palermo" || !joined[0].Value.Open {
+		t.Fatalf("GeoJoin() results->%v, v->%v, err->%v", results, joined, err)
+	}
+
+	if err = index.Remove("catania", "agrigento"); err != nil {
+		t.Fatalf("Remove() err->%v", err)
+	}
+	if _, _, ok, err := index.Position("catania"); err != nil || ok {
+		t.Fatalf("Position() removed ok->%v, err->%v", ok, err)
+	}
+	if _, err = GetGeoMeta[testStore](index, "catania"); !IsRedisNil(err) {
+		t.Fatalf("GetGeoMeta() removed err->%v", err)
+	}
+}
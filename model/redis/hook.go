@@ -0,0 +1,295 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// Hook is called before and after every command and pipeline sent by Client.
+type Hook interface {
+	// BeforeProcess is called before the command is sent.
+	BeforeProcess(cmd Cmder)
+	// AfterProcess is called after the reply is read, cmd.Err() holds the result.
+	AfterProcess(cmd Cmder, elapsed time.Duration)
+	// BeforeProcessPipeline is called before the pipeline(or transaction) is sent.
+	BeforeProcessPipeline(cmds []Cmder)
+	// AfterProcessPipeline is called after all replies of the pipeline are read.
+	AfterProcessPipeline(cmds []Cmder, elapsed time.Duration)
+}
+
+// processWrapper redis client and cluster client process wrapper.
+type processWrapper interface {
+	WrapProcess(fn func(oldProcess func(cmd redis.Cmder) error) func(cmd redis.Cmder) error)
+	WrapProcessPipeline(fn func(oldProcess func([]redis.Cmder) error) func([]redis.Cmder) error)
+}
+
+// AddHook appends hooks, they are called in the order they were added.
+func (c *Client) AddHook(hooks ...Hook) {
+	if c.parent != nil {
+		c.parent.AddHook(hooks...)
+		return
+	}
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	// copy on write, the process funcs iterate without lock.
+	newHooks := make([]Hook, 0, len(c.hooks)+len(hooks))
+	newHooks = append(newHooks, c.hooks...)
+	c.hooks = append(newHooks, hooks...)
+}
+
+// RemoveHook removes the hooks added by AddHook, compared with ==.
+func (c *Client) RemoveHook(hooks ...Hook) {
+	if c.parent != nil {
+		c.parent.RemoveHook(hooks...)
+		return
+	}
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	newHooks := make([]Hook, 0, len(c.hooks))
+next:
+	for _, h := range c.hooks {
+		for _, removed := range hooks {
+			if h == removed {
+				continue next
+			}
+		}
+		newHooks = append(newHooks, h)
+	}
+	c.hooks = newHooks
+}
+
+// getHooks returns the current hooks.
+func (c *Client) getHooks() []Hook {
+	if c.parent != nil {
+		return c.parent.getHooks()
+	}
+	c.hooksMu.RLock()
+	defer c.hooksMu.RUnlock()
+	return c.hooks
+}
+
+// wrapProcess install the hooks into the redis client process.
+func (c *Client) wrapProcess(w processWrapper) {
+	w.WrapProcess(func(oldProcess func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			hooks := c.getHooks()
+			if len(hooks) == 0 {
+				return oldProcess(cmd)
+			}
+			for _, h := range hooks {
+				h.BeforeProcess(cmd)
+			}
+			start := time.Now()
+			err := oldProcess(cmd)
+			elapsed := time.Since(start)
+			for _, h := range hooks {
+				h.AfterProcess(cmd, elapsed)
+			}
+			return err
+		}
+	})
+	w.WrapProcessPipeline(func(oldProcess func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			hooks := c.getHooks()
+			if len(hooks) == 0 {
+				return oldProcess(cmds)
+			}
+			for _, h := range hooks {
+				h.BeforeProcessPipeline(cmds)
+			}
+			start := time.Now()
+			err := oldProcess(cmds)
+			elapsed := time.Since(start)
+			for _, h := range hooks {
+				h.AfterProcessPipeline(cmds, elapsed)
+			}
+			return err
+		}
+	})
+}
+
+// addConfigHooks add the hooks enabled by Config.Hooks.
+func (c *Client) addConfigHooks() error {
+	cfg := c.cfg.Hooks
+	if cfg.Metrics {
+		h, err := NewMetricsHook(cfg.MetricsNamespace)
+		if err != nil {
+			return err
+		}
+		c.AddHook(h)
+	}
+	if cfg.SlowThreshold > 0 {
+		c.AddHook(NewSlowLogHook(time.Duration(cfg.SlowThreshold) * time.Millisecond))
+	}
+	return nil
+}
+
+// CmdKey returns the first key of the command, or "" if the command has no key.
+func CmdKey(cmd Cmder) string {
+	args := cmd.Args()
+	switch cmd.Name() {
+	case "eval", "evalsha":
+		// eval script numkeys key [key ...]
+		if len(args) > 3 {
+			if n, _ := strconv.Atoi(argString(args[2])); n > 0 {
+				return argString(args[3])
+			}
+		}
+		return ""
+	case "ping", "echo", "info", "time", "dbsize", "flushdb", "flushall", "publish", "script",
+		"config", "client", "cluster", "command", "scan", "select", "quit", "multi", "exec":
+		return ""
+	}
+	if len(args) > 1 {
+		return argString(args[1])
+	}
+	return ""
+}
+
+// KeyPrefix returns the prefix of the key up to and including the last ':',
+// .e.g. "ooz:ooztest:" for key "ooz:ooztest:id[1]".
+func KeyPrefix(key string) string {
+	if i := strings.LastIndexByte(key, ':'); i >= 0 {
+		return key[:i+1]
+	}
+	return key
+}
+
+// argString
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// isCmdErr is the command failed? redis nil reply is not a failure.
+func isCmdErr(cmd Cmder) bool {
+	err := cmd.Err()
+	return err != nil && !IsRedisNil(err)
+}
+
+// SlowLogHook logs the commands slower than threshold.
+type SlowLogHook struct {
+	threshold time.Duration
+}
+
+var _ Hook = (*SlowLogHook)(nil)
+
+// NewSlowLogHook creates slow log hook.
+func NewSlowLogHook(threshold time.Duration) *SlowLogHook {
+	return &SlowLogHook{
+		threshold: threshold,
+	}
+}
+
+// BeforeProcess
+func (h *SlowLogHook) BeforeProcess(cmd Cmder) {}
+
+// AfterProcess
+func (h *SlowLogHook) AfterProcess(cmd Cmder, elapsed time.Duration) {
+	if elapsed < h.threshold {
+		return
+	}
+	ozlog.Warnf("redis slow command: %s, key prefix: %s, elapsed: %s", cmd.Name(), KeyPrefix(CmdKey(cmd)), elapsed)
+}
+
+// BeforeProcessPipeline
+func (h *SlowLogHook) BeforeProcessPipeline(cmds []Cmder) {}
+
+// AfterProcessPipeline
+func (h *SlowLogHook) AfterProcessPipeline(cmds []Cmder, elapsed time.Duration) {
+	if elapsed < h.threshold {
+		return
+	}
+	var (
+		names    = make([]string, 0, len(cmds))
+		prefixes = make([]string, 0, len(cmds))
+	)
+	for _, cmd := range cmds {
+		names = append(names, cmd.Name())
+		prefixes = append(prefixes, KeyPrefix(CmdKey(cmd)))
+	}
+	ozlog.Warnf("redis slow pipeline: [%s], key prefixes: [%s], elapsed: %s",
+		strings.Join(names, " "), strings.Join(prefixes, " "), elapsed)
+}
+
+// MetricsHook records per-command latency histograms and error counts in prometheus.
+type MetricsHook struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+var _ Hook = (*MetricsHook)(nil)
+
+// pipelineCmdName the command label of the pipelines.
+const pipelineCmdName = "pipeline"
+
+// NewMetricsHook creates metrics hook and registers the collectors into
+// prometheus.DefaultRegisterer. Hooks with the same namespace share the collectors.
+func NewMetricsHook(namespace string) (*MetricsHook, error) {
+	if namespace == "" {
+		namespace = "redis"
+	}
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "command_duration_seconds",
+		Help:      "Latency of redis commands, pipelines are labeled as command=\"pipeline\".",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"})
+	errCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "command_errors_total",
+		Help:      "Number of failed redis commands, redis nil replies are not counted.",
+	}, []string{"command"})
+	if err := prometheus.Register(duration); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		duration = are.ExistingCollector.(*prometheus.HistogramVec)
+	}
+	if err := prometheus.Register(errCounter); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		errCounter = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+	return &MetricsHook{
+		duration: duration,
+		errors:   errCounter,
+	}, nil
+}
+
+// BeforeProcess
+func (h *MetricsHook) BeforeProcess(cmd Cmder) {}
+
+// AfterProcess
+func (h *MetricsHook) AfterProcess(cmd Cmder, elapsed time.Duration) {
+	h.duration.WithLabelValues(cmd.Name()).Observe(elapsed.Seconds())
+	if isCmdErr(cmd) {
+		h.errors.WithLabelValues(cmd.Name()).Inc()
+	}
+}
+
+// BeforeProcessPipeline
+func (h *MetricsHook) BeforeProcessPipeline(cmds []Cmder) {}
+
+// AfterProcessPipeline
+func (h *MetricsHook) AfterProcessPipeline(cmds []Cmder, elapsed time.Duration) {
+	h.duration.WithLabelValues(pipelineCmdName).Observe(elapsed.Seconds())
+	for _, cmd := range cmds {
+		if isCmdErr(cmd) {
+			h.errors.WithLabelValues(cmd.Name()).Inc()
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package redis_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+type countHook struct {
+	cmds, pipelines int32
+}
+
+func (h *countHook) BeforeProcess(cmd Cmder) {}
+
+func (h *countHook) AfterProcess(cmd Cmder, elapsed time.Duration) {
+	atomic.AddInt32(&h.cmds, 1)
+}
+
+func (h *countHook) BeforeProcessPipeline(cmds []Cmder) {}
+
+func (h *countHook) AfterProcessPipeline(cmds []Cmder, elapsed time.Duration) {
+	atomic.AddInt32(&h.pipelines, 1)
+}
+
+func TestHook(t *testing.T) {
+	client, _ := redistest.NewClient(t, &Config{
+		Hooks: HooksConfig{
+			Metrics:       true,
+			SlowThreshold: 100,
+		},
+	})
+	h := new(countHook)
+	client.AddHook(h)
+	m := NewModule("ooz-test")
+	if err := client.Set(m.GetKey("hook_key"), "hook_value", time.Second).Err(); err != nil {
+		t.Fatalf("c.Set() err-> %v", err)
+	}
+	_, err := client.Pipelined(func(p Pipeliner) error {
+		p.Get(m.GetKey("hook_key"))
+		p.Del(m.GetKey("hook_key"))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("c.Pipelined() err-> %v", err)
+	}
+	if h.cmds != 1 || h.pipelines != 1 {
+		t.Fatalf("hook calls: cmds=%d, pipelines=%d", h.cmds, h.pipelines)
+	}
+	client.RemoveHook(h)
+	client.Get(m.GetKey("hook_key"))
+	if h.cmds != 1 {
+		t.Fatalf("removed hook calls: cmds=%d", h.cmds)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	for key, prefix := range map[string]string{
+		"ooz:ooztest:id[1]": "ooz:ooztest:",
+		"ooz-test:ooz_key":  "ooz-test:",
+		"nokey":             "nokey",
+	} {
+		if p := KeyPrefix(key); p != prefix {
+			t.Errorf("KeyPrefix(%q)=%q, want %q", key, p, prefix)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// Idempotency idempotency-key store, executes a request at most once per key
+// and returns the stored response to the duplicate requests.
+// A record is a hash {state, owner, response}, the in-progress record expires
+// after LockTTL so that the request can be retried if its executor crashed,
+// the completed record expires after TTL.
+type Idempotency struct {
+	client *Client
+	opts   IdempotencyOptions
+	module *Module
+	name   string
+}
+
+// IdempotencyOptions idempotency store options.
+type IdempotencyOptions struct {
+	// Retention of the completed records.
+	// Default is 24 hours.
+	TTL time.Duration
+	// Lease of the in-progress records, it is extended while the request is
+	// executing by Do.
+	// Default is 30 seconds.
+	LockTTL time.Duration
+	// Maximum time a duplicate request waits for the in-progress one to
+	// complete, ErrIdempotencyInProgress is returned after it, 0 not wait.
+	// Default is 0.
+	Wait time.Duration
+	// Frequency of polling the in-progress record while waiting.
+	// Default is 50 milliseconds.
+	PollInterval time.Duration
+}
+
+// init sets the default options.
+func (o *IdempotencyOptions) init() {
+	if o.TTL <= 0 {
+		o.TTL = 24 * time.Hour
+	}
+	if o.LockTTL <= 0 {
+		o.LockTTL = 30 * time.Second
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = 50 * time.Millisecond
+	}
+}
+
+// idempotency record states.
+const (
+	idempotencyNew     = "new"
+	idempotencyPending = "pending"
+	idempotencyDone    = "done"
+)
+
+var (
+	// ErrIdempotencyInProgress a request with the same key is executing.
+	ErrIdempotencyInProgress = errors.New("redis: idempotent request is in progress")
+	// ErrIdempotencyLockLost the in-progress record expired or was taken over
+	// before the request completed.
+	ErrIdempotencyLockLost = errors.New("redis: idempotency key lock lost")
+)
+
+// IdempotencyCompleteError the request was executed but its response could
+// not be stored, a retry with the same key executes it again. Do returns it
+// with the response.
+type IdempotencyCompleteError struct {
+	// Err error of Complete.
+	Err error
+}
+
+// Error implements error.
+func (e *IdempotencyCompleteError) Error() string {
+	return "redis: idempotent response not stored: " + e.Err.Error()
+}
+
+var (
+	// KEYS: record; ARGV: owner, lock ttl
+	idempotencyBeginScript = newLibScript("idempotency.begin", `
+local state = redis.call('HGET', KEYS[1], 'state')
+if not state then
+	redis.call('HSET', KEYS[1], 'state', 'pending', 'owner', ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return {'new', ''}
+end
+if state == 'done' then
+	return {'done', redis.call('HGET', KEYS[1], 'response')}
+end
+return {'pending', ''}`)
+	// KEYS: record; ARGV: owner, ttl, response
+	idempotencyCompleteScript = newLibScript("idempotency.complete", `
+if redis.call('HGET', KEYS[1], 'state') ~= 'pending' or redis.call('HGET', KEYS[1], 'owner') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'state', 'done', 'response', ARGV[3])
+redis.call('HDEL', KEYS[1], 'owner')
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1`)
+	// KEYS: record; ARGV: owner, lock ttl
+	idempotencyTouchScript = newLibScript("idempotency.touch", `
+if redis.call('HGET', KEYS[1], 'state') ~= 'pending' or redis.call('HGET', KEYS[1], 'owner') ~= ARGV[1] then
+	return 0
+end
+return redis.call('PEXPIRE', KEYS[1], ARGV[2])`)
+	// KEYS: record; ARGV: owner
+	idempotencyReleaseScript = newLibScript("idempotency.release", `
+if redis.call('HGET', KEYS[1], 'state') ~= 'pending' or redis.call('HGET', KEYS[1], 'owner') ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])`)
+)
+
+// NewIdempotency creates idempotency store named name under the module.
+func NewIdempotency(c *Client, m *Module, name string, opts *IdempotencyOptions) *Idempotency {
+	var o IdempotencyOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	registerLibScripts(c, m, idempotencyBeginScript, idempotencyCompleteScript, idempotencyTouchScript, idempotencyReleaseScript)
+	return &Idempotency{
+		client: c,
+		opts:   o,
+		module: m,
+		name:   name,
+	}
+}
+
+// recordKey returns the redis key of the idempotency key.
+func (s *Idempotency) recordKey(key string) string {
+	return s.module.GetKey("idem:" + s.name + ":" + key)
+}
+
+// Begin tries to start the request of the key. If started is true, the caller
+// must execute the request and then call Complete or Release with the owner.
+// Otherwise response is the stored response if the request was completed,
+// or ErrIdempotencyInProgress is returned.
+func (s *Idempotency) Begin(key string) (owner string, started bool, response []byte, err error) {
+	owner = randomID()
+	r, err := idempotencyBeginScript.Run(s.client, []string{s.recordKey(key)},
+		owner, int64(s.opts.LockTTL/time.Millisecond)).Result()
+	if err != nil {
+		return "", false, nil, err
+	}
+	vals, ok := r.([]interface{})
+	if !ok || len(vals) != 2 {
+		return "", false, nil, fmt.Errorf("redis: unexpected idempotency begin reply->%v", r)
+	}
+	state, _ := vals[0].(string)
+	switch state {
+	case idempotencyNew:
+		return owner, true, nil, nil
+	case idempotencyDone:
+		resp, _ := vals[1].(string)
+		return "", false, []byte(resp), nil
+	default:
+		return "", false, nil, ErrIdempotencyInProgress
+	}
+}
+
+// Complete stores the response of the started request, returns
+// ErrIdempotencyLockLost if the in-progress record has expired.
+func (s *Idempotency) Complete(key, owner string, response []byte) error {
+	n, err := idempotencyCompleteScript.Run(s.client, []string{s.recordKey(key)},
+		owner, int64(s.opts.TTL/time.Millisecond), response).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrIdempotencyLockLost
+	}
+	return nil
+}
+
+// Touch extends the lease of the started request.
+func (s *Idempotency) Touch(key, owner string) error {
+	n, err := idempotencyTouchScript.Run(s.client, []string{s.recordKey(key)},
+		owner, int64(s.opts.LockTTL/time.Millisecond)).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrIdempotencyLockLost
+	}
+	return nil
+}
+
+// Release deletes the in-progress record of the failed request, so that it
+// can be retried with the same key.
+func (s *Idempotency) Release(key, owner string) error {
+	return idempotencyReleaseScript.Run(s.client, []string{s.recordKey(key)}, owner).Err()
+}
+
+// Forget deletes the record of the key whatever its state.
+func (s *Idempotency) Forget(key string) error {
+	return s.client.Del(s.recordKey(key)).Err()
+}
+
+// Do executes fn at most once per key and stores its response. A duplicate
+// request gets the stored response with replayed true, it waits up to Wait
+// for the in-progress request and then returns ErrIdempotencyInProgress.
+// If fn returns an error (or panics), the record is released and the error
+// is returned, so the request can be retried. If the response of fn cannot be
+// stored, it is returned with an *IdempotencyCompleteError.
+func (s *Idempotency) Do(ctx context.Context, key string, fn func() ([]byte, error)) (response []byte, replayed bool, err error) {
+	deadline := time.Now().Add(s.opts.Wait)
+	for {
+		owner, started, resp, err := s.Begin(key)
+		if err == nil && !started {
+			return resp, true, nil
+		}
+		if err == nil {
+			resp, err = s.execute(key, owner, fn)
+			return resp, false, err
+		}
+		if err != ErrIdempotencyInProgress || !time.Now().Before(deadline) {
+			return nil, false, err
+		}
+		sleepContext(ctx, s.opts.PollInterval)
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// execute calls fn while extending the lease, then completes or releases the record.
+func (s *Idempotency) execute(key, owner string, fn func() ([]byte, error)) (response []byte, err error) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.opts.LockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.Touch(key, owner); err != nil {
+					ozlog.Errorf("Idempotency(%s).Touch(%s): %s", s.name, key, err.Error())
+				}
+			}
+		}
+	}()
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ozlog.Errorf("Idempotency(%s) request %s panic: %v\n%s", s.name, key, r, debug.Stack())
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		response, err = fn()
+	}()
+	close(done)
+	if err != nil {
+		if rerr := s.Release(key, owner); rerr != nil {
+			ozlog.Errorf("Idempotency(%s).Release(%s): %s", s.name, key, rerr.Error())
+		}
+		return nil, err
+	}
+	// the request is done, retry storing its response on redis errors.
+	for i := 0; i < 3; i++ {
+		if err = s.Complete(key, owner, response); err == nil || err == ErrIdempotencyLockLost {
+			break
+		}
+		ozlog.Errorf("Idempotency(%s).Complete(%s): %s", s.name, key, err.Error())
+		time.Sleep(s.opts.PollInterval)
+	}
+	if err != nil {
+		return response, &IdempotencyCompleteError{Err: err}
+	}
+	return response, nil
+}
@@ -0,0 +1,99 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestIdempotency(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	s := NewIdempotency(client, NewModule("ooz-test"), "test_idem", &IdempotencyOptions{
+		TTL:     time.Minute,
+		LockTTL: time.Second,
+		Wait:    time.Second,
+	})
+	var (
+		ctx      = context.Background()
+		calls    int32
+		replayed int32
+		wg       sync.WaitGroup
+	)
+	// concurrent duplicates, executed once and all get the same response.
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, r, err := s.Do(ctx, "pay_1", func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(50 * time.Millisecond)
+				return []byte("paid"), nil
+			})
+			if err != nil || string(resp) != "paid" {
+				t.Errorf("s.Do() resp->%s, err->%v", resp, err)
+			}
+			if r {
+				atomic.AddInt32(&replayed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 || replayed != 9 {
+		t.Fatalf("calls->%d, replayed->%d", calls, replayed)
+	}
+	// failed request is released and can be retried.
+	errFailed := errors.New("failed")
+	if _, _, err := s.Do(ctx, "pay_2", func() ([]byte, error) {
+		return nil, errFailed
+	}); err != errFailed {
+		t.Fatalf("s.Do() err->%v, want %v", err, errFailed)
+	}
+	if resp, r, err := s.Do(ctx, "pay_2", func() ([]byte, error) {
+		return []byte("ok"), nil
+	}); err != nil || r || string(resp) != "ok" {
+		t.Fatalf("s.Do() retry resp->%s, replayed->%v, err->%v", resp, r, err)
+	}
+	// in-progress without waiting.
+	owner, started, _, err := s.Begin("pay_3")
+	if err != nil || !started {
+		t.Fatalf("s.Begin() started->%v, err->%v", started, err)
+	}
+	if _, _, _, err = s.Begin("pay_3"); err != ErrIdempotencyInProgress {
+		t.Fatalf("s.Begin() duplicate err->%v", err)
+	}
+	if err = s.Complete("pay_3", "other", nil); err != ErrIdempotencyLockLost {
+		t.Fatalf("s.Complete() other owner err->%v", err)
+	}
+	if err = s.Complete("pay_3", owner, []byte("3")); err != nil {
+		t.Fatalf("s.Complete() err->%v", err)
+	}
+	if _, started, resp, err := s.Begin("pay_3"); err != nil || started || string(resp) != "3" {
+		t.Fatalf("s.Begin() completed started->%v, resp->%s, err->%v", started, resp, err)
+	}
+	// the response of an executed request is returned if it cannot be stored.
+	resp, _, err := s.Do(ctx, "pay_4", func() ([]byte, error) {
+		s.Forget("pay_4")
+		return []byte("4"), nil
+	})
+	if cerr, ok := err.(*IdempotencyCompleteError); !ok || cerr.Err != ErrIdempotencyLockLost || string(resp) != "4" {
+		t.Fatalf("s.Do() lock lost resp->%s, err->%v", resp, err)
+	}
+	// a panic is released as an error.
+	if _, _, err = s.Do(ctx, "pay_5", func() ([]byte, error) {
+		panic("boom")
+	}); err == nil || err.Error() != "panic: boom" {
+		t.Fatalf("s.Do() panic err->%v", err)
+	}
+	if _, started, _, err := s.Begin("pay_5"); err != nil || !started {
+		t.Fatalf("s.Begin() after panic started->%v, err->%v", started, err)
+	}
+	for _, key := range []string{"pay_1", "pay_2", "pay_3", "pay_4", "pay_5"} {
+		s.Forget(key)
+	}
+}
@@ -0,0 +1,8 @@
+// Package testhook seams of package redis used by redistest, they are not
+// part of the public API.
+package testhook
+
+import "time"
+
+// SetClock sets the clock of a *redis.Client, it is set by package redis.
+var SetClock func(client interface{}, now func() time.Time)
@@ -0,0 +1,259 @@
+package redis
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// keyspace events, .e.g. KeyspaceOptions.Events
+const (
+	EventDel     = "del"
+	EventExpire  = "expire"
+	EventExpired = "expired"
+	EventEvicted = "evicted"
+	EventRename  = "rename_to"
+	EventSet     = "set"
+	EventHSet    = "hset"
+	EventHDel    = "hdel"
+	EventLPush   = "lpush"
+	EventRPush   = "rpush"
+	EventSAdd    = "sadd"
+	EventZAdd    = "zadd"
+	EventXAdd    = "xadd"
+)
+
+// keyspaceEventClass notify-keyspace-events class of the events.
+var keyspaceEventClass = map[string]byte{
+	EventDel: 'g', EventExpire: 'g', "rename_from": 'g', EventRename: 'g', "persist": 'g',
+	EventExpired: 'x', EventEvicted: 'e',
+	EventSet: '$', "setrange": '$', "incrby": '$', "incrbyfloat": '$', "append": '$',
+	EventHSet: 'h', EventHDel: 'h', "hincrby": 'h', "hincrbyfloat": 'h',
+	EventLPush: 'l', EventRPush: 'l', "lpop": 'l', "rpop": 'l', "lset": 'l', "ltrim": 'l', "linsert": 'l', "lrem": 'l',
+	EventSAdd: 's', "srem": 's', "spop": 's', "smove": 's',
+	EventZAdd: 'z', "zrem": 'z', "zincr": 'z', "zremrangebyscore": 'z', "zremrangebyrank": 'z',
+	EventXAdd: 't', "xtrim": 't', "xdel": 't',
+}
+
+// KeyspaceEvent keyspace notification.
+type KeyspaceEvent struct {
+	// Key the key, with the module prefix.
+	Key string
+	// Event the event name, .e.g. EventExpired.
+	Event string
+	// Node address of the node the event happened on.
+	Node string
+}
+
+// KeyspaceOptions keyspace listener options.
+type KeyspaceOptions struct {
+	// Events to listen.
+	// Default is [expired, del].
+	Events []string
+	// Only the keys under one of the modules are delivered, any key if empty.
+	Modules []*Module
+	// Configure sets notify-keyspace-events on every master by Run, keeping
+	// the enabled classes. Leave it false if CONFIG is not allowed, .e.g.
+	// managed redis, and enable the notifications on the server.
+	Configure bool
+	// Frequency of checking the masters for changes in cluster mode.
+	// Default is 1 minute.
+	RefreshInterval time.Duration
+}
+
+// init sets the default options.
+func (o *KeyspaceOptions) init() {
+	if len(o.Events) == 0 {
+		o.Events = []string{EventExpired, EventDel}
+	}
+	if o.RefreshInterval <= 0 {
+		o.RefreshInterval = time.Minute
+	}
+}
+
+// KeyspaceListener subscribes to the keyspace notifications of the keys under
+// the modules on every master, by one pattern per module so that the server
+// filters the keys, and delivers the events.
+type KeyspaceListener struct {
+	client  *Client
+	opts    KeyspaceOptions
+	handler func(*KeyspaceEvent)
+	events  map[string]bool
+}
+
+// NewKeyspaceListener creates keyspace listener, handler is called
+// concurrently.
+func NewKeyspaceListener(c *Client, opts *KeyspaceOptions, handler func(*KeyspaceEvent)) *KeyspaceListener {
+	var o KeyspaceOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	events := make(map[string]bool, len(o.Events))
+	for _, event := range o.Events {
+		events[event] = true
+	}
+	return &KeyspaceListener{
+		client:  c,
+		opts:    o,
+		handler: handler,
+		events:  events,
+	}
+}
+
+// Configure adds the classes of the events to notify-keyspace-events on every master.
+func (k *KeyspaceListener) Configure() error {
+	return k.client.ForEachMaster(func(node Cmdable) error {
+		cfg, err := node.ConfigGet("notify-keyspace-events").Result()
+		if err != nil {
+			return err
+		}
+		var flags string
+		if len(cfg) == 2 {
+			flags, _ = cfg[1].(string)
+		}
+		newFlags := keyspaceFlags(flags, k.opts.Events)
+		if newFlags == flags {
+			return nil
+		}
+		return node.ConfigSet("notify-keyspace-events", newFlags).Err()
+	})
+}
+
+// keyspaceFlags returns flags with the keyspace class and the classes of the events added.
+func keyspaceFlags(flags string, events []string) string {
+	need := []byte{'K'}
+	for _, event := range events {
+		if class, ok := keyspaceEventClass[event]; ok {
+			need = append(need, class)
+		}
+	}
+	for _, f := range need {
+		// A is an alias for "g$lshzxe".
+		if strings.IndexByte(flags, f) >= 0 || f != 'K' && f != 't' && strings.IndexByte(flags, 'A') >= 0 {
+			continue
+		}
+		flags += string(f)
+	}
+	return flags
+}
+
+// Run listens until ctx is done. In cluster mode every master is subscribed
+// and the masters are checked for changes every RefreshInterval.
+func (k *KeyspaceListener) Run(ctx context.Context) error {
+	if k.opts.Configure {
+		if err := k.Configure(); err != nil {
+			return err
+		}
+	}
+	if !k.client.IsCluster() {
+		return k.subscribe(ctx, k.client, k.client.GetConfig().ForSingle.Addr)
+	}
+	ticker := time.NewTicker(k.opts.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		nodes, err := k.masters()
+		if err != nil {
+			return err
+		}
+		var (
+			nodesCtx, cancel = context.WithCancel(ctx)
+			wg               sync.WaitGroup
+		)
+		for _, node := range nodes {
+			wg.Add(1)
+			go func(node *redis.Client) {
+				defer wg.Done()
+				k.subscribe(nodesCtx, &Client{cfg: k.client.cfg, Cmdable: node}, node.Options().Addr)
+			}(node)
+		}
+		for changed := false; !changed; {
+			select {
+			case <-ctx.Done():
+				cancel()
+				wg.Wait()
+				return nil
+			case <-ticker.C:
+				if newNodes, err := k.masters(); err == nil && !sameNodes(nodes, newNodes) {
+					changed = true
+				}
+			}
+		}
+		cancel()
+		wg.Wait()
+		if k.opts.Configure {
+			if err := k.Configure(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// masters returns the master nodes sorted by address.
+func (k *KeyspaceListener) masters() ([]*redis.Client, error) {
+	var (
+		mu    sync.Mutex
+		nodes []*redis.Client
+	)
+	err := k.client.ForEachMaster(func(node Cmdable) error {
+		mu.Lock()
+		nodes = append(nodes, node.(*redis.Client))
+		mu.Unlock()
+		return nil
+	})
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Options().Addr < nodes[j].Options().Addr
+	})
+	return nodes, err
+}
+
+// sameNodes are the addresses the same?
+func sameNodes(a, b []*redis.Client) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Options().Addr != b[i].Options().Addr {
+			return false
+		}
+	}
+	return true
+}
+
+// keyspaceChannel prefix of the keyspace notification channels of db 0.
+const keyspaceChannel = "__keyspace@0__:"
+
+// patterns returns the channel patterns of the modules.
+func (k *KeyspaceListener) patterns() []string {
+	if len(k.opts.Modules) == 0 {
+		return []string{keyspaceChannel + "*"}
+	}
+	patterns := make([]string, len(k.opts.Modules))
+	for i, m := range k.opts.Modules {
+		patterns[i] = keyspaceChannel + globEscape(m.GetPrefix()) + "*"
+	}
+	return patterns
+}
+
+// subscribe listens the events of a node until ctx is done.
+func (k *KeyspaceListener) subscribe(ctx context.Context, node *Client, addr string) error {
+	s := NewSubscriber(node, nil)
+	for _, pattern := range k.patterns() {
+		s.HandlePattern(pattern, func(msg *Message) {
+			// the other events of the enabled classes.
+			if !k.events[msg.Payload] {
+				return
+			}
+			k.handler(&KeyspaceEvent{
+				Key:   strings.TrimPrefix(msg.Channel, keyspaceChannel),
+				Event: msg.Payload,
+				Node:  addr,
+			})
+		})
+	}
+	return s.Run(ctx)
+}
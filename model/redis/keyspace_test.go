@@ -0,0 +1,78 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestKeyspaceFlags(t *testing.T) {
+	for _, c := range []struct {
+		flags  string
+		events []string
+		want   string
+	}{
+		{"", []string{EventExpired, EventDel}, "Kxg"},
+		{"Ex", []string{EventExpired}, "ExK"},
+		{"AK", []string{EventExpired, EventSet}, "AK"},
+		{"AE", []string{EventXAdd}, "AEKt"},
+	} {
+		if flags := KeyspaceFlags(c.flags, c.events); flags != c.want {
+			t.Fatalf("keyspaceFlags(%q, %v)->%q, want %q", c.flags, c.events, flags, c.want)
+		}
+	}
+}
+
+func TestKeyspaceListener(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	var (
+		m      = NewModule("ooz-test")
+		events = make(chan *KeyspaceEvent, 4)
+		l      = NewKeyspaceListener(client, &KeyspaceOptions{
+			Modules: []*Module{m},
+		}, func(e *KeyspaceEvent) {
+			events <- e
+		})
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+	// publish the notifications directly, the test server may not emit them.
+	client.Publish("__keyspace@0__:other:session:1", "expired")
+	client.Publish("__keyspace@0__:"+m.GetKey("session:1"), "expired")
+	client.Publish("__keyspace@0__:"+m.GetKey("session:2"), "set")
+	client.Publish("__keyspace@0__:"+m.GetKey("session:3"), "del")
+	// the handlers are concurrent, the events are not in order.
+	want := map[string]string{
+		m.GetKey("session:1"): EventExpired,
+		m.GetKey("session:3"): EventDel,
+	}
+	for len(want) > 0 {
+		select {
+		case e := <-events:
+			if want[e.Key] != e.Event {
+				t.Fatalf("unexpected event->%+v", e)
+			}
+			delete(want, e.Key)
+		case <-time.After(time.Second):
+			t.Fatalf("events not received->%v", want)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event->%+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the keys of other modules are filtered by the server.
+	if n, err := client.Publish("__keyspace@0__:other:session:1", "expired").Result(); err != nil || n != 0 {
+		t.Fatalf("client.Publish() other module receivers->%d, err->%v", n, err)
+	}
+	if n, err := client.Publish("__keyspace@0__:"+m.GetKey("session:1"), "expired").Result(); err != nil || n != 1 {
+		t.Fatalf("client.Publish() receivers->%d, err->%v", n, err)
+	}
+	<-events
+}
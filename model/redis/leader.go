@@ -0,0 +1,177 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// LeaderElection lease-based leader election. The leader holds a lease key
+// with TTL and renews it, every new term gets a monotonically increasing
+// fencing token that downstream writes can be checked against.
+type LeaderElection struct {
+	client *Client
+	opts   LeaderOptions
+	name   string
+	id     string
+	// keys, share the hash tag {leader:name}.
+	lease   string
+	fencing string
+	// current fencing token, 0 if not leader.
+	token int64
+}
+
+// LeaderOptions leader election options.
+type LeaderOptions struct {
+	// Candidate id, must be unique among the candidates.
+	// Default is random.
+	ID string
+	// Lease TTL, a crashed leader is replaced after at most TTL.
+	// Default is 15 seconds.
+	TTL time.Duration
+	// Frequency of renewing the lease by the leader and trying to acquire it
+	// by the followers, must be less than TTL.
+	// Default is TTL/3.
+	RenewInterval time.Duration
+	// OnElected is called in a new goroutine when becoming the leader, ctx is
+	// canceled when the leadership is lost.
+	OnElected func(ctx context.Context, token int64)
+	// OnLost is called after the leadership is lost and OnElected returned.
+	OnLost func()
+}
+
+// init sets the default options.
+func (o *LeaderOptions) init() {
+	if o.ID == "" {
+		o.ID = randomID()
+	}
+	if o.TTL <= 0 {
+		o.TTL = 15 * time.Second
+	}
+	if o.RenewInterval <= 0 || o.RenewInterval >= o.TTL {
+		o.RenewInterval = o.TTL / 3
+	}
+}
+
+var (
+	// KEYS: lease, fencing; ARGV: id, ttl
+	leaderAcquireScript = newLibScript("leader.acquire", `
+local holder = redis.call('GET', KEYS[1])
+if holder == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return tonumber(redis.call('GET', KEYS[2]))
+end
+if holder then
+	return 0
+end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return token`)
+	// KEYS: lease, fencing; ARGV: id, ttl, token
+	leaderRenewScript = newLibScript("leader.renew", `
+if redis.call('GET', KEYS[1]) == ARGV[1] and redis.call('GET', KEYS[2]) == ARGV[3] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`)
+	// KEYS: lease; ARGV: id
+	leaderResignScript = newLibScript("leader.resign", `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+)
+
+// NewLeaderElection creates leader election named name under the module.
+func NewLeaderElection(c *Client, m *Module, name string, opts LeaderOptions) *LeaderElection {
+	opts.init()
+	registerLibScripts(c, m, leaderAcquireScript, leaderRenewScript, leaderResignScript)
+	return &LeaderElection{
+		client:  c,
+		opts:    opts,
+		name:    name,
+		id:      opts.ID,
+		lease:   hashTagKey(m, "leader:"+name, "lease"),
+		fencing: hashTagKey(m, "leader:"+name, "fencing"),
+	}
+}
+
+// ID returns the candidate id.
+func (l *LeaderElection) ID() string {
+	return l.id
+}
+
+// IsLeader is this candidate the leader?
+func (l *LeaderElection) IsLeader() bool {
+	return atomic.LoadInt64(&l.token) > 0
+}
+
+// Token returns the fencing token of the current term, 0 if not the leader.
+func (l *LeaderElection) Token() int64 {
+	return atomic.LoadInt64(&l.token)
+}
+
+// Leader returns the id of the current leader, returns Nil if there is no leader.
+func (l *LeaderElection) Leader() (string, error) {
+	return l.client.Get(l.lease).Result()
+}
+
+// Run campaigns until ctx is done, then resigns if it is the leader.
+// The leader steps down as soon as a renewal fails.
+func (l *LeaderElection) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.opts.RenewInterval)
+	defer ticker.Stop()
+	for {
+		token, err := leaderAcquireScript.Run(l.client, []string{l.lease, l.fencing},
+			l.id, int64(l.opts.TTL/time.Millisecond)).Int64()
+		if err != nil {
+			ozlog.Errorf("LeaderElection(%s).acquire(): %s", l.name, err.Error())
+		} else if token > 0 {
+			l.lead(ctx, ticker, token)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lead holds the leadership of the term until a renewal fails or ctx is done.
+func (l *LeaderElection) lead(ctx context.Context, ticker *time.Ticker, token int64) {
+	atomic.StoreInt64(&l.token, token)
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var elected sync.WaitGroup
+	if l.opts.OnElected != nil {
+		elected.Add(1)
+		go func() {
+			defer elected.Done()
+			l.opts.OnElected(leaderCtx, token)
+		}()
+	}
+	for renewed := true; renewed; {
+		select {
+		case <-ctx.Done():
+			if err := leaderResignScript.Run(l.client, []string{l.lease}, l.id).Err(); err != nil {
+				ozlog.Errorf("LeaderElection(%s).resign(): %s", l.name, err.Error())
+			}
+			renewed = false
+		case <-ticker.C:
+			ok, err := leaderRenewScript.Run(l.client, []string{l.lease, l.fencing},
+				l.id, int64(l.opts.TTL/time.Millisecond), token).Int64()
+			if err != nil {
+				ozlog.Errorf("LeaderElection(%s).renew(): %s", l.name, err.Error())
+			}
+			renewed = err == nil && ok == 1
+		}
+	}
+	atomic.StoreInt64(&l.token, 0)
+	cancel()
+	elected.Wait()
+	if l.opts.OnLost != nil {
+		l.opts.OnLost()
+	}
+}
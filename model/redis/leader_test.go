@@ -0,0 +1,91 @@
+package redis_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestLeaderElection(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	var (
+		m      = NewModule("ooz-test")
+		name   = "test_leader"
+		mu     sync.Mutex
+		tokens []int64
+		lost   = make(chan string, 2)
+	)
+	newCandidate := func(id string) *LeaderElection {
+		return NewLeaderElection(client, m, name, LeaderOptions{
+			ID:            id,
+			TTL:           300 * time.Millisecond,
+			RenewInterval: 50 * time.Millisecond,
+			OnElected: func(ctx context.Context, token int64) {
+				mu.Lock()
+				tokens = append(tokens, token)
+				mu.Unlock()
+				<-ctx.Done()
+			},
+			OnLost: func() {
+				lost <- id
+			},
+		})
+	}
+	a, b := newCandidate("a"), newCandidate("b")
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan struct{})
+	go func() {
+		a.Run(ctxA)
+		close(doneA)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	doneB := make(chan struct{})
+	go func() {
+		b.Run(ctxB)
+		close(doneB)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("a.IsLeader()->%v, b.IsLeader()->%v", a.IsLeader(), b.IsLeader())
+	}
+	if leader, err := a.Leader(); err != nil || leader != "a" {
+		t.Fatalf("a.Leader() leader->%s, err->%v", leader, err)
+	}
+	// a resigns, b takes over with a greater fencing token.
+	tokenA := a.Token()
+	cancelA()
+	<-doneA
+	if id := <-lost; id != "a" {
+		t.Fatalf("lost->%s, want a", id)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !b.IsLeader() || b.Token() <= tokenA {
+		t.Fatalf("b.IsLeader()->%v, b.Token()->%d, a token->%d", b.IsLeader(), b.Token(), tokenA)
+	}
+	// b steps down when the lease is taken away.
+	client.Set(b.LeaseKey(), "c", time.Second)
+	select {
+	case id := <-lost:
+		if id != "b" {
+			t.Fatalf("lost->%s, want b", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("b did not step down")
+	}
+	if b.IsLeader() {
+		t.Fatal("b.IsLeader() after step down")
+	}
+	cancelB()
+	<-doneB
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tokens) != 2 || tokens[1] <= tokens[0] {
+		t.Fatalf("tokens->%v", tokens)
+	}
+}
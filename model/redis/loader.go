@@ -0,0 +1,249 @@
+package redis
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// Loader request-scoped loader that coalesces the concurrent lookups within a
+// short window into MGET calls, split by hash slot in cluster mode. Identical
+// keys are loaded once and the results are kept for the life of the loader,
+// so create one loader per request.
+type Loader struct {
+	client *Client
+	opts   LoaderOptions
+	mu     sync.Mutex
+	batch  *loaderBatch
+	// results of the dispatched keys.
+	results map[string]*loaderResult
+}
+
+// LoaderOptions loader options.
+type LoaderOptions struct {
+	// Lookups within Wait are batched.
+	// Default is 1 millisecond.
+	Wait time.Duration
+	// Maximum number of keys per MGET, a full batch is sent at once.
+	// Default is 100.
+	MaxBatch int
+	// Fallback loads the keys missing in redis, the keys absent from the
+	// returned map are Nil. Default is nil, the misses are Nil.
+	Fallback func(keys []string) (map[string]string, error)
+	// The values loaded by Fallback are set to redis with Expiration if > 0.
+	// Default is 0, not set.
+	Expiration time.Duration
+}
+
+// init sets the default options.
+func (o *LoaderOptions) init() {
+	if o.Wait <= 0 {
+		o.Wait = time.Millisecond
+	}
+	if o.MaxBatch <= 0 {
+		o.MaxBatch = 100
+	}
+}
+
+// loaderResult result of a key.
+type loaderResult struct {
+	value string
+	err   error
+	done  chan struct{}
+}
+
+// loaderBatch keys waiting to be dispatched.
+type loaderBatch struct {
+	keys    []string
+	results []*loaderResult
+}
+
+// NewLoader creates loader.
+func NewLoader(c *Client, opts *LoaderOptions) *Loader {
+	var o LoaderOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	return &Loader{
+		client:  c,
+		opts:    o,
+		results: make(map[string]*loaderResult),
+	}
+}
+
+// Load returns the value of the key, returns Nil if it does not exist.
+func (l *Loader) Load(key string) (string, error) {
+	r := l.enqueue(key)
+	<-r.done
+	return r.value, r.err
+}
+
+// LoadMany returns the values and errors of the keys in order.
+func (l *Loader) LoadMany(keys []string) ([]string, []error) {
+	results := make([]*loaderResult, len(keys))
+	for i, key := range keys {
+		results[i] = l.enqueue(key)
+	}
+	var (
+		values = make([]string, len(keys))
+		errs   = make([]error, len(keys))
+	)
+	for i, r := range results {
+		<-r.done
+		values[i], errs[i] = r.value, r.err
+	}
+	return values, errs
+}
+
+// Clear forgets the result of the keys, they are loaded again.
+func (l *Loader) Clear(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if r, ok := l.results[key]; ok {
+			select {
+			case <-r.done:
+				delete(l.results, key)
+			default:
+				// in flight
+			}
+		}
+	}
+}
+
+// enqueue adds the key to the current batch.
+func (l *Loader) enqueue(key string) *loaderResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r, ok := l.results[key]; ok {
+		return r
+	}
+	r := &loaderResult{done: make(chan struct{})}
+	l.results[key] = r
+	if l.batch == nil {
+		b := &loaderBatch{}
+		l.batch = b
+		time.AfterFunc(l.opts.Wait, func() {
+			l.mu.Lock()
+			if l.batch != b {
+				// dispatched when full.
+				l.mu.Unlock()
+				return
+			}
+			l.batch = nil
+			l.mu.Unlock()
+			l.dispatch(b)
+		})
+	}
+	b := l.batch
+	b.keys = append(b.keys, key)
+	b.results = append(b.results, r)
+	if len(b.keys) >= l.opts.MaxBatch {
+		l.batch = nil
+		go l.dispatch(b)
+	}
+	return r
+}
+
+// dispatch loads the batch by one MGET per slot in parallel, the waiters are
+// always released.
+func (l *Loader) dispatch(b *loaderBatch) {
+	defer func() {
+		if p := recover(); p != nil {
+			err := fmt.Errorf("redis: loader panic: %v", p)
+			ozlog.Errorf("Loader.dispatch(): %s", err.Error())
+			for _, r := range b.results {
+				r.value, r.err = "", err
+			}
+		}
+		for _, r := range b.results {
+			close(r.done)
+		}
+	}()
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		misses []int
+	)
+	for _, group := range l.client.groupBySlot(b.keys) {
+		wg.Add(1)
+		go func(group []int) {
+			defer wg.Done()
+			keys := make([]string, len(group))
+			for i, idx := range group {
+				keys[i] = b.keys[idx]
+			}
+			vals, err := l.client.MGet(keys...).Result()
+			if err == nil && len(vals) != len(keys) {
+				err = fmt.Errorf("redis: unexpected mget reply length %d, want %d", len(vals), len(keys))
+			}
+			for i, idx := range group {
+				r := b.results[idx]
+				if err != nil {
+					r.err = err
+					continue
+				}
+				if v, ok := vals[i].(string); ok {
+					r.value = v
+					continue
+				}
+				r.err = Nil
+				mu.Lock()
+				misses = append(misses, idx)
+				mu.Unlock()
+			}
+		}(group)
+	}
+	wg.Wait()
+	if len(misses) > 0 && l.opts.Fallback != nil {
+		l.fallback(b, misses)
+	}
+}
+
+// callFallback calls Fallback, a panic is returned as the error of the keys.
+func (l *Loader) callFallback(keys []string) (vals map[string]string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("redis: loader fallback panic: %v", p)
+			ozlog.Errorf("Loader.fallback(): %s", err.Error())
+		}
+	}()
+	return l.opts.Fallback(keys)
+}
+
+// fallback loads the missing keys by Fallback and sets them to redis.
+func (l *Loader) fallback(b *loaderBatch, misses []int) {
+	keys := make([]string, len(misses))
+	for i, idx := range misses {
+		keys[i] = b.keys[idx]
+	}
+	vals, err := l.callFallback(keys)
+	if err != nil {
+		for _, idx := range misses {
+			b.results[idx].err = err
+		}
+		return
+	}
+	var loaded []int
+	for _, idx := range misses {
+		if v, ok := vals[b.keys[idx]]; ok {
+			b.results[idx].value, b.results[idx].err = v, nil
+			loaded = append(loaded, idx)
+		}
+	}
+	if l.opts.Expiration <= 0 || len(loaded) == 0 {
+		return
+	}
+	_, err = l.client.Pipelined(func(p Pipeliner) error {
+		for _, idx := range loaded {
+			p.Set(b.keys[idx], b.results[idx].value, l.opts.Expiration)
+		}
+		return nil
+	})
+	if err != nil {
+		ozlog.Errorf("Loader.fallback(): set loaded keys: %s", err.Error())
+	}
+}
@@ -0,0 +1,91 @@
+package redis_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestSlot(t *testing.T) {
+	// from the redis cluster specification.
+	if s := Slot("123456789"); s != 0x31C3%SlotCount {
+		t.Fatalf("Slot(123456789)->%d", s)
+	}
+	if Slot("{user1000}.following") != Slot("{user1000}.followers") {
+		t.Fatal("Slot() hash tags differ")
+	}
+	// empty hash tag, the whole key is hashed.
+	if Slot("foo{}{bar}") != int(CRC16("foo{}{bar}")%SlotCount) {
+		t.Fatal("Slot() empty hash tag is hashed")
+	}
+	if Slot("foo{{bar}}zap") != Slot("{bar") {
+		t.Fatal("Slot() hash tag is not up to the first '}'")
+	}
+}
+
+func TestLoader(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	var (
+		m         = NewModule("ooz-test")
+		prefix    = "loader:"
+		keys      = []string{m.GetKey(prefix + "1"), m.GetKey(prefix + "2"), m.GetKey(prefix + "3")}
+		fallbacks int32
+		h         = new(countHook)
+	)
+	client.Set(keys[0], "v1", time.Minute)
+	client.Set(keys[1], "v2", time.Minute)
+	defer client.Del(keys...)
+	client.AddHook(h)
+	l := NewLoader(client, &LoaderOptions{
+		Wait: 10 * time.Millisecond,
+		Fallback: func(missing []string) (map[string]string, error) {
+			atomic.AddInt32(&fallbacks, 1)
+			if len(missing) != 1 || missing[0] != keys[2] {
+				return nil, errors.New("unexpected missing keys")
+			}
+			return map[string]string{keys[2]: "v3"}, nil
+		},
+		Expiration: time.Minute,
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if v, err := l.Load(keys[i%3]); err != nil || v != []string{"v1", "v2", "v3"}[i%3] {
+				t.Errorf("l.Load(%d) v->%s, err->%v", i%3, v, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// one mget and one pipeline setting the fallback value.
+	if h.cmds != 1 || h.pipelines != 1 || fallbacks != 1 {
+		t.Fatalf("cmds->%d, pipelines->%d, fallbacks->%d", h.cmds, h.pipelines, fallbacks)
+	}
+	if v, err := client.Get(keys[2]).Result(); err != nil || v != "v3" {
+		t.Fatalf("fallback value not set v->%s, err->%v", v, err)
+	}
+	// loaded once per loader.
+	if values, errs := l.LoadMany(keys); errs[0] != nil || values[2] != "v3" || h.cmds != 2 {
+		t.Fatalf("l.LoadMany() values->%v, errs->%v, cmds->%d", values, errs, h.cmds)
+	}
+	// misses without fallback.
+	if _, err := NewLoader(client, nil).Load(m.GetKey(prefix + "none")); !IsRedisNil(err) {
+		t.Fatalf("Load() missing err->%v", err)
+	}
+	// a panicking fallback fails the missing keys without blocking the waiters.
+	panicking := NewLoader(client, &LoaderOptions{
+		Fallback: func(missing []string) (map[string]string, error) {
+			panic("fallback")
+		},
+	})
+	values, errs := panicking.LoadMany([]string{keys[0], m.GetKey(prefix + "none")})
+	if errs[0] != nil || values[0] != "v1" || errs[1] == nil || IsRedisNil(errs[1]) {
+		t.Fatalf("LoadMany() panicking fallback values->%v, errs->%v", values, errs)
+	}
+}
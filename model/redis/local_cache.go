@@ -0,0 +1,252 @@
+package redis
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// LocalCache in-process LRU/TTL cache in front of the redis string reads.
+// Writes through the cache publish the invalidated keys on a pub/sub
+// channel, Run subscribes it and evicts them on every instance. Until Run
+// has subscribed, the reads go to redis without the local cache.
+// The go-redis v6 driver does not speak RESP3, so client tracking is not used.
+type LocalCache struct {
+	client  *Client
+	opts    LocalCacheOptions
+	name    string
+	channel string
+	sub     *Subscriber
+	mu      sync.Mutex
+	lru     *list.List
+	items   map[string]*list.Element
+	// is the invalidation channel subscribed by Run?
+	subscribed int32
+	// gen is increased by every invalidation, a value loaded from redis is
+	// not cached if gen changed during the load.
+	gen       uint64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// LocalCacheOptions local cache options.
+type LocalCacheOptions struct {
+	// Maximum number of entries, the least recently used entry is evicted
+	// when reached.
+	// Default is 10000.
+	MaxEntries int
+	// Entries expire after TTL, it bounds the staleness if an invalidation
+	// is lost.
+	// Default is 1 minute.
+	TTL time.Duration
+}
+
+// init sets the default options.
+func (o *LocalCacheOptions) init() {
+	if o.MaxEntries <= 0 {
+		o.MaxEntries = 10000
+	}
+	if o.TTL <= 0 {
+		o.TTL = time.Minute
+	}
+}
+
+// LocalCacheStats local cache stats.
+type LocalCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+}
+
+// localCacheEntry lru entry.
+type localCacheEntry struct {
+	key      string
+	value    string
+	expireAt time.Time
+}
+
+// NewLocalCache creates local cache named name under the module, the
+// instances with the same name share the invalidations.
+func NewLocalCache(c *Client, m *Module, name string, opts *LocalCacheOptions) *LocalCache {
+	var o LocalCacheOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	lc := &LocalCache{
+		client:  c,
+		opts:    o,
+		name:    name,
+		channel: m.GetKey("localcache:" + name + ":invalidate"),
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+	// the invalidations published while disconnected are lost.
+	lc.sub = NewSubscriber(c, &SubscriberOptions{
+		Concurrency: 1,
+		OnSubscribe: func() {
+			lc.Purge()
+			atomic.StoreInt32(&lc.subscribed, 1)
+		},
+	})
+	lc.sub.Handle(lc.channel, lc.onInvalidate)
+	return lc
+}
+
+// Run receives the invalidations until ctx is done, then the local cache is
+// purged and bypassed.
+func (lc *LocalCache) Run(ctx context.Context) error {
+	err := lc.sub.Run(ctx)
+	if err == ErrSubscriberRunning {
+		return err
+	}
+	atomic.StoreInt32(&lc.subscribed, 0)
+	lc.Purge()
+	return err
+}
+
+// Get returns the value of the key from the local cache, or from redis on miss.
+// The local cache is bypassed until Run has subscribed, no invalidation would
+// evict the value.
+func (lc *LocalCache) Get(key string) (string, error) {
+	if atomic.LoadInt32(&lc.subscribed) == 0 {
+		atomic.AddUint64(&lc.misses, 1)
+		return lc.client.Get(key).Result()
+	}
+	lc.mu.Lock()
+	if value, ok := lc.get(key); ok {
+		lc.mu.Unlock()
+		atomic.AddUint64(&lc.hits, 1)
+		return value, nil
+	}
+	gen := lc.gen
+	lc.mu.Unlock()
+	atomic.AddUint64(&lc.misses, 1)
+	value, err := lc.client.Get(key).Result()
+	if err != nil {
+		return "", err
+	}
+	lc.mu.Lock()
+	if lc.gen == gen {
+		lc.put(key, value)
+	}
+	lc.mu.Unlock()
+	return value, nil
+}
+
+// Set sets the value of the key in redis and invalidates it on all instances.
+func (lc *LocalCache) Set(key string, value interface{}, expiration time.Duration) error {
+	if err := lc.client.Set(key, value, expiration).Err(); err != nil {
+		return err
+	}
+	return lc.Invalidate(key)
+}
+
+// Del deletes the keys in redis and invalidates them on all instances.
+func (lc *LocalCache) Del(keys ...string) error {
+	if err := lc.client.Del(keys...).Err(); err != nil {
+		return err
+	}
+	return lc.Invalidate(keys...)
+}
+
+// Invalidate evicts the keys locally and publishes them to the other instances,
+// it must be called after the keys are changed in redis without the cache.
+func (lc *LocalCache) Invalidate(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	lc.evict(keys)
+	msg, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return lc.client.Publish(lc.channel, msg).Err()
+}
+
+// Purge evicts all entries locally.
+func (lc *LocalCache) Purge() {
+	lc.mu.Lock()
+	lc.gen++
+	lc.lru.Init()
+	lc.items = make(map[string]*list.Element)
+	lc.mu.Unlock()
+}
+
+// Stats returns the cache stats.
+func (lc *LocalCache) Stats() LocalCacheStats {
+	lc.mu.Lock()
+	entries := lc.lru.Len()
+	lc.mu.Unlock()
+	return LocalCacheStats{
+		Hits:      atomic.LoadUint64(&lc.hits),
+		Misses:    atomic.LoadUint64(&lc.misses),
+		Evictions: atomic.LoadUint64(&lc.evictions),
+		Entries:   entries,
+	}
+}
+
+// onInvalidate evicts the published keys.
+func (lc *LocalCache) onInvalidate(msg *Message) {
+	var keys []string
+	if err := json.Unmarshal([]byte(msg.Payload), &keys); err != nil {
+		ozlog.Errorf("LocalCache(%s): invalid invalidation message->%s, err->%s", lc.name, msg.Payload, err.Error())
+		lc.Purge()
+		return
+	}
+	lc.evict(keys)
+}
+
+// evict removes the keys.
+func (lc *LocalCache) evict(keys []string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.gen++
+	for _, key := range keys {
+		if elem, ok := lc.items[key]; ok {
+			lc.lru.Remove(elem)
+			delete(lc.items, key)
+		}
+	}
+}
+
+// get returns the unexpired value of the key, lc.mu must be held.
+func (lc *LocalCache) get(key string) (string, bool) {
+	elem, ok := lc.items[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*localCacheEntry)
+	if time.Now().After(entry.expireAt) {
+		lc.lru.Remove(elem)
+		delete(lc.items, key)
+		return "", false
+	}
+	lc.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+// put adds the value and evicts the least recently used entries, lc.mu must be held.
+func (lc *LocalCache) put(key, value string) {
+	expireAt := time.Now().Add(lc.opts.TTL)
+	if elem, ok := lc.items[key]; ok {
+		entry := elem.Value.(*localCacheEntry)
+		entry.value, entry.expireAt = value, expireAt
+		lc.lru.MoveToFront(elem)
+		return
+	}
+	lc.items[key] = lc.lru.PushFront(&localCacheEntry{key: key, value: value, expireAt: expireAt})
+	for lc.lru.Len() > lc.opts.MaxEntries {
+		elem := lc.lru.Back()
+		lc.lru.Remove(elem)
+		delete(lc.items, elem.Value.(*localCacheEntry).key)
+		atomic.AddUint64(&lc.evictions, 1)
+	}
+}
@@ -0,0 +1,72 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestLocalCache(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	var (
+		m    = NewModule("ooz-test")
+		name = "test_local"
+		a    = NewLocalCache(client, m, name, &LocalCacheOptions{MaxEntries: 2})
+		b    = NewLocalCache(client, m, name, &LocalCacheOptions{MaxEntries: 2})
+		key  = m.GetKey(name + ":1")
+	)
+	// not cached without Run.
+	client.Set(key, "v0", time.Minute)
+	idle := NewLocalCache(client, m, name, nil)
+	if v, err := idle.Get(key); err != nil || v != "v0" {
+		t.Fatalf("idle.Get() v->%s, err->%v", v, err)
+	}
+	if stats := idle.Stats(); stats.Entries != 0 {
+		t.Fatalf("idle.Stats()->%+v", stats)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	go b.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+	if err := a.Set(key, "v1", time.Minute); err != nil {
+		t.Fatalf("a.Set() err->%v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if v, err := b.Get(key); err != nil || v != "v1" {
+			t.Fatalf("b.Get() v->%s, err->%v", v, err)
+		}
+	}
+	if stats := b.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("b.Stats()->%+v", stats)
+	}
+	// invalidated on b by the write through a.
+	if err := a.Set(key, "v2", time.Minute); err != nil {
+		t.Fatalf("a.Set() err->%v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v, err := b.Get(key); err != nil || v != "v2" {
+		t.Fatalf("b.Get() after invalidation v->%s, err->%v", v, err)
+	}
+	// size limit.
+	for i, k := range []string{key + "a", key + "b"} {
+		client.Set(k, i, time.Minute)
+		if _, err := b.Get(k); err != nil {
+			t.Fatalf("b.Get() err->%v", err)
+		}
+	}
+	if stats := b.Stats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Fatalf("b.Stats()->%+v", stats)
+	}
+	if err := a.Del(key, key+"a", key+"b"); err != nil {
+		t.Fatalf("a.Del() err->%v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := b.Get(key); !IsRedisNil(err) {
+		t.Fatalf("b.Get() after del err->%v", err)
+	}
+}
@@ -0,0 +1,623 @@
+package redis
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// ErrMigratorNoPrefix returned by Migrator.Run and Migrator.Verify when no
+// prefix is configured.
+var ErrMigratorNoPrefix = errors.New("redis: migrator has no prefix")
+
+// migrateDone progress of a prefix fully copied from a node.
+const migrateDone = "done"
+
+// maxMigrationCheckKeys maximum number of keys reported by Migrator.Verify.
+const maxMigrationCheckKeys = 100
+
+// dualWriteStripes number of the locks serializing the dual write of the keys.
+const dualWriteStripes = 256
+
+// Migrator copies the keys under the prefixes from one deployment to another,
+// .e.g. single to cluster, by SCAN and DUMP/RESTORE keeping the TTLs. The
+// progress of every source node is saved to the destination after each batch,
+// so an interrupted Run resumes where it stopped.
+//
+// For an online migration, EnableDualWrite before Run: every key written
+// through the source client is then copied to the destination after the
+// write, and Run skips the keys already in the destination since they are
+// newer. Verify compares the keys once the writes are switched.
+//
+// Dual write is synchronous: a write of a key under the prefixes returns
+// after its DUMP from the source and RESTORE to the destination, two more
+// round trips, and waits for the copy of the keys sharing its lock stripe.
+// The copies of a key are serialized, so the destination ends with the value
+// dumped after the last write.
+type Migrator struct {
+	src, dst *Client
+	opts     MigratorOptions
+	// hookMu guards the hook of the source client.
+	hookMu    sync.Mutex
+	dualWrite int32
+	stripes   [dualWriteStripes]sync.Mutex
+	// number of keys failed to be copied by dual write.
+	dualWriteErrors int64
+}
+
+// MigratorOptions migrator options.
+type MigratorOptions struct {
+	// Keys under the prefixes are migrated, .e.g. Module.GetPrefix().
+	Prefixes []string
+	// Number of keys per SCAN and pipeline.
+	// Default is 100.
+	BatchSize int64
+	// Replace overwrites the keys existing in the destination, leave it false
+	// with dual write.
+	// Default is false, the existing keys are skipped.
+	Replace bool
+	// Key of the progress hash in the destination.
+	// Default is "migrate:<name>".
+	StateKey string
+}
+
+// init sets the default options.
+func (o *MigratorOptions) init(name string) {
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	if o.StateKey == "" {
+		o.StateKey = "migrate:" + name
+	}
+}
+
+// MigrationStats result of Migrator.Run.
+type MigrationStats struct {
+	// Scanned number of keys scanned.
+	Scanned int64 `json:"scanned"`
+	// Copied number of keys restored to the destination.
+	Copied int64 `json:"copied"`
+	// Skipped number of keys already in the destination.
+	Skipped int64 `json:"skipped"`
+	// Expired number of keys expired or deleted before copied.
+	Expired int64 `json:"expired"`
+}
+
+// MigrationCheck result of Migrator.Verify.
+type MigrationCheck struct {
+	// Checked number of source keys checked.
+	Checked int64 `json:"checked"`
+	// Missing number of keys absent from the destination.
+	Missing int64 `json:"missing"`
+	// Mismatched number of keys with different type or value.
+	Mismatched int64 `json:"mismatched"`
+	// Keys the first missing or mismatched keys.
+	Keys []string `json:"keys,omitempty"`
+	// Checksums of the checked keys, equal if the keys are.
+	SrcChecksum uint64 `json:"src_checksum"`
+	DstChecksum uint64 `json:"dst_checksum"`
+}
+
+// OK are all source keys in the destination with the same value?
+func (c *MigrationCheck) OK() bool {
+	return c.Missing == 0 && c.Mismatched == 0
+}
+
+var _ Hook = (*Migrator)(nil)
+
+// NewMigrator creates migrator from src to dst, name identifies the progress.
+func NewMigrator(src, dst *Client, name string, opts *MigratorOptions) *Migrator {
+	var o MigratorOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init(name)
+	return &Migrator{
+		src:  src,
+		dst:  dst,
+		opts: o,
+	}
+}
+
+// Run copies the keys of every source master, resuming the saved progress.
+// Run again after an error or cancellation to continue.
+func (m *Migrator) Run(ctx context.Context) (*MigrationStats, error) {
+	if len(m.opts.Prefixes) == 0 {
+		return nil, ErrMigratorNoPrefix
+	}
+	stats := new(MigrationStats)
+	err := m.src.ForEachMaster(func(node Cmdable) error {
+		for _, prefix := range m.opts.Prefixes {
+			if err := m.copyPrefix(ctx, node, prefix, stats); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// Reset forgets the progress, the next Run starts over.
+func (m *Migrator) Reset() error {
+	return m.dst.Del(m.opts.StateKey).Err()
+}
+
+// copyPrefix copies the keys under the prefix from the node.
+func (m *Migrator) copyPrefix(ctx context.Context, node Cmdable, prefix string, stats *MigrationStats) error {
+	field := prefix + "|" + nodeAddr(node)
+	state, err := m.dst.HGet(m.opts.StateKey, field).Result()
+	if err != nil && !IsRedisNil(err) {
+		return err
+	}
+	if state == migrateDone {
+		return nil
+	}
+	cursor, _ := strconv.ParseUint(state, 10, 64)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keys, next, err := node.Scan(cursor, globEscape(prefix)+"*", m.opts.BatchSize).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			atomic.AddInt64(&stats.Scanned, int64(len(keys)))
+			if err = m.copyKeys(node, keys, stats); err != nil {
+				return err
+			}
+		}
+		state = strconv.FormatUint(next, 10)
+		if next == 0 {
+			state = migrateDone
+		}
+		if err = m.dst.HSet(m.opts.StateKey, field, state).Err(); err != nil {
+			return err
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// copyKeys dumps the keys from the node and restores them to the destination.
+// The keys are locked from the DUMP to the RESTORE as by dual write, so a key
+// written or deleted meanwhile is synced after the copy.
+func (m *Migrator) copyKeys(node Cmdable, keys []string, stats *MigrationStats) error {
+	unlock := m.lockKeys(keys)
+	defer unlock()
+	dumps, ttls, err := dumpKeys(node, keys)
+	if err != nil {
+		return err
+	}
+	restores := make([]*StatusCmd, len(keys))
+	_, err = m.dst.Pipelined(func(p Pipeliner) error {
+		for i, key := range keys {
+			ttl, ok := restoreTTL(dumps[i], ttls[i])
+			if !ok {
+				continue
+			}
+			if m.opts.Replace {
+				restores[i] = p.RestoreReplace(key, ttl, dumps[i].Val())
+			} else {
+				restores[i] = p.Restore(key, ttl, dumps[i].Val())
+			}
+		}
+		return nil
+	})
+	for _, cmd := range restores {
+		switch {
+		case cmd == nil:
+			atomic.AddInt64(&stats.Expired, 1)
+		case cmd.Err() == nil:
+			atomic.AddInt64(&stats.Copied, 1)
+		case isBusyKey(cmd.Err()):
+			atomic.AddInt64(&stats.Skipped, 1)
+		default:
+			return cmd.Err()
+		}
+	}
+	if err != nil && !isBusyKey(err) {
+		return err
+	}
+	return nil
+}
+
+// dumpKeys returns the DUMP and PTTL of the keys.
+func dumpKeys(node Cmdable, keys []string) ([]*StringCmd, []*DurationCmd, error) {
+	var (
+		dumps = make([]*StringCmd, len(keys))
+		ttls  = make([]*DurationCmd, len(keys))
+	)
+	_, err := node.Pipelined(func(p Pipeliner) error {
+		for i, key := range keys {
+			dumps[i] = p.Dump(key)
+			ttls[i] = p.PTTL(key)
+		}
+		return nil
+	})
+	if err != nil && !IsRedisNil(err) {
+		return nil, nil, err
+	}
+	return dumps, ttls, nil
+}
+
+// restoreTTL returns the RESTORE ttl of the dumped key, false if the key is
+// gone or about to expire.
+func restoreTTL(dump *StringCmd, pttl *DurationCmd) (time.Duration, bool) {
+	if dump.Err() != nil || pttl.Err() != nil {
+		return 0, false
+	}
+	switch ttl := pttl.Val(); {
+	case ttl == -time.Millisecond:
+		// no expiration
+		return 0, true
+	case ttl <= 0:
+		return 0, false
+	default:
+		return ttl, true
+	}
+}
+
+// isBusyKey is err the RESTORE error of an existing key?
+func isBusyKey(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "BUSYKEY")
+}
+
+// globEscape escapes the glob special characters of a SCAN MATCH pattern.
+func globEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// EnableDualWrite starts copying the keys written through the source client
+// to the destination, by a hook of the source client.
+func (m *Migrator) EnableDualWrite() {
+	m.hookMu.Lock()
+	defer m.hookMu.Unlock()
+	if atomic.LoadInt32(&m.dualWrite) == 0 {
+		m.src.AddHook(m)
+		atomic.StoreInt32(&m.dualWrite, 1)
+	}
+}
+
+// DisableDualWrite stops dual write and removes the hook from the source
+// client.
+func (m *Migrator) DisableDualWrite() {
+	m.hookMu.Lock()
+	defer m.hookMu.Unlock()
+	if atomic.LoadInt32(&m.dualWrite) == 1 {
+		atomic.StoreInt32(&m.dualWrite, 0)
+		m.src.RemoveHook(m)
+	}
+}
+
+// DualWriteErrors returns the number of keys failed to be copied by dual
+// write, run Verify and Run with Replace to fix them.
+func (m *Migrator) DualWriteErrors() int64 {
+	return atomic.LoadInt64(&m.dualWriteErrors)
+}
+
+// BeforeProcess implements Hook.
+func (m *Migrator) BeforeProcess(cmd Cmder) {}
+
+// AfterProcess implements Hook.
+func (m *Migrator) AfterProcess(cmd Cmder, elapsed time.Duration) {
+	if atomic.LoadInt32(&m.dualWrite) == 0 {
+		return
+	}
+	if keys := m.writtenKeys(cmd, nil); len(keys) > 0 {
+		m.syncKeys(keys)
+	}
+}
+
+// BeforeProcessPipeline implements Hook.
+func (m *Migrator) BeforeProcessPipeline(cmds []Cmder) {}
+
+// AfterProcessPipeline implements Hook.
+func (m *Migrator) AfterProcessPipeline(cmds []Cmder, elapsed time.Duration) {
+	if atomic.LoadInt32(&m.dualWrite) == 0 {
+		return
+	}
+	var keys []string
+	for _, cmd := range cmds {
+		keys = m.writtenKeys(cmd, keys)
+	}
+	if len(keys) > 0 {
+		m.syncKeys(keys)
+	}
+}
+
+// writtenKeys appends the keys under the prefixes written by the command.
+func (m *Migrator) writtenKeys(cmd Cmder, keys []string) []string {
+	name := cmd.Name()
+	if readOnlyCommands[name] || cmd.Err() != nil && !IsRedisNil(cmd.Err()) {
+		return keys
+	}
+	var (
+		args       = cmd.Args()
+		candidates []interface{}
+	)
+	switch name {
+	case "hscan", "sscan", "zscan", "object", "memory":
+		return keys
+	case "del", "unlink", "touch":
+		candidates = args[1:]
+	case "mset", "msetnx":
+		for i := 1; i < len(args); i += 2 {
+			candidates = append(candidates, args[i])
+		}
+	case "rename", "renamenx", "rpoplpush", "brpoplpush", "smove", "lmove", "copy":
+		if len(args) > 2 {
+			candidates = args[1:3]
+		}
+	case "bitop":
+		if len(args) > 2 {
+			candidates = args[2:]
+		}
+	case "eval", "evalsha":
+		if len(args) > 2 {
+			n, _ := strconv.Atoi(argString(args[2]))
+			if n > 0 && len(args) >= 3+n {
+				candidates = args[3 : 3+n]
+			}
+		}
+	default:
+		if key := CmdKey(cmd); key != "" {
+			candidates = []interface{}{key}
+		}
+	}
+	for _, arg := range candidates {
+		key := argString(arg)
+		for _, prefix := range m.opts.Prefixes {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// lockKeys locks the stripes of the keys in order, returns the unlock func.
+func (m *Migrator) lockKeys(keys []string) func() {
+	var locked [dualWriteStripes]bool
+	for _, key := range keys {
+		locked[crc32.ChecksumIEEE([]byte(key))%dualWriteStripes] = true
+	}
+	for i := range locked {
+		if locked[i] {
+			m.stripes[i].Lock()
+		}
+	}
+	return func() {
+		for i := range locked {
+			if locked[i] {
+				m.stripes[i].Unlock()
+			}
+		}
+	}
+}
+
+// syncKeys copies the current value of the keys to the destination, the
+// keys gone from the source are deleted. The keys are locked from the DUMP
+// to the RESTORE, so a copy dumped before a concurrent write can not
+// overwrite the newer one.
+func (m *Migrator) syncKeys(keys []string) {
+	unlock := m.lockKeys(keys)
+	defer unlock()
+	dumps, ttls, err := dumpKeys(m.src.Master(), keys)
+	if err == nil {
+		_, err = m.dst.Pipelined(func(p Pipeliner) error {
+			for i, key := range keys {
+				if ttl, ok := restoreTTL(dumps[i], ttls[i]); ok {
+					p.RestoreReplace(key, ttl, dumps[i].Val())
+				} else if IsRedisNil(dumps[i].Err()) {
+					p.Del(key)
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		atomic.AddInt64(&m.dualWriteErrors, int64(len(keys)))
+		ozlog.Errorf("Migrator.syncKeys(): keys->%v, err->%s", keys, err.Error())
+	}
+}
+
+// Verify compares the checksum of the type and value of every source key
+// under the prefixes with the destination key. The keys written during
+// Verify may be reported, verify after the writes are switched.
+func (m *Migrator) Verify(ctx context.Context) (*MigrationCheck, error) {
+	if len(m.opts.Prefixes) == 0 {
+		return nil, ErrMigratorNoPrefix
+	}
+	var (
+		mu    sync.Mutex
+		check = new(MigrationCheck)
+	)
+	err := m.src.ForEachMaster(func(node Cmdable) error {
+		for _, prefix := range m.opts.Prefixes {
+			var cursor uint64
+			for {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				keys, next, err := node.Scan(cursor, globEscape(prefix)+"*", m.opts.BatchSize).Result()
+				if err != nil {
+					return err
+				}
+				if len(keys) > 0 {
+					srcSums, err := keyChecksums(node, keys)
+					if err != nil {
+						return err
+					}
+					dstSums, err := keyChecksums(m.dst, keys)
+					if err != nil {
+						return err
+					}
+					mu.Lock()
+					check.add(keys, srcSums, dstSums)
+					mu.Unlock()
+				}
+				if cursor = next; cursor == 0 {
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// add adds the checksums of the keys, 0 for an absent key.
+func (c *MigrationCheck) add(keys []string, srcSums, dstSums []uint64) {
+	for i, key := range keys {
+		if srcSums[i] == 0 {
+			// deleted after SCAN
+			continue
+		}
+		c.Checked++
+		c.SrcChecksum += srcSums[i]
+		c.DstChecksum += dstSums[i]
+		switch {
+		case dstSums[i] == 0:
+			c.Missing++
+		case dstSums[i] != srcSums[i]:
+			c.Mismatched++
+		default:
+			continue
+		}
+		if len(c.Keys) < maxMigrationCheckKeys {
+			c.Keys = append(c.Keys, key)
+		}
+	}
+}
+
+// crc64Table table of the key checksums.
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// keyChecksums returns the checksum of the name, type and value of the keys,
+// 0 if the key does not exist. The checksum does not depend on the encoding,
+// so it is comparable between redis versions.
+func keyChecksums(c Cmdable, keys []string) ([]uint64, error) {
+	types := make([]*StatusCmd, len(keys))
+	_, err := c.Pipelined(func(p Pipeliner) error {
+		for i, key := range keys {
+			types[i] = p.Type(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	values := make([]Cmder, len(keys))
+	_, err = c.Pipelined(func(p Pipeliner) error {
+		for i, key := range keys {
+			switch types[i].Val() {
+			case "string":
+				values[i] = p.Get(key)
+			case "hash":
+				values[i] = p.HGetAll(key)
+			case "list":
+				values[i] = p.LRange(key, 0, -1)
+			case "set":
+				values[i] = p.SMembers(key)
+			case "zset":
+				values[i] = p.ZRangeWithScores(key, 0, -1)
+			case "stream":
+				values[i] = p.XRange(key, "-", "+")
+			}
+		}
+		return nil
+	})
+	if err != nil && !IsRedisNil(err) {
+		return nil, err
+	}
+	sums := make([]uint64, len(keys))
+	for i, key := range keys {
+		typ := types[i].Val()
+		if typ == "none" || values[i] != nil && values[i].Err() != nil {
+			// expired between the pipelines, or a type not supported.
+			continue
+		}
+		h := crc64.New(crc64Table)
+		writeChecksumField(h, key)
+		writeChecksumField(h, typ)
+		switch v := values[i].(type) {
+		case *StringCmd:
+			writeChecksumField(h, v.Val())
+		case *StringStringMapCmd:
+			m := v.Val()
+			fields := make([]string, 0, len(m))
+			for f := range m {
+				fields = append(fields, f)
+			}
+			sort.Strings(fields)
+			for _, f := range fields {
+				writeChecksumField(h, f)
+				writeChecksumField(h, m[f])
+			}
+		case *StringSliceCmd:
+			vals := v.Val()
+			if typ == "set" {
+				sort.Strings(vals)
+			}
+			for _, val := range vals {
+				writeChecksumField(h, val)
+			}
+		case *ZSliceCmd:
+			for _, z := range v.Val() {
+				writeChecksumField(h, argString(z.Member))
+				writeChecksumField(h, strconv.FormatFloat(z.Score, 'g', -1, 64))
+			}
+		case *redis.XMessageSliceCmd:
+			for _, msg := range v.Val() {
+				writeChecksumField(h, msg.ID)
+				fields := make([]string, 0, len(msg.Values))
+				for f := range msg.Values {
+					fields = append(fields, f)
+				}
+				sort.Strings(fields)
+				for _, f := range fields {
+					writeChecksumField(h, f)
+					writeChecksumField(h, argString(msg.Values[f]))
+				}
+			}
+		}
+		if sums[i] = h.Sum64(); sums[i] == 0 {
+			sums[i] = 1
+		}
+	}
+	return sums, nil
+}
+
+// writeChecksumField writes the length prefixed field to h.
+func writeChecksumField(h hash.Hash64, s string) {
+	var n [binary.MaxVarintLen64]byte
+	h.Write(n[:binary.PutUvarint(n[:], uint64(len(s)))])
+	h.Write([]byte(s))
+}
@@ -0,0 +1,187 @@
+package redis_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestMigrator(t *testing.T) {
+	src, _ := redistest.NewClient(t)
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis.Run() err->%v", err)
+	}
+	defer s.Close()
+	dst, err := NewClient(&Config{
+		DeployType: "single",
+		ForSingle: SingleConfig{
+			Addr: s.Addr(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("new client err->%v", err)
+	}
+	var (
+		ctx   = context.Background()
+		m     = NewModule("ooz-test")
+		other = NewModule("ooz-test-other")
+		mg    = NewMigrator(src, dst, "test", &MigratorOptions{
+			Prefixes:  []string{m.GetPrefix()},
+			BatchSize: 2,
+		})
+	)
+	defer src.Del(m.GetKey("a"), m.GetKey("b"), m.GetKey("c"), m.GetKey("h"), other.GetKey("a"))
+	src.Set(m.GetKey("a"), "1", 0)
+	src.Set(m.GetKey("b"), "2", time.Hour)
+	src.Set(m.GetKey("c"), "3", 0)
+	src.Set(other.GetKey("a"), "1", 0)
+	// existing in the destination, not replaced.
+	dst.Set(m.GetKey("c"), "new", 0)
+
+	stats, err := mg.Run(ctx)
+	if err != nil || stats.Scanned != 3 || stats.Copied != 2 || stats.Skipped != 1 {
+		t.Fatalf("Run() v->%+v, err->%v", stats, err)
+	}
+	if v, _ := dst.Get(m.GetKey("a")).Result(); v != "1" {
+		t.Fatalf("dst get a v->%s", v)
+	}
+	if ttl := dst.PTTL(m.GetKey("b")).Val(); ttl <= 59*time.Minute {
+		t.Fatalf("dst pttl b v->%v", ttl)
+	}
+	if n := dst.Exists(other.GetKey("a")).Val(); n != 0 {
+		t.Fatalf("dst exists other v->%d", n)
+	}
+
+	// done, resumed run does nothing.
+	if stats, err = mg.Run(ctx); err != nil || stats.Scanned != 0 {
+		t.Fatalf("Run() resumed v->%+v, err->%v", stats, err)
+	}
+
+	check, err := mg.Verify(ctx)
+	if err != nil || check.OK() || check.Checked != 3 || check.Mismatched != 1 || check.Keys[0] != m.GetKey("c") {
+		t.Fatalf("Verify() v->%+v, err->%v", check, err)
+	}
+
+	mg.EnableDualWrite()
+	src.Set(m.GetKey("c"), "4", 0)
+	src.Set(other.GetKey("a"), "2", 0)
+	src.Del(m.GetKey("a"))
+	src.Pipelined(func(p Pipeliner) error {
+		p.Set(m.GetKey("a"), "5", 0)
+		return nil
+	})
+	mg.DisableDualWrite()
+	if hooks := src.Hooks(); len(hooks) != 0 {
+		t.Fatalf("DisableDualWrite() hooks->%d", len(hooks))
+	}
+	src.Set(m.GetKey("b"), "6", 0)
+	if v, _ := dst.Get(m.GetKey("c")).Result(); v != "4" {
+		t.Fatalf("dual write c v->%s", v)
+	}
+	if v, _ := dst.Get(m.GetKey("a")).Result(); v != "5" {
+		t.Fatalf("dual write a v->%s", v)
+	}
+	if n := dst.Exists(other.GetKey("a")).Val(); n != 0 {
+		t.Fatalf("dual write other v->%d", n)
+	}
+	if mg.DualWriteErrors() != 0 {
+		t.Fatalf("DualWriteErrors() v->%d", mg.DualWriteErrors())
+	}
+
+	// concurrent writes of a key leave the last value in the destination.
+	mg.EnableDualWrite()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src.Incr(m.GetKey("n"))
+		}()
+	}
+	wg.Wait()
+	mg.DisableDualWrite()
+	if v, _ := dst.Get(m.GetKey("n")).Result(); v != "20" {
+		t.Fatalf("dual write n v->%s", v)
+	}
+	src.Del(m.GetKey("n"))
+	dst.Del(m.GetKey("n"))
+
+	// the checksums do not depend on the encoding.
+	src.HSet(m.GetKey("h"), "f1", "v1")
+	src.HSet(m.GetKey("h"), "f2", "v2")
+	dst.HSet(m.GetKey("h"), "f2", "v2")
+	dst.HSet(m.GetKey("h"), "f1", "v1")
+	dst.Set(m.GetKey("b"), "6", 0)
+	check, err = mg.Verify(ctx)
+	if err != nil || !check.OK() || check.Checked != 4 || check.SrcChecksum != check.DstChecksum {
+		t.Fatalf("Verify() v->%+v, err->%v", check, err)
+	}
+
+	if err = mg.Reset(); err != nil {
+		t.Fatalf("Reset() err->%v", err)
+	}
+	if _, err = NewMigrator(src, dst, "test", nil).Run(ctx); err != ErrMigratorNoPrefix {
+		t.Fatalf("Run() without prefix err->%v", err)
+	}
+}
+
+// delOnDump deletes the key from the source once it is dumped.
+type delOnDump struct {
+	src  *Client
+	key  string
+	once sync.Once
+	done chan struct{}
+}
+
+func (h *delOnDump) BeforeProcess(cmd Cmder) {}
+
+func (h *delOnDump) AfterProcess(cmd Cmder, elapsed time.Duration) {}
+
+func (h *delOnDump) BeforeProcessPipeline(cmds []Cmder) {}
+
+func (h *delOnDump) AfterProcessPipeline(cmds []Cmder, elapsed time.Duration) {
+	for _, cmd := range cmds {
+		if cmd.Name() != "dump" || CmdKey(cmd) != h.key {
+			continue
+		}
+		h.once.Do(func() {
+			go func() {
+				defer close(h.done)
+				h.src.Del(h.key)
+			}()
+			// its dual write waits for the copy.
+			select {
+			case <-h.done:
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestMigratorDeleteDuringCopy(t *testing.T) {
+	src, _ := redistest.NewClient(t)
+	dst, _ := redistest.NewClient(t)
+	m := NewModule("ooz-test")
+	mg := NewMigrator(src, dst, "test", &MigratorOptions{
+		Prefixes: []string{m.GetPrefix()},
+	})
+	src.Set(m.GetKey("a"), "1", 0)
+	h := &delOnDump{src: src, key: m.GetKey("a"), done: make(chan struct{})}
+	src.AddHook(h)
+	mg.EnableDualWrite()
+	if _, err := mg.Run(context.Background()); err != nil {
+		t.Fatalf("Run() err->%v", err)
+	}
+	<-h.done
+	mg.DisableDualWrite()
+	if n := dst.Exists(m.GetKey("a")).Val(); n != 0 {
+		t.Fatalf("dst exists deleted key v->%d", n)
+	}
+}
@@ -0,0 +1,119 @@
+package redis
+
+import (
+	"fmt"
+	"time"
+)
+
+// pipelinedBySlot calls fn with the indexes of every slot group of the keys
+// in one pipeline. In cluster mode the pipeline is sent to the nodes in
+// parallel, so the commands of a group never fail with CROSSSLOT.
+func (c *Client) pipelinedBySlot(keys []string, fn func(p Pipeliner, group []int)) ([][]int, error) {
+	groups := c.groupBySlot(keys)
+	_, err := c.Pipelined(func(p Pipeliner) error {
+		for _, group := range groups {
+			fn(p, group)
+		}
+		return nil
+	})
+	return groups, err
+}
+
+// groupKeys returns the keys of the indexes.
+func groupKeys(keys []string, group []int) []string {
+	sub := make([]string, len(group))
+	for i, idx := range group {
+		sub[i] = keys[idx]
+	}
+	return sub
+}
+
+// MultiGet returns the values of the keys in order, nil if a key does not
+// exist, like MGET but with one MGET per hash slot in cluster mode. The
+// values of the slots loaded are returned along with the first error.
+func (c *Client) MultiGet(keys ...string) ([]interface{}, error) {
+	vals := make([]interface{}, len(keys))
+	if len(keys) == 0 {
+		return vals, nil
+	}
+	cmds := make([]*SliceCmd, 0, 1)
+	groups, _ := c.pipelinedBySlot(keys, func(p Pipeliner, group []int) {
+		cmds = append(cmds, p.MGet(groupKeys(keys, group)...))
+	})
+	var firstErr error
+	for i, group := range groups {
+		groupVals, err := cmds[i].Result()
+		if err == nil && len(groupVals) != len(group) {
+			err = fmt.Errorf("redis: unexpected mget reply length %d, want %d", len(groupVals), len(group))
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for j, idx := range group {
+			vals[idx] = groupVals[j]
+		}
+	}
+	return vals, firstErr
+}
+
+// MultiSet sets the values of the keys, by one MSET per hash slot in cluster
+// mode, or by SET of every key if expiration > 0. MultiSet is not atomic
+// across slots, the first error is returned.
+func (c *Client) MultiSet(values map[string]interface{}, expiration time.Duration) error {
+	if len(values) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	var cmds []Cmder
+	_, err := c.pipelinedBySlot(keys, func(p Pipeliner, group []int) {
+		if expiration > 0 {
+			for _, idx := range group {
+				cmds = append(cmds, p.Set(keys[idx], values[keys[idx]], expiration))
+			}
+			return
+		}
+		pairs := make([]interface{}, 0, 2*len(group))
+		for _, idx := range group {
+			pairs = append(pairs, keys[idx], values[keys[idx]])
+		}
+		cmds = append(cmds, p.MSet(pairs...))
+	})
+	for _, cmd := range cmds {
+		if cmd.Err() != nil {
+			return cmd.Err()
+		}
+	}
+	return err
+}
+
+// MultiDel deletes the keys by one DEL per hash slot in cluster mode, returns
+// the number of keys deleted along with the first error.
+func (c *Client) MultiDel(keys ...string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	cmds := make([]*IntCmd, 0, 1)
+	c.pipelinedBySlot(keys, func(p Pipeliner, group []int) {
+		cmds = append(cmds, p.Del(groupKeys(keys, group)...))
+	})
+	var (
+		n        int64
+		firstErr error
+	)
+	for _, cmd := range cmds {
+		if cmd.Err() != nil {
+			if firstErr == nil {
+				firstErr = cmd.Err()
+			}
+			continue
+		}
+		n += cmd.Val()
+	}
+	return n, firstErr
+}
@@ -0,0 +1,66 @@
+package redis_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestMultiKey(t *testing.T) {
+	s, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("redistest.NewServer() err->%v", err)
+	}
+	defer s.Close()
+	for _, cfg := range []*Config{
+		{
+			DeployType: "single",
+			ForSingle: SingleConfig{
+				Addr: s.Addr(),
+			},
+		},
+		{
+			DeployType: "cluster",
+			ForCluster: ClusterConfig{
+				Addrs: []string{s.Addr()},
+			},
+		},
+	} {
+		client, err := NewClient(cfg)
+		if err != nil {
+			t.Fatalf("new client err->%v", err)
+		}
+		var (
+			m    = NewModule("ooz-test-" + cfg.DeployType)
+			keys = []string{m.GetKey("{a}:1"), m.GetKey("{b}:1"), m.GetKey("{a}:2"), m.GetKey("{c}:1")}
+		)
+		err = client.MultiSet(map[string]interface{}{
+			keys[0]: "a1",
+			keys[1]: "b1",
+			keys[2]: "a2",
+		}, 0)
+		if err != nil {
+			t.Fatalf("%s: MultiSet() err->%v", cfg.DeployType, err)
+		}
+		if err = client.MultiSet(map[string]interface{}{keys[3]: "c1"}, time.Minute); err != nil {
+			t.Fatalf("%s: MultiSet() expiration err->%v", cfg.DeployType, err)
+		}
+		if ttl := client.TTL(keys[3]).Val(); ttl <= 0 {
+			t.Fatalf("%s: ttl v->%v", cfg.DeployType, ttl)
+		}
+		vals, err := client.MultiGet(append(keys, m.GetKey("none"))...)
+		if err != nil || len(vals) != 5 || vals[0] != "a1" || vals[1] != "b1" || vals[2] != "a2" || vals[3] != "c1" || vals[4] != nil {
+			t.Fatalf("%s: MultiGet() v->%v, err->%v", cfg.DeployType, vals, err)
+		}
+		n, err := client.MultiDel(append(keys, m.GetKey("none"))...)
+		if err != nil || n != 4 {
+			t.Fatalf("%s: MultiDel() v->%d, err->%v", cfg.DeployType, n, err)
+		}
+		if vals, err = client.MultiGet(); err != nil || len(vals) != 0 {
+			t.Fatalf("%s: MultiGet() empty v->%v, err->%v", cfg.DeployType, vals, err)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,42 @@
+package redis
+
+import (
+	"time"
+)
+
+// ObjectCodec returns the codec used by SetObject and GetObject.
+func (c *Client) ObjectCodec() *ObjectCodec {
+	return c.objCodec
+}
+
+// SetObjectCodec replaces the codec used by SetObject, the values written by
+// the previous codec can still be read.
+func (c *Client) SetObjectCodec(oc *ObjectCodec) *Client {
+	c.objCodec = oc
+	return c
+}
+
+// SetObject encodes value by the object codec and sets it.
+func (c *Client) SetObject(key string, value interface{}, expiration time.Duration) error {
+	data, err := c.objCodec.Encode(value)
+	if err != nil {
+		return err
+	}
+	return c.Set(key, data, expiration).Err()
+}
+
+// GetObjectTo gets key and decodes it into ptr, returns Nil if key does not exist.
+func (c *Client) GetObjectTo(key string, ptr interface{}) error {
+	data, err := c.Get(key).Bytes()
+	if err != nil {
+		return err
+	}
+	return c.objCodec.Decode(data, ptr)
+}
+
+// GetObject gets key and decodes it as T, returns Nil if key does not exist.
+func GetObject[T any](c *Client, key string) (T, error) {
+	var v T
+	err := c.GetObjectTo(key, &v)
+	return v, err
+}
@@ -0,0 +1,65 @@
+package redis_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+type oozObject struct {
+	Id   int64
+	Name string
+}
+
+func TestObjectCodec(t *testing.T) {
+	obj := &oozObject{Id: 1, Name: strings.Repeat("ooz", 1000)}
+	for _, codec := range []string{"json", "msgpack", "gob"} {
+		for _, compression := range []string{"", "snappy", "zstd"} {
+			oc, err := NewObjectCodec(ObjectConfig{Codec: codec, Compression: compression})
+			if err != nil {
+				t.Fatalf("NewObjectCodec(%s, %s) err->%v", codec, compression, err)
+			}
+			data, err := oc.Encode(obj)
+			if err != nil {
+				t.Fatalf("Encode(%s, %s) err->%v", codec, compression, err)
+			}
+			// decode by the default codec, the header decides.
+			var dest oozObject
+			if err = new(ObjectCodec).Decode(data, &dest); err != nil {
+				t.Fatalf("Decode(%s, %s) err->%v", codec, compression, err)
+			}
+			if dest != *obj {
+				t.Fatalf("Decode(%s, %s) unmatch object", codec, compression)
+			}
+		}
+	}
+	// plain json without header
+	var dest oozObject
+	if err := new(ObjectCodec).Decode([]byte(`{"Id":2,"Name":"ooz"}`), &dest); err != nil || dest.Id != 2 {
+		t.Fatalf("Decode(plain json) err->%v, dest->%+v", err, dest)
+	}
+}
+
+func TestObject(t *testing.T) {
+	client, _ := redistest.NewClient(t, &Config{
+		Object: ObjectConfig{
+			Codec:       "msgpack",
+			Compression: "snappy",
+		},
+	})
+	m := NewModule("ooz-test")
+	if err := client.SetObject(m.GetKey("ooz_object"), &oozObject{Id: 1, Name: "ooz"}, time.Second); err != nil {
+		t.Fatalf("c.SetObject() err-> %v", err)
+	}
+	obj, err := GetObject[oozObject](client, m.GetKey("ooz_object"))
+	if err != nil {
+		t.Fatalf("GetObject() err-> %v", err)
+	}
+	t.Logf("GetObject() result-> %+v", obj)
+	if _, err = GetObject[oozObject](client, m.GetKey("ooz_object_none")); !IsRedisNil(err) {
+		t.Fatalf("GetObject() want redis nil, have-> %v", err)
+	}
+}
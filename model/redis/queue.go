@@ -0,0 +1,473 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// Queue reliable work queue on redis lists.
+// Reserved jobs are moved atomically to a processing list with a visibility
+// deadline, jobs not acknowledged before the deadline are requeued by the
+// reaper, and moved to the dead-letter list after MaxAttempts.
+type Queue struct {
+	client *Client
+	opts   QueueOptions
+	name   string
+	// keys, all keys of a queue share the hash tag {name}.
+	pending    string
+	processing string
+	dead       string
+	deadlines  string
+	jobs       string
+	attempts   string
+}
+
+// QueueOptions queue options.
+type QueueOptions struct {
+	// A reserved job is requeued if not acknowledged within VisibilityTimeout.
+	// Default is 30 seconds.
+	VisibilityTimeout time.Duration
+	// Jobs failed MaxAttempts times are moved to the dead-letter list.
+	// Default is 3.
+	MaxAttempts int
+	// Frequency of polling when the queue is empty.
+	// Default is 100 milliseconds.
+	PollInterval time.Duration
+	// Frequency of requeueing the stalled jobs.
+	// Default is 1 second.
+	ReapInterval time.Duration
+	// Maximum number of stalled jobs requeued per reap.
+	// Default is 100.
+	ReapBatch int
+}
+
+// init sets the default options.
+func (o *QueueOptions) init() {
+	if o.VisibilityTimeout <= 0 {
+		o.VisibilityTimeout = 30 * time.Second
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 3
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = 100 * time.Millisecond
+	}
+	if o.ReapInterval <= 0 {
+		o.ReapInterval = time.Second
+	}
+	if o.ReapBatch <= 0 {
+		o.ReapBatch = 100
+	}
+}
+
+// Job queue job.
+type Job struct {
+	// ID unique job id.
+	ID string
+	// Payload job data.
+	Payload []byte
+	// Attempts number of times the job has been reserved, including this one.
+	Attempts int
+	queue    *Queue
+}
+
+// ErrJobNotFound the job is not reserved or already acknowledged.
+var ErrJobNotFound = errors.New("redis: queue job not found")
+
+var (
+	// KEYS: pending, processing, deadlines, jobs, attempts; ARGV: deadline
+	queueReserveScript = newLibScript("queue.reserve", `
+while true do
+	local id = redis.call('RPOPLPUSH', KEYS[1], KEYS[2])
+	if not id then
+		return false
+	end
+	local payload = redis.call('HGET', KEYS[4], id)
+	if payload then
+		redis.call('ZADD', KEYS[3], ARGV[1], id)
+		local attempts = redis.call('HINCRBY', KEYS[5], id, 1)
+		return {id, payload, attempts}
+	end
+	redis.call('LREM', KEYS[2], -1, id)
+end`)
+	// KEYS: processing, pending, deadlines, jobs, attempts; ARGV: id
+	queueAckScript = newLibScript("queue.ack", `
+local n = redis.call('LREM', KEYS[1], -1, ARGV[1]) + redis.call('LREM', KEYS[2], -1, ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('HDEL', KEYS[5], ARGV[1])
+return n`)
+	// KEYS: processing, pending, deadlines, dead, attempts; ARGV: id, max attempts
+	queueNackScript = newLibScript("queue.nack", `
+if redis.call('LREM', KEYS[1], -1, ARGV[1]) == 0 then
+	return -1
+end
+redis.call('ZREM', KEYS[3], ARGV[1])
+local attempts = tonumber(redis.call('HGET', KEYS[5], ARGV[1]) or '0')
+if attempts >= tonumber(ARGV[2]) then
+	redis.call('LPUSH', KEYS[4], ARGV[1])
+	return 1
+end
+redis.call('LPUSH', KEYS[2], ARGV[1])
+return 0`)
+	// KEYS: deadlines; ARGV: id, deadline
+	queueTouchScript = newLibScript("queue.touch", `
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1]) + 1
+end
+return 0`)
+	// KEYS: processing, pending, deadlines, dead, attempts; ARGV: now, max attempts, limit
+	queueReapScript = newLibScript("queue.reap", `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+local requeued, dead = 0, 0
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[3], id)
+	if redis.call('LREM', KEYS[1], -1, id) > 0 then
+		local attempts = tonumber(redis.call('HGET', KEYS[5], id) or '0')
+		if attempts >= tonumber(ARGV[2]) then
+			redis.call('LPUSH', KEYS[4], id)
+			dead = dead + 1
+		else
+			redis.call('LPUSH', KEYS[2], id)
+			requeued = requeued + 1
+		end
+	end
+end
+return {requeued, dead}`)
+	// KEYS: dead, pending, attempts; ARGV: limit
+	queueRequeueDeadScript = newLibScript("queue.requeue_dead", `
+local n = 0
+while n < tonumber(ARGV[1]) do
+	local id = redis.call('RPOPLPUSH', KEYS[1], KEYS[2])
+	if not id then
+		break
+	end
+	redis.call('HDEL', KEYS[3], id)
+	n = n + 1
+end
+return n`)
+)
+
+// NewQueue creates queue named name under the module.
+func NewQueue(c *Client, m *Module, name string, opts *QueueOptions) *Queue {
+	var o QueueOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	registerLibScripts(c, m, queueReserveScript, queueAckScript, queueNackScript, queueTouchScript,
+		queueReapScript, queueRequeueDeadScript)
+	return &Queue{
+		client:     c,
+		opts:       o,
+		name:       name,
+		pending:    hashTagKey(m, "queue:"+name, "pending"),
+		processing: hashTagKey(m, "queue:"+name, "processing"),
+		dead:       hashTagKey(m, "queue:"+name, "dead"),
+		deadlines:  hashTagKey(m, "queue:"+name, "deadlines"),
+		jobs:       hashTagKey(m, "queue:"+name, "jobs"),
+		attempts:   hashTagKey(m, "queue:"+name, "attempts"),
+	}
+}
+
+// Name returns queue name.
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// Push adds jobs to the tail of the queue, returns the job ids.
+func (q *Queue) Push(payloads ...[]byte) ([]string, error) {
+	if len(payloads) == 0 {
+		return nil, nil
+	}
+	var (
+		ids    = make([]string, len(payloads))
+		fields = make(map[string]interface{}, len(payloads))
+		values = make([]interface{}, len(payloads))
+	)
+	for i, payload := range payloads {
+		ids[i] = randomID()
+		fields[ids[i]] = payload
+		values[i] = ids[i]
+	}
+	_, err := q.client.TxPipelined(func(p Pipeliner) error {
+		p.HMSet(q.jobs, fields)
+		p.LPush(q.pending, values...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Reserve reserves the job at the head of the queue, waits up to timeout
+// for a job, returns Nil if there is still no job.
+func (q *Queue) Reserve(ctx context.Context, timeout time.Duration) (*Job, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		job, err := q.reserve()
+		if err == nil || !IsRedisNil(err) {
+			return job, err
+		}
+		wait := q.opts.PollInterval
+		if left := time.Until(deadline); left < wait {
+			wait = left
+		}
+		if wait <= 0 {
+			return nil, Nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// reserve reserves the job at the head of the queue, returns Nil if the queue is empty.
+func (q *Queue) reserve() (*Job, error) {
+	deadline := unixMilli(q.client.now().Add(q.opts.VisibilityTimeout))
+	r, err := queueReserveScript.Run(q.client,
+		[]string{q.pending, q.processing, q.deadlines, q.jobs, q.attempts}, deadline).Result()
+	if err != nil {
+		return nil, err
+	}
+	vals, ok := r.([]interface{})
+	if !ok || len(vals) != 3 {
+		return nil, fmt.Errorf("redis: unexpected queue reserve reply->%v", r)
+	}
+	id, _ := vals[0].(string)
+	payload, _ := vals[1].(string)
+	attempts, _ := vals[2].(int64)
+	return &Job{
+		ID:       id,
+		Payload:  []byte(payload),
+		Attempts: int(attempts),
+		queue:    q,
+	}, nil
+}
+
+// Ack acknowledges the job is done and deletes it.
+func (q *Queue) Ack(id string) error {
+	n, err := queueAckScript.Run(q.client,
+		[]string{q.processing, q.pending, q.deadlines, q.jobs, q.attempts}, id).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+// Nack reports the job failed, it is requeued or moved to the dead-letter
+// list if it has been attempted MaxAttempts times.
+func (q *Queue) Nack(id string) (dead bool, err error) {
+	n, err := queueNackScript.Run(q.client,
+		[]string{q.processing, q.pending, q.deadlines, q.dead, q.attempts}, id, q.opts.MaxAttempts).Int64()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 {
+		return false, ErrJobNotFound
+	}
+	return n == 1, nil
+}
+
+// Touch extends the visibility deadline of the reserved job by VisibilityTimeout.
+func (q *Queue) Touch(id string) error {
+	deadline := unixMilli(q.client.now().Add(q.opts.VisibilityTimeout))
+	n, err := queueTouchScript.Run(q.client, []string{q.deadlines}, id, deadline).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+// Reap requeues the jobs whose visibility deadline has passed, the jobs
+// attempted MaxAttempts times are moved to the dead-letter list.
+func (q *Queue) Reap() (requeued, dead int, err error) {
+	r, err := queueReapScript.Run(q.client,
+		[]string{q.processing, q.pending, q.deadlines, q.dead, q.attempts},
+		unixMilli(q.client.now()), q.opts.MaxAttempts, q.opts.ReapBatch).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	vals, ok := r.([]interface{})
+	if !ok || len(vals) != 2 {
+		return 0, 0, fmt.Errorf("redis: unexpected queue reap reply->%v", r)
+	}
+	n1, _ := vals[0].(int64)
+	n2, _ := vals[1].(int64)
+	return int(n1), int(n2), nil
+}
+
+// RunReaper reaps the stalled jobs every ReapInterval until ctx is done.
+func (q *Queue) RunReaper(ctx context.Context) {
+	ticker := time.NewTicker(q.opts.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, _, err := q.Reap(); err != nil {
+				ozlog.Errorf("Queue(%s).Reap(): %s", q.name, err.Error())
+			}
+		}
+	}
+}
+
+// Len returns the number of pending, processing and dead jobs.
+func (q *Queue) Len() (pending, processing, dead int64, err error) {
+	var cmds [3]*IntCmd
+	_, err = q.client.Pipelined(func(p Pipeliner) error {
+		cmds[0] = p.LLen(q.pending)
+		cmds[1] = p.LLen(q.processing)
+		cmds[2] = p.LLen(q.dead)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return cmds[0].Val(), cmds[1].Val(), cmds[2].Val(), nil
+}
+
+// DeadJobs returns up to count jobs of the dead-letter list, oldest first.
+func (q *Queue) DeadJobs(count int64) ([]*Job, error) {
+	ids, err := q.client.LRange(q.dead, -count, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	var (
+		payloads *SliceCmd
+		attempts *SliceCmd
+	)
+	_, err = q.client.Pipelined(func(p Pipeliner) error {
+		payloads = p.HMGet(q.jobs, ids...)
+		attempts = p.HMGet(q.attempts, ids...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(ids))
+	// the dead list is pushed at the head, reverse to oldest first.
+	for i := len(ids) - 1; i >= 0; i-- {
+		payload, _ := payloads.Val()[i].(string)
+		job := &Job{
+			ID:      ids[i],
+			Payload: []byte(payload),
+			queue:   q,
+		}
+		if s, ok := attempts.Val()[i].(string); ok {
+			fmt.Sscan(s, &job.Attempts)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// RequeueDead moves up to count oldest dead jobs back to the queue and resets their attempts.
+func (q *Queue) RequeueDead(count int) (int, error) {
+	n, err := queueRequeueDeadScript.Run(q.client, []string{q.dead, q.pending, q.attempts}, count).Int64()
+	return int(n), err
+}
+
+// Consume runs the reaper and concurrency workers that call handler for the
+// reserved jobs until ctx is done, then waits for the running handlers.
+// A job is acknowledged if handler returns nil, otherwise (or on panic) it is
+// nacked. The visibility deadline is extended while handler is running.
+func (q *Queue) Consume(ctx context.Context, concurrency int, handler func(*Job) error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(concurrency + 1)
+	go func() {
+		defer wg.Done()
+		q.RunReaper(ctx)
+	}()
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				job, err := q.Reserve(ctx, q.opts.ReapInterval)
+				if err != nil {
+					if !IsRedisNil(err) && ctx.Err() == nil {
+						ozlog.Errorf("Queue(%s).Reserve(): %s", q.name, err.Error())
+						time.Sleep(q.opts.PollInterval)
+					}
+					continue
+				}
+				q.handle(job, handler)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// handle calls handler for the job and acks or nacks it.
+func (q *Queue) handle(job *Job, handler func(*Job) error) {
+	var (
+		done = make(chan struct{})
+		err  error
+	)
+	go func() {
+		ticker := time.NewTicker(q.opts.VisibilityTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := job.Touch(); err != nil {
+					ozlog.Errorf("Queue(%s).Touch(%s): %s", q.name, job.ID, err.Error())
+				}
+			}
+		}
+	}()
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		err = handler(job)
+	}()
+	close(done)
+	if err == nil {
+		if err = job.Ack(); err != nil {
+			ozlog.Errorf("Queue(%s).Ack(%s): %s", q.name, job.ID, err.Error())
+		}
+		return
+	}
+	ozlog.Errorf("Queue(%s) job %s failed, attempts: %d, err: %s", q.name, job.ID, job.Attempts, err.Error())
+	if _, err = job.Nack(); err != nil {
+		ozlog.Errorf("Queue(%s).Nack(%s): %s", q.name, job.ID, err.Error())
+	}
+}
+
+// Ack acknowledges the job is done.
+func (j *Job) Ack() error {
+	return j.queue.Ack(j.ID)
+}
+
+// Nack reports the job failed.
+func (j *Job) Nack() (dead bool, err error) {
+	return j.queue.Nack(j.ID)
+}
+
+// Touch extends the visibility deadline of the job.
+func (j *Job) Touch() error {
+	return j.queue.Touch(j.ID)
+}
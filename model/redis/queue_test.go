@@ -0,0 +1,63 @@
+package redis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestQueue(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	m := NewModule("ooz-test")
+	q := NewQueue(client, m, "test_queue", &QueueOptions{
+		VisibilityTimeout: 100 * time.Millisecond,
+		MaxAttempts:       2,
+	})
+	ids, err := q.Push([]byte("job1"))
+	if err != nil {
+		t.Fatalf("q.Push() err->%v", err)
+	}
+	ctx := context.Background()
+	// attempt 1: failed
+	job, err := q.Reserve(ctx, time.Second)
+	if err != nil {
+		t.Fatalf("q.Reserve() err->%v", err)
+	}
+	if job.ID != ids[0] || string(job.Payload) != "job1" || job.Attempts != 1 {
+		t.Fatalf("q.Reserve() unexpected job->%+v", job)
+	}
+	if dead, err := job.Nack(); err != nil || dead {
+		t.Fatalf("job.Nack() dead->%v, err->%v", dead, err)
+	}
+	// attempt 2: stalled, dead after the visibility timeout
+	if job, err = q.Reserve(ctx, time.Second); err != nil || job.Attempts != 2 {
+		t.Fatalf("q.Reserve() job->%+v, err->%v", job, err)
+	}
+	srv.Advance(150 * time.Millisecond)
+	if requeued, dead, err := q.Reap(); err != nil || requeued != 0 || dead != 1 {
+		t.Fatalf("q.Reap() requeued->%d, dead->%d, err->%v", requeued, dead, err)
+	}
+	if _, err = q.Reserve(ctx, 50*time.Millisecond); !IsRedisNil(err) {
+		t.Fatalf("q.Reserve() want redis nil, have->%v", err)
+	}
+	if err = job.Ack(); err != ErrJobNotFound {
+		t.Fatalf("job.Ack() want ErrJobNotFound, have->%v", err)
+	}
+	// requeue dead and consume
+	if n, err := q.RequeueDead(10); err != nil || n != 1 {
+		t.Fatalf("q.RequeueDead() n->%d, err->%v", n, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	q.Consume(ctx, 2, func(job *Job) error {
+		cancel()
+		return nil
+	})
+	pending, processing, dead, err := q.Len()
+	if err != nil || pending+processing+dead != 0 {
+		t.Fatalf("q.Len() pending->%d, processing->%d, dead->%d, err->%v", pending, processing, dead, err)
+	}
+}
@@ -0,0 +1,102 @@
+// Package redistest in-memory redis server behind redis.Client for the
+// hermetic unit tests, backed by miniredis. It covers strings, TTL expiry,
+// SETNX, hashes, lists, sorted sets, pub/sub, pipelines and lua scripts.
+//
+// The server time is also the clock of its clients, so the tests Advance it
+// instead of sleeping until the TTLs, leases and deadlines expire.
+package redistest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/internal/testhook"
+)
+
+// Server in-memory redis server with controllable time, it is the clock
+// of the clients created by NewClient.
+type Server struct {
+	*miniredis.Miniredis
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewServer starts in-memory redis server on a random local port.
+func NewServer() (*Server, error) {
+	m, err := miniredis.Run()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Miniredis: m,
+		now:       time.Now().Truncate(time.Microsecond),
+	}
+	m.SetTime(s.now)
+	return s, nil
+}
+
+// NewClient creates client connected to the server with the server clock,
+// cfg is optional and its deploy type and address are overwritten.
+func (s *Server) NewClient(cfg ...*redis.Config) (*redis.Client, error) {
+	var c redis.Config
+	if len(cfg) > 0 && cfg[0] != nil {
+		c = *cfg[0]
+	}
+	c.DeployType = redis.DeploySingle
+	c.ForSingle.Addr = s.Addr()
+	client, err := redis.NewClient(&c)
+	if err != nil {
+		return nil, err
+	}
+	testhook.SetClock(client, s.Now)
+	return client, nil
+}
+
+// Now returns the server time.
+func (s *Server) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Advance moves the server time and the clock of the clients forward by d,
+// the keys whose TTL elapsed expire.
+func (s *Server) Advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+	s.Miniredis.SetTime(s.now)
+	s.Miniredis.FastForward(d)
+}
+
+// SetTime sets the server time returned by TIME(microsecond precision), it
+// does not expire keys, use Advance to do so.
+func (s *Server) SetTime(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = t.Truncate(time.Microsecond)
+	s.Miniredis.SetTime(s.now)
+}
+
+// NewClient starts in-memory server and returns client connected to it, both
+// are closed when the test finishes.
+func NewClient(tb testing.TB, cfg ...*redis.Config) (*redis.Client, *Server) {
+	tb.Helper()
+	s, err := NewServer()
+	if err != nil {
+		tb.Fatalf("redistest: start server err->%v", err)
+	}
+	c, err := s.NewClient(cfg...)
+	if err != nil {
+		s.Close()
+		tb.Fatalf("redistest: new client err->%v", err)
+	}
+	tb.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c, s
+}
@@ -0,0 +1,57 @@
+package redistest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/usthooz/oozkits/model/redis"
+)
+
+func TestClient(t *testing.T) {
+	client, s := NewClient(t)
+	m := redis.NewModule("ooz-test")
+	// strings, ttl and setnx.
+	if err := client.Set(m.GetKey("k"), "v", time.Minute).Err(); err != nil {
+		t.Fatalf("client.Set() err->%v", err)
+	}
+	if ok, err := client.SetNX(m.GetKey("k"), "v2", 0).Result(); err != nil || ok {
+		t.Fatalf("client.SetNX() ok->%v, err->%v", ok, err)
+	}
+	s.Advance(time.Minute)
+	if _, err := client.Get(m.GetKey("k")).Result(); !redis.IsRedisNil(err) {
+		t.Fatalf("client.Get() after expiry err->%v", err)
+	}
+	if now, err := client.Time().Result(); err != nil || !now.Equal(s.Now()) {
+		t.Fatalf("client.Time()->%v, want %v, err->%v", now, s.Now(), err)
+	}
+	// hashes, lists and sorted sets in one pipeline.
+	cmds, err := client.Pipelined(func(p redis.Pipeliner) error {
+		p.HSet(m.GetKey("h"), "f", 1)
+		p.RPush(m.GetKey("l"), "a", "b")
+		p.ZAdd(m.GetKey("z"), redis.Z{Score: 2, Member: "b"}, redis.Z{Score: 1, Member: "a"})
+		return nil
+	})
+	if err != nil || len(cmds) != 3 {
+		t.Fatalf("client.Pipelined() cmds->%d, err->%v", len(cmds), err)
+	}
+	if v, err := client.HGet(m.GetKey("h"), "f").Result(); err != nil || v != "1" {
+		t.Fatalf("client.HGet() v->%s, err->%v", v, err)
+	}
+	if v, err := client.LPop(m.GetKey("l")).Result(); err != nil || v != "a" {
+		t.Fatalf("client.LPop() v->%s, err->%v", v, err)
+	}
+	if v, err := client.ZRange(m.GetKey("z"), 0, -1).Result(); err != nil || len(v) != 2 || v[0] != "a" {
+		t.Fatalf("client.ZRange() v->%v, err->%v", v, err)
+	}
+	// pub/sub.
+	ps := client.Subscribe(m.GetKey("channel"))
+	defer ps.Close()
+	if _, err = ps.Receive(); err != nil {
+		t.Fatalf("ps.Receive() err->%v", err)
+	}
+	client.Publish(m.GetKey("channel"), "hello")
+	msg, err := ps.ReceiveMessage()
+	if err != nil || msg.Payload != "hello" {
+		t.Fatalf("ps.ReceiveMessage() msg->%v, err->%v", msg, err)
+	}
+}
@@ -0,0 +1,206 @@
+package redis
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// ErrRememberEntry returned when a remembered value is not a Remember entry.
+var ErrRememberEntry = errors.New("redis: invalid remember entry")
+
+// rememberVersion first byte of a remember entry.
+const rememberVersion = 1
+
+// rememberHeaderLen version, expire at unix ms and load duration ms.
+const rememberHeaderLen = 1 + 8 + 8
+
+// RememberOptions remember options.
+type RememberOptions struct {
+	// Beta of the probabilistic early refresh(XFetch), the value is refreshed
+	// in background before ttl with a probability growing with the load
+	// duration and Beta, negative disables it.
+	// Default is 1.
+	Beta float64
+	// The value is kept StaleTTL after ttl and returned if the loader fails,
+	// negative disables it.
+	// Default is ttl.
+	StaleTTL time.Duration
+}
+
+// init sets the default options.
+func (o *RememberOptions) init(ttl time.Duration) {
+	if o.Beta == 0 {
+		o.Beta = 1
+	}
+	if o.StaleTTL == 0 {
+		o.StaleTTL = ttl
+	}
+	if o.StaleTTL < 0 {
+		o.StaleTTL = 0
+	}
+}
+
+// Remember returns the value of key, or loads it by loader and sets it for
+// ttl if it does not exist, see RememberWith.
+func Remember[T any](ctx context.Context, c *Client, key string, ttl time.Duration, loader func(context.Context) (T, error)) (T, error) {
+	return RememberWith(ctx, c, key, ttl, nil, loader)
+}
+
+// RememberWith returns the value of key, or loads it by loader and sets it for
+// ttl encoded by the object codec. The concurrent loads of the same key in
+// the process are coalesced. A value about to expire is refreshed early in
+// background, an expired value is returned if the loader fails within
+// StaleTTL. The loader is called directly if redis is unavailable.
+func RememberWith[T any](ctx context.Context, c *Client, key string, ttl time.Duration, opts *RememberOptions, loader func(context.Context) (T, error)) (T, error) {
+	var (
+		o    RememberOptions
+		zero T
+	)
+	if opts != nil {
+		o = *opts
+	}
+	o.init(ttl)
+	if c.CacheBypassed() {
+		return loader(ctx)
+	}
+	// the load is shared by the callers, it is not canceled with ctx.
+	load := func() ([]byte, error) {
+		return rememberLoad(context.WithoutCancel(ctx), c, key, ttl, o, loader)
+	}
+	data, err := c.Get(key).Bytes()
+	if err != nil && !IsRedisNil(err) {
+		ozlog.Warnf("Remember(): get %s: %s", key, err.Error())
+		return loader(ctx)
+	}
+	if err == nil {
+		var (
+			v                T
+			expireAt, loaded time.Duration
+		)
+		expireAt, loaded, err = decodeRemember(c, data, &v)
+		if err == nil {
+			now := time.Duration(unixMilli(c.now())) * time.Millisecond
+			if now < expireAt {
+				if o.Beta > 0 && now-time.Duration(float64(loaded)*o.Beta*math.Log(1-rand.Float64())) >= expireAt {
+					c.flight.start(key, load)
+				}
+				return v, nil
+			}
+			// stale
+			data, err = c.flight.wait(ctx, key, load)
+			if err != nil {
+				ozlog.Warnf("Remember(): serve stale %s: %s", key, err.Error())
+				return v, nil
+			}
+		} else {
+			ozlog.Warnf("Remember(): decode %s: %s", key, err.Error())
+			if data, err = c.flight.wait(ctx, key, load); err != nil {
+				return zero, err
+			}
+		}
+	} else if data, err = c.flight.wait(ctx, key, load); err != nil {
+		return zero, err
+	}
+	var v T
+	if _, _, err = decodeRemember(c, data, &v); err != nil {
+		return zero, err
+	}
+	return v, nil
+}
+
+// rememberLoad calls loader and sets the entry of the value, returns the entry.
+func rememberLoad[T any](ctx context.Context, c *Client, key string, ttl time.Duration, o RememberOptions, loader func(context.Context) (T, error)) ([]byte, error) {
+	start := time.Now()
+	v, err := loader(ctx)
+	// the load duration is measured by the system clock.
+	loaded := time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := c.objCodec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	now := c.now()
+	data := make([]byte, rememberHeaderLen, rememberHeaderLen+len(payload))
+	data[0] = rememberVersion
+	binary.BigEndian.PutUint64(data[1:], uint64(unixMilli(now.Add(ttl))))
+	binary.BigEndian.PutUint64(data[9:], uint64(loaded/time.Millisecond))
+	data = append(data, payload...)
+	if err = c.Set(key, data, ttl+o.StaleTTL).Err(); err != nil {
+		// the value is still returned.
+		ozlog.Errorf("Remember(): set %s: %s", key, err.Error())
+	}
+	return data, nil
+}
+
+// decodeRemember decodes the entry into ptr, returns the expire time and the
+// load duration of the value.
+func decodeRemember(c *Client, data []byte, ptr interface{}) (expireAt, loaded time.Duration, err error) {
+	if len(data) < rememberHeaderLen || data[0] != rememberVersion {
+		return 0, 0, ErrRememberEntry
+	}
+	expireAt = time.Duration(binary.BigEndian.Uint64(data[1:])) * time.Millisecond
+	loaded = time.Duration(binary.BigEndian.Uint64(data[9:])) * time.Millisecond
+	return expireAt, loaded, c.objCodec.Decode(data[rememberHeaderLen:], ptr)
+}
+
+// flightCall in-flight or completed call.
+type flightCall struct {
+	done chan struct{}
+	val  []byte
+	err  error
+}
+
+// flightGroup coalesces the concurrent calls of the same key.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// wait calls fn once for the concurrent callers of key, returns early when
+// ctx is done while fn keeps running.
+func (g *flightGroup) wait(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, error) {
+	call := g.start(key, fn)
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// start returns the call of key, calls fn in a new goroutine if none.
+func (g *flightGroup) start(key string, fn func() ([]byte, error)) *flightCall {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				call.err = fmt.Errorf("redis: loader of %s panic: %v", key, r)
+			}
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+		call.val, call.err = fn()
+	}()
+	return call
+}
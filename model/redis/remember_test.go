@@ -0,0 +1,98 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestRemember(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	type report struct {
+		Total int
+		Names []string
+	}
+	var (
+		ctx   = context.Background()
+		m     = NewModule("ooz-test")
+		key   = m.GetKey("report")
+		calls int32
+		fail  int32
+	)
+	defer client.Del(key)
+	loader := func(ctx context.Context) (*report, error) {
+		n := atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil, errors.New("db down")
+		}
+		return &report{Total: int(n), Names: []string{"a"}}, nil
+	}
+
+	// concurrent misses are loaded once.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := RememberWith(ctx, client, key, 200*time.Millisecond, &RememberOptions{Beta: -1}, loader)
+			if err != nil || r.Total != 1 {
+				t.Errorf("RememberWith() v->%+v, err->%v", r, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("loader calls->%d", calls)
+	}
+	r, err := Remember(ctx, client, key, 200*time.Millisecond, loader)
+	if err != nil || r.Total != 1 || len(r.Names) != 1 {
+		t.Fatalf("Remember() hit v->%+v, err->%v", r, err)
+	}
+
+	// stale value is served when the loader fails.
+	srv.Advance(250 * time.Millisecond)
+	atomic.StoreInt32(&fail, 1)
+	r, err = Remember(ctx, client, key, 200*time.Millisecond, loader)
+	if err != nil || r.Total != 1 || calls != 2 {
+		t.Fatalf("Remember() stale v->%+v, calls->%d, err->%v", r, calls, err)
+	}
+	atomic.StoreInt32(&fail, 0)
+	r, err = Remember(ctx, client, key, time.Hour, loader)
+	if err != nil || r.Total != 3 {
+		t.Fatalf("Remember() reload v->%+v, err->%v", r, err)
+	}
+
+	// early refresh in background, the current value is returned.
+	r, err = RememberWith(ctx, client, key, time.Hour, &RememberOptions{Beta: 1e9}, loader)
+	if err != nil || r.Total != 3 {
+		t.Fatalf("RememberWith() early v->%+v, err->%v", r, err)
+	}
+	// wait for the refreshed value.
+	for i := 0; ; i++ {
+		r, err = RememberWith(ctx, client, key, time.Hour, &RememberOptions{Beta: -1}, loader)
+		if err != nil || r.Total == 4 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("RememberWith() refreshed v->%+v", r)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err != nil || calls != 4 {
+		t.Fatalf("RememberWith() refreshed calls->%d, err->%v", calls, err)
+	}
+
+	// miss with a failing loader.
+	atomic.StoreInt32(&fail, 1)
+	client.Del(key)
+	if _, err = Remember(ctx, client, key, time.Hour, loader); err == nil || err.Error() != "db down" {
+		t.Fatalf("Remember() failing err->%v", err)
+	}
+}
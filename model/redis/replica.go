@@ -0,0 +1,170 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// replica routing, SingleConfig.ReplicaRouting
+const (
+	ReplicaRoundRobin = "round_robin"
+	ReplicaLatency    = "latency"
+)
+
+// readOnlyCommands the commands sent to the replicas. The SCAN family is not
+// included since a cursor must stay on one node.
+var readOnlyCommands = map[string]bool{
+	"get": true, "mget": true, "strlen": true, "getrange": true, "getbit": true,
+	"bitcount": true, "bitpos": true, "exists": true, "ttl": true, "pttl": true,
+	"type": true, "dump": true,
+	"hget": true, "hmget": true, "hgetall": true, "hkeys": true, "hvals": true,
+	"hlen": true, "hexists": true, "hstrlen": true,
+	"lrange": true, "lindex": true, "llen": true,
+	"scard": true, "smembers": true, "sismember": true, "srandmember": true,
+	"sunion": true, "sinter": true, "sdiff": true,
+	"zrange": true, "zrangebyscore": true, "zrevrange": true, "zrevrangebyscore": true,
+	"zrangebylex": true, "zrevrangebylex": true, "zscore": true, "zcard": true,
+	"zcount": true, "zlexcount": true, "zrank": true, "zrevrank": true,
+	"pfcount": true, "geopos": true, "geodist": true, "geohash": true,
+	"georadius_ro": true, "georadiusbymember_ro": true,
+	"xrange": true, "xrevrange": true, "xlen": true,
+}
+
+// replicaRouter picks the replica of a read-only command.
+type replicaRouter struct {
+	replicas []*redis.Client
+	latency  bool
+	next     uint64
+	// moving average of the command latency of every replica, nanosecond.
+	ewma []int64
+}
+
+// replicaFailurePenalty added to the latency of a replica on failure.
+const replicaFailurePenalty = int64(time.Second)
+
+// newSingleNode creates redis client of a single node.
+func (c *Client) newSingleNode(addr string) *redis.Client {
+	cfg := c.cfg
+	client := redis.NewClient(&redis.Options{
+		Addr:               addr,
+		Password:           cfg.Password,
+		MaxRetries:         cfg.MaxRetries,
+		PoolSize:           cfg.PoolSizePerNode,
+		MaxRetryBackoff:    time.Duration(cfg.ForSingle.MaxRetryBackoff) * time.Second,
+		DialTimeout:        time.Duration(cfg.DialTimeout) * time.Second,
+		ReadTimeout:        time.Duration(cfg.ReadTimeout) * time.Second,
+		WriteTimeout:       time.Duration(cfg.WriteTimeout) * time.Second,
+		PoolTimeout:        time.Duration(cfg.PoolTimeout) * time.Second,
+		IdleTimeout:        time.Duration(cfg.IdleTimeout) * time.Second,
+		IdleCheckFrequency: time.Duration(cfg.IdleCheckFrequency) * time.Second,
+	})
+	if c.breaker != nil {
+		client.SetLimiter(c.breaker)
+	}
+	return client
+}
+
+// routeReplicas sends the read-only commands of master to the replicas, the
+// pipelines and transactions are sent to master. The hooks wrap the routing,
+// so they run once per command even if a replica read falls back to master.
+func (c *Client) routeReplicas(master *redis.Client) error {
+	cfg := c.cfg.ForSingle
+	router := &replicaRouter{}
+	switch cfg.ReplicaRouting {
+	case "", ReplicaRoundRobin:
+	case ReplicaLatency:
+		router.latency = true
+	default:
+		return fmt.Errorf("SingleConfig.ReplicaRouting: optionals-> %s, %s", ReplicaRoundRobin, ReplicaLatency)
+	}
+	for _, addr := range cfg.ReplicaAddrs {
+		replica := c.newSingleNode(addr)
+		router.replicas = append(router.replicas, replica)
+	}
+	router.ewma = make([]int64, len(router.replicas))
+	c.replicas = router.replicas
+	// shares the connection pool, without routing.
+	direct := master.WithContext(context.Background())
+	c.wrapProcess(direct)
+	c.master = &Client{
+		cfg:      c.cfg,
+		Cmdable:  direct,
+		objCodec: c.objCodec,
+		breaker:  c.breaker,
+		parent:   c,
+	}
+	master.WrapProcess(func(oldProcess func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			if !readOnlyCommands[cmd.Name()] {
+				return oldProcess(cmd)
+			}
+			i := router.pick()
+			start := time.Now()
+			err := router.replicas[i].Process(cmd)
+			if isBreakerFailure(err) {
+				router.observe(i, replicaFailurePenalty)
+				// the replica is down, read master.
+				return oldProcess(cmd)
+			}
+			router.observe(i, int64(time.Since(start)))
+			return err
+		}
+	})
+	c.wrapProcess(master)
+	c.Cmdable = master
+	return nil
+}
+
+// pick returns the index of the replica.
+func (r *replicaRouter) pick() int {
+	n := atomic.AddUint64(&r.next, 1)
+	// probe the others now and then to refresh their latency.
+	if !r.latency || n%16 == 0 {
+		return int(n % uint64(len(r.replicas)))
+	}
+	best := rand.Intn(len(r.replicas))
+	for i := range r.ewma {
+		if atomic.LoadInt64(&r.ewma[i]) < atomic.LoadInt64(&r.ewma[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// observe updates the latency of the replica.
+func (r *replicaRouter) observe(i int, latency int64) {
+	if !r.latency {
+		return
+	}
+	old := atomic.LoadInt64(&r.ewma[i])
+	if old == 0 {
+		old = latency
+	}
+	atomic.StoreInt64(&r.ewma[i], old+(latency-old)/8)
+}
+
+// Master returns the client that sends all commands to master, .e.g. to read
+// your own writes. It shares the connections and hooks of c, AddHook on it
+// adds the hooks to c, and it is c itself if there are no replicas.
+func (c *Client) Master() *Client {
+	if c.master == nil {
+		return c
+	}
+	return c.master
+}
+
+// Close closes the client and the replica clients.
+func (c *Client) Close() error {
+	err := c.Cmdable.Close()
+	for _, replica := range c.replicas {
+		if e := replica.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package redis_test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestReplicaRouting(t *testing.T) {
+	var replicas []*miniredis.Miniredis
+	for i := 0; i < 2; i++ {
+		r, err := miniredis.Run()
+		if err != nil {
+			t.Fatalf("miniredis.Run() err->%v", err)
+		}
+		defer r.Close()
+		replicas = append(replicas, r)
+	}
+	for _, routing := range []string{ReplicaRoundRobin, ReplicaLatency} {
+		client, _ := redistest.NewClient(t, &Config{
+			ForSingle: SingleConfig{
+				ReplicaAddrs:   []string{replicas[0].Addr(), replicas[1].Addr()},
+				ReplicaRouting: routing,
+			},
+		})
+		var (
+			m   = NewModule("ooz-test")
+			key = m.GetKey("replica")
+		)
+		// the replicas are not replicating, so the source of a read is visible.
+		replicas[0].Set(key, "replica")
+		replicas[1].Set(key, "replica")
+		if err := client.Set(key, "master", 0).Err(); err != nil {
+			t.Fatalf("client.Set() err->%v", err)
+		}
+		for i := 0; i < 4; i++ {
+			if v, err := client.Get(key).Result(); err != nil || v != "replica" {
+				t.Fatalf("%s: client.Get() v->%s, err->%v", routing, v, err)
+			}
+		}
+		if v, err := client.Master().Get(key).Result(); err != nil || v != "master" {
+			t.Fatalf("%s: client.Master().Get() v->%s, err->%v", routing, v, err)
+		}
+		client.Master().Del(key)
+		client.Close()
+	}
+	// a replica down, read master.
+	client, _ := redistest.NewClient(t, &Config{
+		ForSingle: SingleConfig{
+			ReplicaAddrs: []string{"127.0.0.1:1"},
+		},
+	})
+	defer client.Close()
+	key := NewModule("ooz-test").GetKey("replica")
+	client.Set(key, "master", 0)
+	defer client.Del(key)
+	// the hooks run once for a read falling back to master.
+	hook := &countHook{}
+	client.AddHook(hook)
+	if v, err := client.Get(key).Result(); err != nil || v != "master" {
+		t.Fatalf("client.Get() with replica down v->%s, err->%v", v, err)
+	}
+	if n := atomic.LoadInt32(&hook.cmds); n != 1 {
+		t.Fatalf("hook cmds->%d, want 1", n)
+	}
+	// Master() shares the hooks.
+	masterHook := &countHook{}
+	client.Master().AddHook(masterHook)
+	client.Master().Get(key)
+	client.Get(key)
+	if n := atomic.LoadInt32(&masterHook.cmds); n != 2 {
+		t.Fatalf("master hook cmds->%d, want 2", n)
+	}
+	if n := atomic.LoadInt32(&hook.cmds); n != 3 {
+		t.Fatalf("hook cmds->%d, want 3", n)
+	}
+}
@@ -0,0 +1,286 @@
+package redis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// ScriptRegistry lua scripts loaded once and called by EVALSHA, the scripts
+// are reloaded on every master when a node replies NOSCRIPT, .e.g. after a
+// restart or failover.
+type ScriptRegistry struct {
+	client  *Client
+	mu      sync.RWMutex
+	scripts map[string]*RegisteredScript
+}
+
+// RegisteredScript lua script of the registry.
+type RegisteredScript struct {
+	registry *ScriptRegistry
+	name     string
+	src      string
+	hash     string
+	// the keys must be under one of the modules, any key if empty.
+	modules []*Module
+}
+
+// libScript lua script of the package, the constructors register it in the
+// script registry of the client with the module of the keys.
+type libScript struct {
+	name string
+	src  string
+}
+
+// newLibScript creates lua script of the package named name.
+func newLibScript(name, src string) *libScript {
+	return &libScript{
+		name: "oozkits." + name,
+		src:  src,
+	}
+}
+
+// registerLibScripts registers the scripts in the registry of c, the keys
+// must be under the module.
+func registerLibScripts(c *Client, m *Module, scripts ...*libScript) {
+	r := c.Scripts()
+	for _, s := range scripts {
+		r.MustRegister(s.name, s.src, m)
+	}
+}
+
+// Run runs the script registered in the registry of c.
+func (s *libScript) Run(c *Client, keys []string, args ...interface{}) *ScriptCmd {
+	return c.Scripts().Run(s.name, keys, args...)
+}
+
+// ScriptCmd result of a registered script.
+type ScriptCmd struct {
+	cmd *Cmd
+	err error
+}
+
+// Scripts returns the script registry of the client.
+func (c *Client) Scripts() *ScriptRegistry {
+	c.scriptsOnce.Do(func() {
+		c.scripts = &ScriptRegistry{
+			client:  c,
+			scripts: make(map[string]*RegisteredScript),
+		}
+	})
+	return c.scripts
+}
+
+// ForEachMaster calls fn for the client in single mode, or concurrently for
+// every master node in cluster mode.
+func (c *Client) ForEachMaster(fn func(node Cmdable) error) error {
+	if cluster, ok := c.Cmdable.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(node *redis.Client) error {
+			return fn(node)
+		})
+	}
+	return fn(c.Cmdable)
+}
+
+// Register registers the script by name, the keys passed to the script must
+// be under one of the modules if any. Registering the same name and source
+// again adds the modules, with a different source it is an error.
+func (r *ScriptRegistry) Register(name, src string, modules ...*Module) (*RegisteredScript, error) {
+	h := sha1.Sum([]byte(src))
+	s := &RegisteredScript{
+		registry: r,
+		name:     name,
+		src:      src,
+		hash:     hex.EncodeToString(h[:]),
+		modules:  modules,
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.scripts[name]; ok {
+		if old.hash != s.hash {
+			return nil, fmt.Errorf("redis: script %s is already registered with a different source", name)
+		}
+		old.addModules(modules)
+		return old, nil
+	}
+	r.scripts[name] = s
+	return s, nil
+}
+
+// MustRegister is like Register but panics on error.
+func (r *ScriptRegistry) MustRegister(name, src string, modules ...*Module) *RegisteredScript {
+	s, err := r.Register(name, src, modules...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Get returns the script by name.
+func (r *ScriptRegistry) Get(name string) (*RegisteredScript, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.scripts[name]
+	return s, ok
+}
+
+// Run runs the script by name.
+func (r *ScriptRegistry) Run(name string, keys []string, args ...interface{}) *ScriptCmd {
+	s, ok := r.Get(name)
+	if !ok {
+		return &ScriptCmd{err: fmt.Errorf("redis: script %s is not registered", name)}
+	}
+	return s.Run(keys, args...)
+}
+
+// Load loads all scripts on every master, it is optional since the scripts
+// are loaded on the first NOSCRIPT reply.
+func (r *ScriptRegistry) Load() error {
+	r.mu.RLock()
+	scripts := make([]*RegisteredScript, 0, len(r.scripts))
+	for _, s := range r.scripts {
+		scripts = append(scripts, s)
+	}
+	r.mu.RUnlock()
+	return r.client.ForEachMaster(func(node Cmdable) error {
+		for _, s := range scripts {
+			if err := node.ScriptLoad(s.src).Err(); err != nil {
+				return fmt.Errorf("redis: load script %s err->%v", s.name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Name returns the script name.
+func (s *RegisteredScript) Name() string {
+	return s.name
+}
+
+// Hash returns the sha1 of the script.
+func (s *RegisteredScript) Hash() string {
+	return s.hash
+}
+
+// Load loads the script on every master.
+func (s *RegisteredScript) Load() error {
+	return s.registry.client.ForEachMaster(func(node Cmdable) error {
+		return node.ScriptLoad(s.src).Err()
+	})
+}
+
+// Run calls the script by EVALSHA, reloads it on NOSCRIPT and retries.
+func (s *RegisteredScript) Run(keys []string, args ...interface{}) *ScriptCmd {
+	if err := s.checkKeys(keys); err != nil {
+		return &ScriptCmd{err: err}
+	}
+	c := s.registry.client
+	cmd := c.EvalSha(s.hash, keys, args...)
+	if err := cmd.Err(); err == nil || !strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+		return &ScriptCmd{cmd: cmd}
+	}
+	if err := s.Load(); err != nil {
+		return &ScriptCmd{err: err}
+	}
+	return &ScriptCmd{cmd: c.EvalSha(s.hash, keys, args...)}
+}
+
+// addModules adds the modules of the keys, no module allows any key.
+// The caller holds the registry lock.
+func (s *RegisteredScript) addModules(modules []*Module) {
+	if len(s.modules) == 0 {
+		return
+	}
+	if len(modules) == 0 {
+		s.modules = nil
+		return
+	}
+NEXT:
+	for _, m := range modules {
+		for _, old := range s.modules {
+			if old.GetPrefix() == m.GetPrefix() {
+				continue NEXT
+			}
+		}
+		s.modules = append(s.modules, m)
+	}
+}
+
+// checkKeys checks the keys are under the modules.
+func (s *RegisteredScript) checkKeys(keys []string) error {
+	s.registry.mu.RLock()
+	defer s.registry.mu.RUnlock()
+	if len(s.modules) == 0 {
+		return nil
+	}
+NEXT:
+	for _, key := range keys {
+		for _, m := range s.modules {
+			if strings.HasPrefix(key, m.GetPrefix()) {
+				continue NEXT
+			}
+		}
+		return fmt.Errorf("redis: script %s key %s is not under its modules", s.name, key)
+	}
+	return nil
+}
+
+// Err returns the error of the script.
+func (c *ScriptCmd) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.cmd.Err()
+}
+
+// Val returns the reply of the script.
+func (c *ScriptCmd) Val() interface{} {
+	if c.err != nil {
+		return nil
+	}
+	return c.cmd.Val()
+}
+
+// Result returns the reply and error of the script.
+func (c *ScriptCmd) Result() (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.cmd.Result()
+}
+
+// String returns the reply as string.
+func (c *ScriptCmd) String() (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	return c.cmd.String()
+}
+
+// Int64 returns the reply as int64.
+func (c *ScriptCmd) Int64() (int64, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.cmd.Int64()
+}
+
+// Float64 returns the reply as float64.
+func (c *ScriptCmd) Float64() (float64, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.cmd.Float64()
+}
+
+// Bool returns the reply as bool.
+func (c *ScriptCmd) Bool() (bool, error) {
+	if c.err != nil {
+		return false, c.err
+	}
+	return c.cmd.Bool()
+}
@@ -0,0 +1,57 @@
+package redis_test
+
+import (
+	"testing"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestScriptRegistry(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	var (
+		m    = NewModule("ooz-test")
+		name = "test_incr"
+		src  = `return redis.call('INCRBY', KEYS[1], ARGV[1])`
+		key  = m.GetKey(name)
+	)
+	s, err := client.Scripts().Register(name, src, m)
+	if err != nil {
+		t.Fatalf("Register() err->%v", err)
+	}
+	if _, err = client.Scripts().Register(name, src+" "); err == nil {
+		t.Fatal("Register() with different source err->nil")
+	}
+	if n, err := s.Run([]string{key}, 2).Int64(); err != nil || n != 2 {
+		t.Fatalf("s.Run() n->%d, err->%v", n, err)
+	}
+	// reloaded after the script cache is flushed.
+	if err = client.ScriptFlush().Err(); err != nil {
+		t.Fatalf("client.ScriptFlush() err->%v", err)
+	}
+	if n, err := client.Scripts().Run(name, []string{key}, 3).Int64(); err != nil || n != 5 {
+		t.Fatalf("Scripts().Run() n->%d, err->%v", n, err)
+	}
+	if exists, err := client.ScriptExists(s.Hash()).Result(); err != nil || !exists[0] {
+		t.Fatalf("client.ScriptExists() exists->%v, err->%v", exists, err)
+	}
+	// keys outside the module are rejected.
+	if err = s.Run([]string{"other:" + name}, 1).Err(); err == nil {
+		t.Fatal("s.Run() with foreign key err->nil")
+	}
+	if err = client.Scripts().Run("unknown_"+name, nil).Err(); err == nil {
+		t.Fatal("Scripts().Run() unknown script err->nil")
+	}
+	// registering again adds the module.
+	var (
+		m2   = NewModule("ooz-test-2")
+		key2 = m2.GetKey(name)
+	)
+	if s2, err := client.Scripts().Register(name, src, m2); err != nil || s2 != s {
+		t.Fatalf("Register() again v->%v, err->%v", s2, err)
+	}
+	if n, err := s.Run([]string{key2}, 1).Int64(); err != nil || n != 1 {
+		t.Fatalf("s.Run() second module n->%d, err->%v", n, err)
+	}
+	client.Del(key, key2)
+}
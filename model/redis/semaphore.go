@@ -0,0 +1,222 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+var (
+	// ErrSemaphoreFull returned by Semaphore.TryAcquire when the limit is reached.
+	ErrSemaphoreFull = errors.New("redis: semaphore is full")
+	// ErrSemaphoreTimeout returned by Semaphore.Acquire when the timeout is reached.
+	ErrSemaphoreTimeout = errors.New("redis: semaphore acquire timeout")
+	// ErrSemaphoreLeaseLost returned when the lease has expired or was released.
+	ErrSemaphoreLeaseLost = errors.New("redis: semaphore lease lost")
+)
+
+// Semaphore distributed counting semaphore. The holders are members of a
+// sorted set scored by the expiry of their lease, the expired leases of the
+// crashed holders are removed before counting. The lease expiry is set by
+// the client clock, the clock skew between the clients must be small
+// compared with LeaseTTL.
+type Semaphore struct {
+	client *Client
+	opts   SemaphoreOptions
+	name   string
+	limit  int64
+	key    string
+}
+
+// SemaphoreOptions semaphore options.
+type SemaphoreOptions struct {
+	// Lease TTL, the slot of a crashed holder is freed after at most LeaseTTL.
+	// Default is 30 seconds.
+	LeaseTTL time.Duration
+	// Maximum wait between the attempts of Acquire, with jitter.
+	// Default is 100 milliseconds.
+	PollInterval time.Duration
+}
+
+// init sets the default options.
+func (o *SemaphoreOptions) init() {
+	if o.LeaseTTL <= 0 {
+		o.LeaseTTL = 30 * time.Second
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = 100 * time.Millisecond
+	}
+}
+
+// SemaphoreLease slot held in the semaphore.
+type SemaphoreLease struct {
+	sem *Semaphore
+	id  string
+}
+
+var (
+	// KEYS: holders; ARGV: now, expire at, id, limit, ttl
+	semaphoreAcquireScript = newLibScript("semaphore.acquire", `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if not redis.call('ZSCORE', KEYS[1], ARGV[3]) and redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[4]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[5]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+end
+return 1`)
+	// KEYS: holders; ARGV: now, expire at, id, ttl
+	semaphoreRenewScript = newLibScript("semaphore.renew", `
+local score = redis.call('ZSCORE', KEYS[1], ARGV[3])
+if not score or tonumber(score) <= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[4]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+end
+return 1`)
+)
+
+// NewSemaphore creates semaphore named name under the module, at most limit
+// leases are held at the same time.
+func NewSemaphore(c *Client, m *Module, name string, limit int, opts *SemaphoreOptions) *Semaphore {
+	var o SemaphoreOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	registerLibScripts(c, m, semaphoreAcquireScript, semaphoreRenewScript)
+	return &Semaphore{
+		client: c,
+		opts:   o,
+		name:   name,
+		limit:  int64(limit),
+		key:    hashTagKey(m, "semaphore:"+name, "holders"),
+	}
+}
+
+// TryAcquire acquires a lease, returns ErrSemaphoreFull if the limit is reached.
+func (s *Semaphore) TryAcquire() (*SemaphoreLease, error) {
+	lease := &SemaphoreLease{sem: s, id: randomID()}
+	now := s.client.now()
+	n, err := semaphoreAcquireScript.Run(s.client, []string{s.key},
+		unixMilli(now), unixMilli(now.Add(s.opts.LeaseTTL)), lease.id, s.limit,
+		int64(s.opts.LeaseTTL/time.Millisecond)).Int64()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrSemaphoreFull
+	}
+	return lease, nil
+}
+
+// Acquire waits for a lease until ctx is done or timeout if > 0, returns
+// ErrSemaphoreTimeout on timeout. The waiters are not served in order.
+func (s *Semaphore) Acquire(ctx context.Context, timeout time.Duration) (*SemaphoreLease, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		lease, err := s.TryAcquire()
+		if err != ErrSemaphoreFull {
+			return lease, err
+		}
+		wait := time.Duration(rand.Int63n(int64(s.opts.PollInterval))) + 1
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return nil, ErrSemaphoreTimeout
+			}
+			if wait > left {
+				wait = left
+			}
+		}
+		sleepContext(ctx, wait)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Count returns the number of leases held.
+func (s *Semaphore) Count() (int64, error) {
+	return s.client.ZCount(s.key, fmt.Sprintf("(%d", unixMilli(s.client.now())), "+inf").Result()
+}
+
+// Limit returns the maximum number of leases.
+func (s *Semaphore) Limit() int64 {
+	return s.limit
+}
+
+// Do acquires a lease as Acquire, calls fn while renewing the lease and then
+// releases it. The ctx of fn is canceled if the lease is lost.
+func (s *Semaphore) Do(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) (err error) {
+	lease, err := s.Acquire(ctx, timeout)
+	if err != nil {
+		return err
+	}
+	fnCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.opts.LeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := lease.Renew()
+				if err == ErrSemaphoreLeaseLost {
+					ozlog.Errorf("Semaphore(%s).Renew(): %s", s.name, err.Error())
+					cancel()
+					return
+				}
+				if err != nil {
+					ozlog.Errorf("Semaphore(%s).Renew(): %s", s.name, err.Error())
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		if rerr := lease.Release(); rerr != nil {
+			ozlog.Errorf("Semaphore(%s).Release(): %s", s.name, rerr.Error())
+		}
+	}()
+	return fn(fnCtx)
+}
+
+// ID returns the holder id of the lease.
+func (l *SemaphoreLease) ID() string {
+	return l.id
+}
+
+// Renew extends the lease by LeaseTTL, returns ErrSemaphoreLeaseLost if the
+// lease has expired.
+func (l *SemaphoreLease) Renew() error {
+	now := l.sem.client.now()
+	n, err := semaphoreRenewScript.Run(l.sem.client, []string{l.sem.key},
+		unixMilli(now), unixMilli(now.Add(l.sem.opts.LeaseTTL)), l.id,
+		int64(l.sem.opts.LeaseTTL/time.Millisecond)).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSemaphoreLeaseLost
+	}
+	return nil
+}
+
+// Release frees the slot of the lease.
+func (l *SemaphoreLease) Release() error {
+	return l.sem.client.ZRem(l.sem.key, l.id).Err()
+}
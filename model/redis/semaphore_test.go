@@ -0,0 +1,113 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestSemaphore(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	var (
+		ctx = context.Background()
+		m   = NewModule("ooz-test")
+		sem = NewSemaphore(client, m, "api", 2, &SemaphoreOptions{
+			LeaseTTL:     60 * time.Millisecond,
+			PollInterval: 10 * time.Millisecond,
+		})
+	)
+	l1, err := sem.TryAcquire()
+	if err != nil {
+		t.Fatalf("TryAcquire() err->%v", err)
+	}
+	l2, err := sem.Acquire(ctx, 0)
+	if err != nil {
+		t.Fatalf("Acquire() err->%v", err)
+	}
+	if _, err = sem.TryAcquire(); err != ErrSemaphoreFull {
+		t.Fatalf("TryAcquire() full err->%v", err)
+	}
+	if _, err = sem.Acquire(ctx, 50*time.Millisecond); err != ErrSemaphoreTimeout {
+		t.Fatalf("Acquire() timeout err->%v", err)
+	}
+	if n, err := sem.Count(); err != nil || n != 2 {
+		t.Fatalf("Count() v->%d, err->%v", n, err)
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		l1.Release()
+	}()
+	l3, err := sem.Acquire(ctx, time.Second)
+	if err != nil {
+		t.Fatalf("Acquire() after release err->%v", err)
+	}
+	if err = l2.Renew(); err != nil {
+		t.Fatalf("Renew() err->%v", err)
+	}
+
+	// the crashed holders expire.
+	srv.Advance(100 * time.Millisecond)
+	if err = l3.Renew(); err != ErrSemaphoreLeaseLost {
+		t.Fatalf("Renew() expired err->%v", err)
+	}
+	if n, err := sem.Count(); err != nil || n != 0 {
+		t.Fatalf("Count() expired v->%d, err->%v", n, err)
+	}
+
+	var (
+		wg            sync.WaitGroup
+		running, peak int32
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sem.Do(ctx, 5*time.Second, func(ctx context.Context) error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return ctx.Err()
+			})
+			if err != nil {
+				t.Errorf("Do() err->%v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Fatalf("Do() peak->%d", peak)
+	}
+
+	// the lease is renewed while fn runs longer than LeaseTTL.
+	err = sem.Do(ctx, 0, func(ctx context.Context) error {
+		holders := client.ZRangeWithScores(sem.HoldersKey(), 0, -1).Val()
+		srv.Advance(40 * time.Millisecond)
+		for i := 0; client.ZScore(sem.HoldersKey(), holders[0].Member.(string)).Val() == holders[0].Score; i++ {
+			if i == 100 {
+				return errors.New("lease not renewed")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		srv.Advance(40 * time.Millisecond)
+		if n, err := sem.Count(); err != nil || n != 1 {
+			return fmt.Errorf("Count() v->%d, err->%v", n, err)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("Do() renew err->%v", err)
+	}
+}
@@ -0,0 +1,584 @@
+package redis
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+var (
+	// ErrSessionSecret returned by NewSessionStore when the secret is empty.
+	ErrSessionSecret = errors.New("redis: session secret is empty")
+	// ErrSessionInvalid returned when the signature of the session id is invalid.
+	ErrSessionInvalid = errors.New("redis: invalid session id")
+	// ErrSessionNotFound returned when the session has expired or was revoked.
+	ErrSessionNotFound = errors.New("redis: session not found")
+)
+
+// session hash fields, the data fields are prefixed by sessionDataPrefix.
+const (
+	sessionUserField    = "_user"
+	sessionCreatedField = "_created"
+	sessionDataPrefix   = "d:"
+)
+
+// SessionOptions session store options.
+type SessionOptions struct {
+	// Secret key of the session id signature, required.
+	Secret []byte
+	// The session expires after IdleTimeout without request, every load
+	// extends it.
+	// Default is 30 minutes.
+	IdleTimeout time.Duration
+	// The session expires MaxAge after created whatever the activity, 0 for
+	// no limit.
+	// Default is 0.
+	MaxAge time.Duration
+	// Cookie of the session id used by Middleware.
+	// Default is "session_id".
+	CookieName string
+	// Default is "/".
+	CookiePath   string
+	CookieDomain string
+	CookieSecure bool
+	// Default is http.SameSiteLaxMode.
+	CookieSameSite http.SameSite
+}
+
+// init sets the default options.
+func (o *SessionOptions) init() {
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = 30 * time.Minute
+	}
+	if o.CookieName == "" {
+		o.CookieName = "session_id"
+	}
+	if o.CookiePath == "" {
+		o.CookiePath = "/"
+	}
+	if o.CookieSameSite == 0 {
+		o.CookieSameSite = http.SameSiteLaxMode
+	}
+}
+
+// SessionStore web sessions stored as redis hashes under the module. The
+// session ids are signed by HMAC-SHA256, the sessions of a user are indexed
+// so that they can be revoked together.
+type SessionStore struct {
+	client *Client
+	module *Module
+	opts   SessionOptions
+}
+
+// KEYS: session; ARGV: must exist, idle timeout, number of deleted fields,
+// deleted fields..., changed field, value...
+var sessionSaveScript = newLibScript("session.save", `
+if ARGV[1] == '1' and redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local n = tonumber(ARGV[3])
+if n > 0 then
+	redis.call('HDEL', KEYS[1], unpack(ARGV, 4, 3 + n))
+end
+if #ARGV > 3 + n then
+	redis.call('HMSET', KEYS[1], unpack(ARGV, 4 + n))
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1`)
+
+// Session web session, the changes are written by Save.
+type Session struct {
+	store     *SessionStore
+	mu        sync.Mutex
+	id        string
+	userID    string
+	created   time.Time
+	values    map[string]string
+	changed   map[string]string
+	deleted   map[string]bool
+	isNew     bool
+	userSet   bool
+	destroyed bool
+	// previous id replaced by Regenerate, deleted by Save.
+	oldID string
+}
+
+// NewSessionStore creates session store under the module.
+func NewSessionStore(c *Client, m *Module, opts *SessionOptions) (*SessionStore, error) {
+	var o SessionOptions
+	if opts != nil {
+		o = *opts
+	}
+	if len(o.Secret) == 0 {
+		return nil, ErrSessionSecret
+	}
+	o.init()
+	registerLibScripts(c, m, sessionSaveScript)
+	return &SessionStore{
+		client: c,
+		module: m,
+		opts:   o,
+	}, nil
+}
+
+// sessionKey returns the redis key of the session.
+func (s *SessionStore) sessionKey(id string) string {
+	return s.module.GetKey("session:" + id)
+}
+
+// userKey returns the redis key of the session ids of the user.
+func (s *SessionStore) userKey(userID string) string {
+	return s.module.GetKey("session:user:" + userID)
+}
+
+// userTTL returns the expiration of the user index, refreshed with the
+// sessions so that it outlives them.
+func (s *SessionStore) userTTL() time.Duration {
+	if s.opts.MaxAge > s.opts.IdleTimeout {
+		return s.opts.MaxAge
+	}
+	return s.opts.IdleTimeout
+}
+
+// touchUser adds the session to the index of the user and extends the index
+// expiration.
+func (s *SessionStore) touchUser(userID, id string) error {
+	userKey := s.userKey(userID)
+	_, err := s.client.Pipelined(func(p Pipeliner) error {
+		p.SAdd(userKey, id)
+		p.PExpire(userKey, s.userTTL())
+		return nil
+	})
+	return err
+}
+
+// sign returns the signed session id, "id.signature".
+func (s *SessionStore) sign(id string) string {
+	mac := hmac.New(sha256.New, s.opts.Secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the id of the signed session id.
+func (s *SessionStore) verify(signed string) (string, error) {
+	i := strings.LastIndexByte(signed, '.')
+	if i <= 0 {
+		return "", ErrSessionInvalid
+	}
+	id := signed[:i]
+	if !hmac.Equal([]byte(s.sign(id)), []byte(signed)) {
+		return "", ErrSessionInvalid
+	}
+	return id, nil
+}
+
+// New returns a new session, it is stored by Save.
+func (s *SessionStore) New() *Session {
+	return &Session{
+		store:   s,
+		id:      randomID(),
+		created: s.client.now(),
+		values:  make(map[string]string),
+		changed: make(map[string]string),
+		deleted: make(map[string]bool),
+		isNew:   true,
+	}
+}
+
+// Load returns the session of the signed id and extends its expiration,
+// returns ErrSessionInvalid or ErrSessionNotFound.
+func (s *SessionStore) Load(signedID string) (*Session, error) {
+	id, err := s.verify(signedID)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		key    = s.sessionKey(id)
+		fields *StringStringMapCmd
+	)
+	_, err = s.client.Pipelined(func(p Pipeliner) error {
+		fields = p.HGetAll(key)
+		p.PExpire(key, s.opts.IdleTimeout)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(fields.Val()) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	sess := &Session{
+		store:   s,
+		id:      id,
+		values:  make(map[string]string),
+		changed: make(map[string]string),
+		deleted: make(map[string]bool),
+	}
+	for field, value := range fields.Val() {
+		switch {
+		case field == sessionUserField:
+			sess.userID = value
+		case field == sessionCreatedField:
+			ms, _ := strconv.ParseInt(value, 10, 64)
+			sess.created = time.Unix(0, ms*int64(time.Millisecond))
+		case strings.HasPrefix(field, sessionDataPrefix):
+			sess.values[field[len(sessionDataPrefix):]] = value
+		}
+	}
+	if s.opts.MaxAge > 0 && s.client.now().Sub(sess.created) > s.opts.MaxAge {
+		_, err = s.client.Pipelined(func(p Pipeliner) error {
+			p.Del(key)
+			if sess.userID != "" {
+				p.SRem(s.userKey(sess.userID), id)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrSessionNotFound
+	}
+	if sess.userID != "" {
+		if err = s.touchUser(sess.userID, id); err != nil {
+			return nil, err
+		}
+	}
+	return sess, nil
+}
+
+// RevokeUser deletes all sessions of the user, returns the number deleted.
+func (s *SessionStore) RevokeUser(userID string) (int64, error) {
+	userKey := s.userKey(userID)
+	ids, err := s.client.SMembers(userKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, s.sessionKey(id))
+	}
+	n, err := s.client.MultiDel(keys...)
+	if err != nil {
+		return n, err
+	}
+	// the ids added meanwhile are kept.
+	if len(ids) > 0 {
+		members := make([]interface{}, len(ids))
+		for i, id := range ids {
+			members[i] = id
+		}
+		err = s.client.SRem(userKey, members...).Err()
+	}
+	return n, err
+}
+
+// UserSessions returns the signed ids of the live sessions of the user, the
+// expired ones are removed from the index.
+func (s *SessionStore) UserSessions(userID string) ([]string, error) {
+	userKey := s.userKey(userID)
+	ids, err := s.client.SMembers(userKey).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.sessionKey(id)
+	}
+	exists := make([]*IntCmd, len(ids))
+	_, err = s.client.Pipelined(func(p Pipeliner) error {
+		for i, key := range keys {
+			exists[i] = p.Exists(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var (
+		live    []string
+		expired []interface{}
+	)
+	for i, id := range ids {
+		if exists[i].Val() == 1 {
+			live = append(live, s.sign(id))
+		} else {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) > 0 {
+		s.client.SRem(userKey, expired...)
+	}
+	return live, nil
+}
+
+// ID returns the signed session id.
+func (sess *Session) ID() string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.store.sign(sess.id)
+}
+
+// IsNew is the session not stored yet?
+func (sess *Session) IsNew() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.isNew
+}
+
+// UserID returns the user of the session, "" if anonymous.
+func (sess *Session) UserID() string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.userID
+}
+
+// SetUserID binds the session to the user, call Regenerate on login to
+// prevent session fixation.
+func (sess *Session) SetUserID(userID string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.userID = userID
+	sess.userSet = true
+}
+
+// Get returns the value of the key.
+func (sess *Session) Get(key string) (string, bool) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	v, ok := sess.values[key]
+	return v, ok
+}
+
+// Values returns a copy of the data.
+func (sess *Session) Values() map[string]string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	values := make(map[string]string, len(sess.values))
+	for k, v := range sess.values {
+		values[k] = v
+	}
+	return values
+}
+
+// Set sets the value of the key, only the changed keys are written by Save.
+func (sess *Session) Set(key, value string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.values[key] = value
+	sess.changed[key] = value
+	delete(sess.deleted, key)
+}
+
+// Delete deletes the key.
+func (sess *Session) Delete(key string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	delete(sess.values, key)
+	delete(sess.changed, key)
+	sess.deleted[key] = true
+}
+
+// Regenerate changes the session id keeping the data, the old id is
+// invalidated by Save.
+func (sess *Session) Regenerate() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if !sess.isNew && sess.oldID == "" {
+		sess.oldID = sess.id
+	}
+	sess.id = randomID()
+	// all data is written to the new key.
+	for k, v := range sess.values {
+		sess.changed[k] = v
+	}
+	sess.userSet = sess.userSet || sess.userID != ""
+	sess.isNew = true
+}
+
+// Destroy deletes the session.
+func (sess *Session) Destroy() error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.destroyed = true
+	keys := []string{sess.store.sessionKey(sess.id)}
+	if sess.oldID != "" {
+		keys = append(keys, sess.store.sessionKey(sess.oldID))
+	}
+	_, err := sess.store.client.MultiDel(keys...)
+	return err
+}
+
+// modified has the session changes to save?
+func (sess *Session) modified() bool {
+	return len(sess.changed) > 0 || len(sess.deleted) > 0 || sess.userSet || sess.oldID != ""
+}
+
+// Save writes the changed keys and extends the expiration, a new session
+// is stored even if empty. Save returns ErrSessionNotFound if the stored
+// session has expired or was revoked meanwhile, it is not re-created.
+func (sess *Session) Save() error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.destroyed {
+		return nil
+	}
+	s := sess.store
+	if sess.oldID != "" {
+		// the regenerated session exists only if the old one did.
+		n, err := s.client.Del(s.sessionKey(sess.oldID)).Result()
+		if err != nil {
+			return err
+		}
+		// a stale id left in the index is dropped by UserSessions.
+		if sess.userID != "" {
+			if err = s.client.SRem(s.userKey(sess.userID), sess.oldID).Err(); err != nil {
+				ozlog.Errorf("Session.Save(): remove the regenerated id from the user index: %s", err.Error())
+			}
+		}
+		sess.oldID = ""
+		if n == 0 {
+			return ErrSessionNotFound
+		}
+	}
+	mustExist := "1"
+	if sess.isNew {
+		mustExist = "0"
+	}
+	args := []interface{}{mustExist, int64(s.opts.IdleTimeout / time.Millisecond), len(sess.deleted)}
+	for k := range sess.deleted {
+		args = append(args, sessionDataPrefix+k)
+	}
+	for k, v := range sess.changed {
+		args = append(args, sessionDataPrefix+k, v)
+	}
+	if sess.isNew {
+		args = append(args, sessionCreatedField, unixMilli(sess.created))
+	}
+	if sess.userSet {
+		args = append(args, sessionUserField, sess.userID)
+	}
+	saved, err := sessionSaveScript.Run(s.client, []string{s.sessionKey(sess.id)}, args...).Int64()
+	if err != nil {
+		return err
+	}
+	if saved == 0 {
+		return ErrSessionNotFound
+	}
+	if sess.userID != "" {
+		if err = s.touchUser(sess.userID, sess.id); err != nil {
+			return err
+		}
+	}
+	sess.changed = make(map[string]string)
+	sess.deleted = make(map[string]bool)
+	sess.isNew, sess.userSet = false, false
+	return nil
+}
+
+// sessionContextKey context key of the session.
+type sessionContextKey struct{}
+
+// SessionFromContext returns the session of the request loaded by
+// SessionStore.Middleware, nil if none.
+func SessionFromContext(ctx context.Context) *Session {
+	sess, _ := ctx.Value(sessionContextKey{}).(*Session)
+	return sess
+}
+
+// Middleware loads the session of the cookie, or creates a new one, into the
+// request context, see SessionFromContext. The session is saved and the
+// cookie set before the response header is written, a new session is
+// stored only if modified.
+func (s *SessionStore) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sess *Session
+		if c, err := r.Cookie(s.opts.CookieName); err == nil {
+			if sess, err = s.Load(c.Value); err != nil && err != ErrSessionInvalid && err != ErrSessionNotFound {
+				ozlog.Errorf("SessionStore.Middleware(): load session: %s", err.Error())
+			}
+		}
+		if sess == nil {
+			sess = s.New()
+		}
+		sw := &sessionWriter{ResponseWriter: w, store: s, sess: sess}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, sess)))
+		sw.save()
+	})
+}
+
+// sessionWriter saves the session before the header is written.
+type sessionWriter struct {
+	http.ResponseWriter
+	store *SessionStore
+	sess  *Session
+	saved bool
+}
+
+// save saves the session and sets the cookie once.
+func (w *sessionWriter) save() {
+	if w.saved {
+		return
+	}
+	w.saved = true
+	sess := w.sess
+	sess.mu.Lock()
+	var (
+		destroyed = sess.destroyed
+		skip      = sess.isNew && !sess.modified()
+	)
+	sess.mu.Unlock()
+	cookie := &http.Cookie{
+		Name:     w.store.opts.CookieName,
+		Path:     w.store.opts.CookiePath,
+		Domain:   w.store.opts.CookieDomain,
+		Secure:   w.store.opts.CookieSecure,
+		HttpOnly: true,
+		SameSite: w.store.opts.CookieSameSite,
+	}
+	switch {
+	case destroyed:
+		cookie.MaxAge = -1
+	case skip:
+		return
+	default:
+		if err := sess.Save(); err == ErrSessionNotFound {
+			// revoked during the request.
+			cookie.MaxAge = -1
+			break
+		} else if err != nil {
+			ozlog.Errorf("SessionStore.Middleware(): save session: %s", err.Error())
+			return
+		}
+		cookie.Value = sess.ID()
+		if w.store.opts.MaxAge > 0 {
+			cookie.MaxAge = int(w.store.opts.MaxAge / time.Second)
+		}
+	}
+	http.SetCookie(w.ResponseWriter, cookie)
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *sessionWriter) WriteHeader(code int) {
+	w.save()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	w.save()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original writer for http.ResponseController.
+func (w *sessionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,197 @@
+package redis_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestSessionStore(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	m := NewModule("ooz-test")
+	if _, err := NewSessionStore(client, m, nil); err != ErrSessionSecret {
+		t.Fatalf("NewSessionStore() no secret err->%v", err)
+	}
+	store, err := NewSessionStore(client, m, &SessionOptions{
+		Secret:      []byte("secret"),
+		IdleTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewSessionStore() err->%v", err)
+	}
+
+	sess := store.New()
+	sess.Set("name", "ooz")
+	sess.Set("lang", "go")
+	sess.SetUserID("u1")
+	if err = sess.Save(); err != nil {
+		t.Fatalf("Save() err->%v", err)
+	}
+	signed := sess.ID()
+	if _, err = store.Load(signed[:strings.LastIndexByte(signed, '.')] + ".forged"); err != ErrSessionInvalid {
+		t.Fatalf("Load() forged err->%v", err)
+	}
+	other, _ := NewSessionStore(client, m, &SessionOptions{Secret: []byte("other")})
+	if _, err = other.Load(sess.ID()); err != ErrSessionInvalid {
+		t.Fatalf("Load() other secret err->%v", err)
+	}
+
+	// concurrent requests update different fields.
+	s1, err := store.Load(sess.ID())
+	if err != nil {
+		t.Fatalf("Load() err->%v", err)
+	}
+	s2, _ := store.Load(sess.ID())
+	s1.Set("name", "oozkits")
+	s2.Delete("lang")
+	s2.Set("theme", "dark")
+	if err = s1.Save(); err != nil {
+		t.Fatalf("Save() err->%v", err)
+	}
+	if err = s2.Save(); err != nil {
+		t.Fatalf("Save() err->%v", err)
+	}
+	s3, err := store.Load(sess.ID())
+	if err != nil {
+		t.Fatalf("Load() err->%v", err)
+	}
+	if v := s3.Values(); len(v) != 2 || v["name"] != "oozkits" || v["theme"] != "dark" || s3.UserID() != "u1" {
+		t.Fatalf("Load() v->%v, user->%s", v, s3.UserID())
+	}
+	if ttl := client.PTTL(store.SessionKey(sess)).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("PTTL() v->%v", ttl)
+	}
+
+	// the old id is invalid after Regenerate.
+	oldID := s3.ID()
+	s3.Regenerate()
+	if err = s3.Save(); err != nil {
+		t.Fatalf("Save() regenerated err->%v", err)
+	}
+	if _, err = store.Load(oldID); err != ErrSessionNotFound {
+		t.Fatalf("Load() old id err->%v", err)
+	}
+	if s4, err := store.Load(s3.ID()); err != nil || s4.Values()["name"] != "oozkits" {
+		t.Fatalf("Load() regenerated v->%v, err->%v", s4, err)
+	}
+
+	another := store.New()
+	another.SetUserID("u1")
+	if err = another.Save(); err != nil {
+		t.Fatalf("Save() err->%v", err)
+	}
+	// the user index slides with the sessions.
+	client.PExpire(store.UserKey("u1"), time.Second)
+	loaded, err := store.Load(another.ID())
+	if err != nil {
+		t.Fatalf("Load() err->%v", err)
+	}
+	if ttl := client.PTTL(store.UserKey("u1")).Val(); ttl <= time.Second {
+		t.Fatalf("user index PTTL() v->%v", ttl)
+	}
+	if ids, err := store.UserSessions("u1"); err != nil || len(ids) != 2 {
+		t.Fatalf("UserSessions() v->%v, err->%v", ids, err)
+	}
+	if n, err := store.RevokeUser("u1"); err != nil || n != 2 {
+		t.Fatalf("RevokeUser() v->%d, err->%v", n, err)
+	}
+	if _, err = store.Load(another.ID()); err != ErrSessionNotFound {
+		t.Fatalf("Load() revoked err->%v", err)
+	}
+
+	// the revoked sessions are not re-created by Save.
+	loaded.Set("name", "stale")
+	if err = loaded.Save(); err != ErrSessionNotFound {
+		t.Fatalf("Save() revoked err->%v", err)
+	}
+	if n := client.Exists(store.SessionKey(loaded)).Val(); n != 0 {
+		t.Fatalf("Save() revoked exists->%d", n)
+	}
+	loaded.Regenerate()
+	if err = loaded.Save(); err != ErrSessionNotFound {
+		t.Fatalf("Save() revoked regenerated err->%v", err)
+	}
+	if n := client.Exists(store.SessionKey(loaded)).Val(); n != 0 {
+		t.Fatalf("Save() revoked regenerated exists->%d", n)
+	}
+
+	// the sessions past MaxAge are deleted and removed from the user index.
+	aged, _ := NewSessionStore(client, m, &SessionOptions{
+		Secret:      []byte("secret"),
+		IdleTimeout: 24 * time.Hour,
+		MaxAge:      time.Hour,
+	})
+	old := aged.New()
+	old.SetUserID("u2")
+	if err = old.Save(); err != nil {
+		t.Fatalf("Save() err->%v", err)
+	}
+	srv.Advance(2 * time.Hour)
+	if _, err = aged.Load(old.ID()); err != ErrSessionNotFound {
+		t.Fatalf("Load() past MaxAge err->%v", err)
+	}
+	if n := client.Exists(aged.SessionKey(old)).Val(); n != 0 {
+		t.Fatalf("Load() past MaxAge exists->%d", n)
+	}
+	if n := client.SCard(aged.UserKey("u2")).Val(); n != 0 {
+		t.Fatalf("Load() past MaxAge user index len->%d", n)
+	}
+}
+
+func TestSessionMiddleware(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	store, err := NewSessionStore(client, NewModule("ooz-test"), &SessionOptions{
+		Secret: []byte("secret"),
+	})
+	if err != nil {
+		t.Fatalf("NewSessionStore() err->%v", err)
+	}
+	handler := store.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := SessionFromContext(r.Context())
+		switch r.URL.Path {
+		case "/login":
+			sess.Regenerate()
+			sess.SetUserID("u1")
+			sess.Set("name", "ooz")
+		case "/logout":
+			sess.Destroy()
+		}
+		name, _ := sess.Get("name")
+		w.Write([]byte(name))
+	}))
+	do := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// anonymous requests don't create sessions.
+	if w := do("/", nil); len(w.Result().Cookies()) != 0 {
+		t.Fatalf("anonymous cookies->%v", w.Result().Cookies())
+	}
+	w := do("/login", nil)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "session_id" || !cookies[0].HttpOnly {
+		t.Fatalf("login cookies->%v", cookies)
+	}
+	defer store.RevokeUser("u1")
+	if w = do("/", cookies[0]); w.Body.String() != "ooz" {
+		t.Fatalf("session body->%s", w.Body.String())
+	}
+	w = do("/logout", cookies[0])
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Fatalf("logout cookies->%v", c)
+	}
+	if w = do("/", cookies[0]); w.Body.String() != "" {
+		t.Fatalf("destroyed session body->%s", w.Body.String())
+	}
+}
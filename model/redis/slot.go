@@ -0,0 +1,79 @@
+package redis
+
+import (
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// SlotCount number of redis cluster hash slots.
+const SlotCount = 16384
+
+// crc16tab crc16 xmodem table used by redis cluster.
+var crc16tab = func() (tab [256]uint16) {
+	for i := range tab {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		tab[i] = crc
+	}
+	return tab
+}()
+
+// crc16 returns the crc16 xmodem checksum of key.
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc = crc<<8 ^ crc16tab[byte(crc>>8)^key[i]]
+	}
+	return crc
+}
+
+// Slot returns the cluster hash slot of the key, only the hash tag
+// (the non-empty part between the first '{' and the next '}') is hashed if any.
+func Slot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key) % SlotCount)
+}
+
+// IsCluster is the client a cluster client?
+func (c *Client) IsCluster() bool {
+	_, ok := c.Cmdable.(*redis.ClusterClient)
+	return ok
+}
+
+// groupBySlot returns the indexes of the keys grouped by slot, all keys are
+// in one group if not cluster.
+func (c *Client) groupBySlot(keys []string) [][]int {
+	if !c.IsCluster() {
+		all := make([]int, len(keys))
+		for i := range keys {
+			all[i] = i
+		}
+		return [][]int{all}
+	}
+	var (
+		groups [][]int
+		slots  = make(map[int]int)
+	)
+	for i, key := range keys {
+		slot := Slot(key)
+		g, ok := slots[slot]
+		if !ok {
+			g = len(groups)
+			slots[slot] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
@@ -0,0 +1,471 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// StreamProducer adds messages to a redis stream.
+type StreamProducer struct {
+	client *Client
+	stream string
+	maxLen int64
+}
+
+// NewStreamProducer creates stream producer, the stream is trimmed to about
+// maxLen entries (MAXLEN ~) on every add, maxLen <= 0 disables trimming.
+func NewStreamProducer(c *Client, m *Module, stream string, maxLen int64) *StreamProducer {
+	return &StreamProducer{
+		client: c,
+		stream: m.GetKey(stream),
+		maxLen: maxLen,
+	}
+}
+
+// Stream returns the stream key.
+func (p *StreamProducer) Stream() string {
+	return p.stream
+}
+
+// Add adds the message, returns the message id.
+func (p *StreamProducer) Add(values map[string]interface{}) (string, error) {
+	args := &redis.XAddArgs{
+		Stream: p.stream,
+		Values: values,
+	}
+	if p.maxLen > 0 {
+		args.MaxLenApprox = p.maxLen
+	}
+	return p.client.XAdd(args).Result()
+}
+
+// StreamMessage message delivered to StreamHandler.
+type StreamMessage struct {
+	// ID stream entry id.
+	ID string
+	// Stream stream key.
+	Stream string
+	// Values entry fields.
+	Values map[string]interface{}
+	// Deliveries number of times the message has been delivered, including this one.
+	Deliveries int64
+}
+
+// StreamHandler handles the message, the message is acknowledged if it returns nil.
+type StreamHandler func(*StreamMessage) error
+
+// StreamConsumerOptions stream consumer options.
+type StreamConsumerOptions struct {
+	// Consumer group name, created with StartID if not exists.
+	Group string
+	// ID the group starts from when it is created.
+	// Default is "$", only the new messages.
+	StartID string
+	// Consumer name, must be unique in the group.
+	// Default is hostname-pid-random.
+	Consumer string
+	// Number of concurrent handlers.
+	// Default is 1.
+	Workers int
+	// Maximum number of messages per read.
+	// Default is 10.
+	BatchSize int64
+	// Maximum time a read blocks, also bounds the shutdown latency.
+	// Default is 2 seconds.
+	Block time.Duration
+	// Pending messages idle longer than this are reclaimed from other(dead) consumers.
+	// Default is 1 minute.
+	ClaimMinIdle time.Duration
+	// Frequency of reclaiming.
+	// Default is 30 seconds.
+	ClaimInterval time.Duration
+	// Messages delivered more than MaxDeliveries times are dead-lettered.
+	// Default is 5.
+	MaxDeliveries int64
+	// Dead-lettered messages are added to this stream under the same module
+	// with an extra "origin_id" field, then acknowledged.
+	// Default is "", dead-lettered messages are only acknowledged and logged.
+	DeadLetterStream string
+}
+
+// init sets the default options.
+func (o *StreamConsumerOptions) init() {
+	if o.StartID == "" {
+		o.StartID = "$"
+	}
+	if o.Consumer == "" {
+		host, _ := os.Hostname()
+		o.Consumer = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), randomID()[:8])
+	}
+	if o.Workers <= 0 {
+		o.Workers = 1
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 10
+	}
+	if o.Block <= 0 {
+		o.Block = 2 * time.Second
+	}
+	if o.ClaimMinIdle <= 0 {
+		o.ClaimMinIdle = time.Minute
+	}
+	if o.ClaimInterval <= 0 {
+		o.ClaimInterval = 30 * time.Second
+	}
+	if o.MaxDeliveries <= 0 {
+		o.MaxDeliveries = 5
+	}
+}
+
+// StreamStats stream consumer counters.
+type StreamStats struct {
+	// Acked messages handled successfully.
+	Acked int64
+	// Failed handler errors and panics, the messages are retried after ClaimMinIdle.
+	Failed int64
+	// Claimed messages reclaimed from idle consumers.
+	Claimed int64
+	// Dead messages delivered more than MaxDeliveries times.
+	Dead int64
+}
+
+// StreamConsumer consumer group worker pool.
+type StreamConsumer struct {
+	client     *Client
+	stream     string
+	deadStream string
+	opts       StreamConsumerOptions
+	handler    StreamHandler
+	stats      StreamStats
+	// xautoclaim is not supported by the server(< 6.2), fall back to xpending + xclaim.
+	noAutoClaim int32
+	// the XAUTOCLAIM cursor of the next Claim, "0-0" scans from the start.
+	claimMu     sync.Mutex
+	claimCursor string
+}
+
+// NewStreamConsumer creates stream consumer.
+func NewStreamConsumer(c *Client, m *Module, stream string, opts StreamConsumerOptions, handler StreamHandler) *StreamConsumer {
+	opts.init()
+	sc := &StreamConsumer{
+		client:  c,
+		stream:  m.GetKey(stream),
+		opts:    opts,
+		handler: handler,
+	}
+	if opts.DeadLetterStream != "" {
+		sc.deadStream = m.GetKey(opts.DeadLetterStream)
+	}
+	return sc
+}
+
+// Consumer returns the consumer name.
+func (sc *StreamConsumer) Consumer() string {
+	return sc.opts.Consumer
+}
+
+// Stats returns the counters.
+func (sc *StreamConsumer) Stats() StreamStats {
+	return StreamStats{
+		Acked:   atomic.LoadInt64(&sc.stats.Acked),
+		Failed:  atomic.LoadInt64(&sc.stats.Failed),
+		Claimed: atomic.LoadInt64(&sc.stats.Claimed),
+		Dead:    atomic.LoadInt64(&sc.stats.Dead),
+	}
+}
+
+// Run creates the group and consumes until ctx is done, then stops reading
+// and waits for the handlers of the read messages.
+func (sc *StreamConsumer) Run(ctx context.Context) error {
+	err := sc.client.XGroupCreateMkStream(sc.stream, sc.opts.Group, sc.opts.StartID).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	var (
+		msgs = make(chan *StreamMessage)
+		wg   sync.WaitGroup
+	)
+	wg.Add(sc.opts.Workers)
+	for i := 0; i < sc.opts.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for msg := range msgs {
+				sc.handle(msg)
+			}
+		}()
+	}
+	var feeders sync.WaitGroup
+	feeders.Add(2)
+	go func() {
+		defer feeders.Done()
+		sc.readLoop(ctx, msgs)
+	}()
+	go func() {
+		defer feeders.Done()
+		sc.claimLoop(ctx, msgs)
+	}()
+	feeders.Wait()
+	close(msgs)
+	wg.Wait()
+	return nil
+}
+
+// readLoop reads the new messages of the group.
+func (sc *StreamConsumer) readLoop(ctx context.Context, msgs chan<- *StreamMessage) {
+	for ctx.Err() == nil {
+		streams, err := sc.client.XReadGroup(&redis.XReadGroupArgs{
+			Group:    sc.opts.Group,
+			Consumer: sc.opts.Consumer,
+			Streams:  []string{sc.stream, ">"},
+			Count:    sc.opts.BatchSize,
+			Block:    sc.opts.Block,
+		}).Result()
+		if err != nil {
+			if !IsRedisNil(err) {
+				ozlog.Errorf("StreamConsumer(%s).XReadGroup(): %s", sc.stream, err.Error())
+				sleepContext(ctx, time.Second)
+			}
+			continue
+		}
+		for _, s := range streams {
+			for _, m := range s.Messages {
+				msgs <- &StreamMessage{
+					ID:         m.ID,
+					Stream:     sc.stream,
+					Values:     m.Values,
+					Deliveries: 1,
+				}
+			}
+		}
+	}
+}
+
+// claimLoop reclaims the idle pending messages every ClaimInterval.
+func (sc *StreamConsumer) claimLoop(ctx context.Context, msgs chan<- *StreamMessage) {
+	ticker := time.NewTicker(sc.opts.ClaimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			claimed, err := sc.Claim()
+			if err != nil {
+				ozlog.Errorf("StreamConsumer(%s).Claim(): %s", sc.stream, err.Error())
+			}
+			for _, msg := range claimed {
+				msgs <- msg
+			}
+		}
+	}
+}
+
+// Claim claims the pending messages idle longer than ClaimMinIdle to this
+// consumer, the messages delivered more than MaxDeliveries are dead-lettered.
+func (sc *StreamConsumer) Claim() ([]*StreamMessage, error) {
+	var (
+		claimed []*StreamMessage
+		err     error
+	)
+	if atomic.LoadInt32(&sc.noAutoClaim) == 0 {
+		claimed, err = sc.autoClaim()
+		if err != nil && strings.Contains(strings.ToLower(err.Error()), "unknown command") {
+			atomic.StoreInt32(&sc.noAutoClaim, 1)
+		}
+	}
+	if atomic.LoadInt32(&sc.noAutoClaim) == 1 {
+		claimed, err = sc.pendingClaim()
+	}
+	if err != nil || len(claimed) == 0 {
+		return nil, err
+	}
+	atomic.AddInt64(&sc.stats.Claimed, int64(len(claimed)))
+	var alive = claimed[:0]
+	for _, msg := range claimed {
+		if msg.Deliveries > sc.opts.MaxDeliveries {
+			sc.deadLetter(msg)
+			continue
+		}
+		alive = append(alive, msg)
+	}
+	return alive, nil
+}
+
+// autoClaim claims by XAUTOCLAIM from the cursor of the last call, then reads
+// the delivery counts by XPENDING.
+func (sc *StreamConsumer) autoClaim() ([]*StreamMessage, error) {
+	sc.claimMu.Lock()
+	defer sc.claimMu.Unlock()
+	if sc.claimCursor == "" {
+		sc.claimCursor = "0-0"
+	}
+	r, err := sc.client.Do("xautoclaim", sc.stream, sc.opts.Group, sc.opts.Consumer,
+		int64(sc.opts.ClaimMinIdle/time.Millisecond), sc.claimCursor, "count", sc.opts.BatchSize).Result()
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := r.([]interface{})
+	if !ok || len(reply) < 2 {
+		return nil, fmt.Errorf("redis: unexpected xautoclaim reply->%v", r)
+	}
+	// "0-0" when the whole PEL is scanned, the next call starts over.
+	if cursor, ok := reply[0].(string); ok {
+		sc.claimCursor = cursor
+	}
+	entries, _ := reply[1].([]interface{})
+	var claimed []*StreamMessage
+	for _, e := range entries {
+		// deleted entries are nil.
+		entry, ok := e.([]interface{})
+		if !ok || len(entry) != 2 {
+			continue
+		}
+		id, _ := entry[0].(string)
+		fields, _ := entry[1].([]interface{})
+		values := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			k, _ := fields[i].(string)
+			values[k] = fields[i+1]
+		}
+		claimed = append(claimed, &StreamMessage{
+			ID:     id,
+			Stream: sc.stream,
+			Values: values,
+		})
+	}
+	if len(claimed) == 0 {
+		return nil, nil
+	}
+	pending, err := sc.client.XPendingExt(&redis.XPendingExtArgs{
+		Stream:   sc.stream,
+		Group:    sc.opts.Group,
+		Start:    claimed[0].ID,
+		End:      claimed[len(claimed)-1].ID,
+		Count:    int64(len(claimed)),
+		Consumer: sc.opts.Consumer,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make(map[string]int64, len(pending))
+	for _, p := range pending {
+		deliveries[p.Id] = p.RetryCount
+	}
+	for _, msg := range claimed {
+		msg.Deliveries = deliveries[msg.ID]
+	}
+	return claimed, nil
+}
+
+// pendingClaim claims by XPENDING and XCLAIM, the PEL is paged through until
+// BatchSize idle messages are found.
+func (sc *StreamConsumer) pendingClaim() ([]*StreamMessage, error) {
+	var (
+		ids        []string
+		deliveries = make(map[string]int64)
+		start      = "-"
+		// one more for the start of the next page.
+		count = sc.opts.BatchSize + 1
+	)
+	for int64(len(ids)) < sc.opts.BatchSize {
+		pending, err := sc.client.XPendingExt(&redis.XPendingExtArgs{
+			Stream: sc.stream,
+			Group:  sc.opts.Group,
+			Start:  start,
+			End:    "+",
+			Count:  count,
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pending {
+			// the start is inclusive, the last entry of the previous page.
+			if p.Id == start {
+				continue
+			}
+			if p.Idle >= sc.opts.ClaimMinIdle && int64(len(ids)) < sc.opts.BatchSize {
+				ids = append(ids, p.Id)
+				// xclaim increments the delivery count.
+				deliveries[p.Id] = p.RetryCount + 1
+			}
+		}
+		if int64(len(pending)) < count {
+			break
+		}
+		start = pending[len(pending)-1].Id
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	msgs, err := sc.client.XClaim(&redis.XClaimArgs{
+		Stream:   sc.stream,
+		Group:    sc.opts.Group,
+		Consumer: sc.opts.Consumer,
+		MinIdle:  sc.opts.ClaimMinIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	claimed := make([]*StreamMessage, 0, len(msgs))
+	for _, m := range msgs {
+		claimed = append(claimed, &StreamMessage{
+			ID:         m.ID,
+			Stream:     sc.stream,
+			Values:     m.Values,
+			Deliveries: deliveries[m.ID],
+		})
+	}
+	return claimed, nil
+}
+
+// deadLetter moves the message to the dead-letter stream and acknowledges it.
+func (sc *StreamConsumer) deadLetter(msg *StreamMessage) {
+	atomic.AddInt64(&sc.stats.Dead, 1)
+	if sc.deadStream != "" {
+		values := make(map[string]interface{}, len(msg.Values)+1)
+		for k, v := range msg.Values {
+			values[k] = v
+		}
+		values["origin_id"] = msg.ID
+		if err := sc.client.XAdd(&redis.XAddArgs{Stream: sc.deadStream, Values: values}).Err(); err != nil {
+			ozlog.Errorf("StreamConsumer(%s) dead-letter %s: %s", sc.stream, msg.ID, err.Error())
+			return
+		}
+	}
+	ozlog.Errorf("StreamConsumer(%s) message %s dead after %d deliveries", sc.stream, msg.ID, msg.Deliveries-1)
+	if err := sc.client.XAck(sc.stream, sc.opts.Group, msg.ID).Err(); err != nil {
+		ozlog.Errorf("StreamConsumer(%s).XAck(%s): %s", sc.stream, msg.ID, err.Error())
+	}
+}
+
+// handle calls the handler and acknowledges the message if it succeeds.
+func (sc *StreamConsumer) handle(msg *StreamMessage) {
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		err = sc.handler(msg)
+	}()
+	if err != nil {
+		atomic.AddInt64(&sc.stats.Failed, 1)
+		ozlog.Errorf("StreamConsumer(%s) message %s failed, deliveries: %d, err: %s", sc.stream, msg.ID, msg.Deliveries, err.Error())
+		return
+	}
+	if err = sc.client.XAck(sc.stream, sc.opts.Group, msg.ID).Err(); err != nil {
+		ozlog.Errorf("StreamConsumer(%s).XAck(%s): %s", sc.stream, msg.ID, err.Error())
+		return
+	}
+	atomic.AddInt64(&sc.stats.Acked, 1)
+}
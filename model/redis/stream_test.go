@@ -0,0 +1,113 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestStream(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	var (
+		m      = NewModule("ooz-test")
+		stream = "test_stream"
+		p      = NewStreamProducer(client, m, stream, 1000)
+		calls  int32
+	)
+	sc := NewStreamConsumer(client, m, stream, StreamConsumerOptions{
+		Group:            "test_group",
+		StartID:          "0",
+		Workers:          2,
+		Block:            100 * time.Millisecond,
+		ClaimMinIdle:     50 * time.Millisecond,
+		ClaimInterval:    50 * time.Millisecond,
+		MaxDeliveries:    2,
+		DeadLetterStream: stream + "_dead",
+	}, func(msg *StreamMessage) error {
+		atomic.AddInt32(&calls, 1)
+		if msg.Values["fail"] == "1" {
+			// idle long enough to be claimed again.
+			srv.Advance(50 * time.Millisecond)
+			return errors.New("fail")
+		}
+		return nil
+	})
+	for _, fail := range []string{"0", "1", "0"} {
+		if _, err := p.Add(map[string]interface{}{"fail": fail}); err != nil {
+			t.Fatalf("p.Add() err->%v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sc.Run(ctx); err != nil {
+		t.Fatalf("sc.Run() err->%v", err)
+	}
+	stats := sc.Stats()
+	if stats.Acked != 2 || stats.Failed != 2 || stats.Dead != 1 {
+		t.Fatalf("unexpected stats->%+v, calls->%d", stats, calls)
+	}
+	if n, err := client.XLen(m.GetKey(stream + "_dead")).Result(); err != nil || n != 1 {
+		t.Fatalf("dead letter stream len->%d, err->%v", n, err)
+	}
+}
+
+func TestStreamClaim(t *testing.T) {
+	client, srv := redistest.NewClient(t)
+	var (
+		m      = NewModule("ooz-test")
+		stream = "test_stream"
+		p      = NewStreamProducer(client, m, stream, 1000)
+		ids    []string
+	)
+	for i := 0; i < 5; i++ {
+		id, err := p.Add(map[string]interface{}{"n": i})
+		if err != nil {
+			t.Fatalf("p.Add() err->%v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := client.XGroupCreate(p.Stream(), "test_group", "0").Err(); err != nil {
+		t.Fatalf("XGroupCreate() err->%v", err)
+	}
+	if err := client.Do("xreadgroup", "group", "test_group", "other", "count", 5, "streams", p.Stream(), ">").Err(); err != nil {
+		t.Fatalf("XReadGroup() err->%v", err)
+	}
+	sc := NewStreamConsumer(client, m, stream, StreamConsumerOptions{
+		Group:        "test_group",
+		Consumer:     "test_consumer",
+		BatchSize:    2,
+		ClaimMinIdle: 50 * time.Millisecond,
+	}, nil)
+	srv.Advance(100 * time.Millisecond)
+	// the cursor is kept between the calls, the unacked messages are not
+	// claimed again before the rest of the pending list.
+	var claimed []string
+	for i := 0; i < 3; i++ {
+		msgs, err := sc.Claim()
+		if err != nil {
+			t.Fatalf("sc.Claim() err->%v", err)
+		}
+		for _, msg := range msgs {
+			claimed = append(claimed, msg.ID)
+		}
+		srv.Advance(100 * time.Millisecond)
+	}
+	if len(claimed) != 5 || claimed[4] != ids[4] {
+		t.Fatalf("sc.Claim() claimed->%v, want %v", claimed, ids)
+	}
+	// the pending list is paged through by XPENDING, past the messages
+	// that are not idle.
+	srv.Advance(100 * time.Millisecond)
+	if err := client.Do("xclaim", p.Stream(), "test_group", "other", 0, ids[0], ids[1], ids[2]).Err(); err != nil {
+		t.Fatalf("XClaim() err->%v", err)
+	}
+	msgs, err := sc.PendingClaim()
+	if err != nil || len(msgs) != 2 || msgs[0].ID != ids[3] || msgs[1].ID != ids[4] {
+		t.Fatalf("sc.PendingClaim() msgs->%v, err->%v", msgs, err)
+	}
+}
@@ -0,0 +1,262 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	ozlog "github.com/usthooz/oozlog/go"
+)
+
+// MessageHandler handles pub/sub messages.
+type MessageHandler func(msg *Message)
+
+// SubscriberOptions subscriber options.
+type SubscriberOptions struct {
+	// Maximum number of concurrent handlers, receiving blocks when reached.
+	// Default is 16.
+	Concurrency int
+	// The connection is pinged after being idle for PingInterval, and
+	// resubscribed if the ping fails.
+	// Default is 30 seconds.
+	PingInterval time.Duration
+	// Maximum backoff between resubscribes, the backoff starts from 100
+	// milliseconds and doubles on every failure.
+	// Default is 5 seconds.
+	MaxBackoff time.Duration
+	// OnSubscribe is called after every (re)subscribe, the messages published
+	// while disconnected are lost.
+	OnSubscribe func()
+}
+
+// init sets the default options.
+func (o *SubscriberOptions) init() {
+	if o.Concurrency <= 0 {
+		o.Concurrency = 16
+	}
+	if o.PingInterval <= 0 {
+		o.PingInterval = 30 * time.Second
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 5 * time.Second
+	}
+}
+
+// Subscriber pub/sub subscriber that routes messages to the handlers
+// registered by channel and pattern, and resubscribes after connection loss.
+type Subscriber struct {
+	client   *Client
+	opts     SubscriberOptions
+	mu       sync.Mutex
+	channels map[string]MessageHandler
+	patterns map[string]MessageHandler
+	pubsub   *PubSub
+	running  bool
+	sem      chan struct{}
+	wg       sync.WaitGroup
+}
+
+// ErrSubscriberRunning Subscriber.Run called twice.
+var ErrSubscriberRunning = errors.New("redis: subscriber is already running")
+
+// NewSubscriber creates subscriber.
+func NewSubscriber(c *Client, opts *SubscriberOptions) *Subscriber {
+	var o SubscriberOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	return &Subscriber{
+		client:   c,
+		opts:     o,
+		channels: make(map[string]MessageHandler),
+		patterns: make(map[string]MessageHandler),
+		sem:      make(chan struct{}, o.Concurrency),
+	}
+}
+
+// Handle registers handler for the channel, subscribes it if running.
+func (s *Subscriber) Handle(channel string, handler MessageHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.channels[channel]
+	s.channels[channel] = handler
+	if s.pubsub == nil || exists {
+		return nil
+	}
+	return s.pubsub.Subscribe(channel)
+}
+
+// HandlePattern registers handler for the pattern, subscribes it if running.
+func (s *Subscriber) HandlePattern(pattern string, handler MessageHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.patterns[pattern]
+	s.patterns[pattern] = handler
+	if s.pubsub == nil || exists {
+		return nil
+	}
+	return s.pubsub.PSubscribe(pattern)
+}
+
+// Remove removes the handler of the channel and unsubscribes it.
+func (s *Subscriber) Remove(channel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.channels, channel)
+	if s.pubsub == nil {
+		return nil
+	}
+	return s.pubsub.Unsubscribe(channel)
+}
+
+// RemovePattern removes the handler of the pattern and unsubscribes it.
+func (s *Subscriber) RemovePattern(pattern string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.patterns, pattern)
+	if s.pubsub == nil {
+		return nil
+	}
+	return s.pubsub.PUnsubscribe(pattern)
+}
+
+// Run receives and dispatches messages until ctx is done, then waits for
+// the running handlers.
+func (s *Subscriber) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return ErrSubscriberRunning
+	}
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+	// unblock the receiving on shutdown.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			if s.pubsub != nil {
+				s.pubsub.Close()
+			}
+			s.mu.Unlock()
+		case <-done:
+		}
+	}()
+	backoff := 100 * time.Millisecond
+	for ctx.Err() == nil {
+		ps, err := s.subscribe(ctx)
+		if err == nil {
+			backoff = 100 * time.Millisecond
+			if s.opts.OnSubscribe != nil {
+				s.opts.OnSubscribe()
+			}
+			err = s.receive(ps)
+		}
+		s.mu.Lock()
+		if s.pubsub == ps {
+			s.pubsub = nil
+		}
+		s.mu.Unlock()
+		if ps != nil {
+			ps.Close()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		ozlog.Errorf("Subscriber: %s, resubscribe after %s", err.Error(), backoff)
+		sleepContext(ctx, backoff)
+		if backoff *= 2; backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+	}
+	s.wg.Wait()
+	return nil
+}
+
+// subscribe creates pub/sub connection and subscribes all channels and patterns.
+func (s *Subscriber) subscribe(ctx context.Context) (*PubSub, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	var (
+		channels = make([]string, 0, len(s.channels))
+		patterns = make([]string, 0, len(s.patterns))
+	)
+	for channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	for pattern := range s.patterns {
+		patterns = append(patterns, pattern)
+	}
+	ps := s.client.Subscribe()
+	if len(channels) > 0 {
+		if err := ps.Subscribe(channels...); err != nil {
+			return ps, err
+		}
+	}
+	if len(patterns) > 0 {
+		if err := ps.PSubscribe(patterns...); err != nil {
+			return ps, err
+		}
+	}
+	s.pubsub = ps
+	return ps, nil
+}
+
+// receive receives and dispatches messages until the connection fails.
+func (s *Subscriber) receive(ps *PubSub) error {
+	for {
+		msg, err := ps.ReceiveTimeout(s.opts.PingInterval)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if err = ps.Ping(); err == nil {
+					continue
+				}
+			}
+			return err
+		}
+		if m, ok := msg.(*Message); ok {
+			s.dispatch(m)
+		}
+	}
+}
+
+// dispatch calls the handler of the message in a new goroutine.
+func (s *Subscriber) dispatch(msg *Message) {
+	s.mu.Lock()
+	var handler MessageHandler
+	if msg.Pattern != "" {
+		handler = s.patterns[msg.Pattern]
+	} else {
+		handler = s.channels[msg.Channel]
+	}
+	s.mu.Unlock()
+	if handler == nil {
+		return
+	}
+	s.sem <- struct{}{}
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ozlog.Errorf("Subscriber: handler of %s panic: %s", msg.Channel, fmt.Sprint(r))
+			}
+			<-s.sem
+			s.wg.Done()
+		}()
+		handler(msg)
+	}()
+}
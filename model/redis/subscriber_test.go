@@ -0,0 +1,44 @@
+package redis_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/usthooz/oozkits/model/redis"
+	"github.com/usthooz/oozkits/model/redis/redistest"
+)
+
+func TestSubscriber(t *testing.T) {
+	client, _ := redistest.NewClient(t)
+	var (
+		m                  = NewModule("ooz-test")
+		channelN, patternN int32
+		s                  = NewSubscriber(client, nil)
+	)
+	s.Handle(m.GetKey("channel"), func(msg *Message) {
+		atomic.AddInt32(&channelN, 1)
+	})
+	s.HandlePattern(m.GetKey("pattern:*"), func(msg *Message) {
+		atomic.AddInt32(&patternN, 1)
+		panic("recovered")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	client.Publish(m.GetKey("channel"), "1")
+	client.Publish(m.GetKey("pattern:a"), "2")
+	client.Publish(m.GetKey("pattern:b"), "3")
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("s.Run() err->%v", err)
+	}
+	if channelN != 1 || patternN != 2 {
+		t.Fatalf("handler calls: channel->%d, pattern->%d", channelN, patternN)
+	}
+}
@@ -0,0 +1,49 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// randomID returns a random 32 hex chars id.
+func randomID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand never fails on supported platforms.
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// unixMilli returns t as unix milliseconds.
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// hashTagKey returns the module key with the name as hash tag, so that all
+// keys of the same name are in the same cluster slot, .e.g. "mod:{name}:suffix".
+func hashTagKey(m *Module, name, suffix string) string {
+	return m.GetKey("{" + name + "}:" + suffix)
+}
+
+// sleepContext sleeps d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// nodeAddr returns the address of the node, or "" if unknown.
+func nodeAddr(node Cmdable) string {
+	if n, ok := node.(interface{ Options() *redis.Options }); ok {
+		return n.Options().Addr
+	}
+	return ""
+}